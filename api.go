@@ -63,7 +63,10 @@ func startEngine(ch chan bool, rebootChan chan bool) {
 			engine.LogFatal("init", logrus.Fields{"error": err}, "Error building config")
 		}
 
-		engine.PostConfig(cfg)
+		err = engine.PostConfig(cfg)
+		if err != nil {
+			engine.LogFatal("init", logrus.Fields{"error": err}, "Error preparing config")
+		}
 		bolt.BuiltinHandlers(engine)
 
 		strcfg, _ := json.Marshal(engine.Config)
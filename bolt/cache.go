@@ -5,7 +5,12 @@
 package bolt
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"math/big"
+	"strings"
 	"time"
 
 	"gopkg.in/go-redis/cache.v1"
@@ -14,90 +19,264 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
 )
 
+// Cache types, set with the cache section's type
+const (
+	CacheRedis  = "redis"  //Redis at the cache's host
+	CacheMemory = "memory" //LRU cache in the engine's memory, sized with maxEntries and maxBytes
+	CacheTiered = "tiered" //Memory cache in front of redis, for the hottest calls
+)
+
+// cacheBackend is where cached call results are kept, see SetupCache. Items are set with tags so they can be
+// purged together, see PurgeCache.
+type cacheBackend interface {
+	Set(key string, value string, expiration time.Duration, tags []string) error
+	Get(key string) (string, error) //Returns cache.ErrCacheMiss if key isn't cached
+	Delete(key string) error
+	DeleteTag(tag string) ([]string, error) //Deletes every item set with tag, returns their keys
+}
+
 // SetupCache uses the current config to connect and setup a cache system
 func (engine *Engine) SetupCache() error {
-	if engine.Config.Cache.Type == "" {
+	cacheExt := CacheExt{}
+	if engine.ConfigExt != nil {
+		cacheExt = engine.ConfigExt.Cache
+	}
+	switch engine.Config.Cache.Type {
+	case "":
+		return nil
+	case CacheRedis:
+		engine.cache = engine.redisCache()
 		return nil
-	} else if engine.Config.Cache.Type == "redis" {
-		timeout := time.Duration(engine.Config.Cache.TimeoutMs) * time.Millisecond
-
-		ring := redis.NewRing(&redis.RingOptions{
-			Addrs: map[string]string{
-				"server1": engine.Config.Cache.Host,
-			},
-			Password: engine.Config.Cache.Pass,
-
-			DialTimeout:  timeout,
-			ReadTimeout:  timeout,
-			WriteTimeout: timeout,
-		})
-
-		codec := &cache.Codec{
-			Ring: ring,
-
-			Marshal: func(v interface{}) ([]byte, error) {
-				return msgpack.Marshal(v)
-			},
-			Unmarshal: func(b []byte, v interface{}) error {
-				return msgpack.Unmarshal(b, v)
-			},
+	case CacheMemory:
+		engine.cache = newMemoryCache(cacheExt.Entries(), cacheExt.MaxBytes)
+		return nil
+	case CacheTiered:
+		engine.cache = &tieredCache{
+			local:           newMemoryCache(cacheExt.Entries(), cacheExt.MaxBytes),
+			remote:          engine.redisCache(),
+			localExpiration: cacheExt.LocalExpiration(),
 		}
-
-		engine.cacheCodec = codec
 		return nil
-	} else {
+	default:
 		return errors.New("Config error: Unsupported cache type")
 	}
 }
 
-// SetCacheItem adds an item to cache, forces non-local cache use
-func (engine *Engine) SetCacheItem(apicall string, inputjson string, value string, expiration time.Duration) error {
-	key := assembleCacheKey(apicall, inputjson)
-	if engine.cacheCodec != nil {
-		item := &cache.Item{
-			Key:               key,
-			Object:            value,
-			Expiration:        expiration,
-			DisableLocalCache: true,
+// redisCache connects to the redis at the cache's host
+func (engine *Engine) redisCache() *redisCache {
+	timeout := time.Duration(engine.Config.Cache.TimeoutMs) * time.Millisecond
+
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{
+			"server1": engine.Config.Cache.Host,
+		},
+		Password: engine.Config.Cache.Pass,
+
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	})
+
+	codec := &cache.Codec{
+		Ring: ring,
+
+		Marshal: func(v interface{}) ([]byte, error) {
+			return msgpack.Marshal(v)
+		},
+		Unmarshal: func(b []byte, v interface{}) error {
+			return msgpack.Unmarshal(b, v)
+		},
+	}
+	return &redisCache{codec: codec}
+}
+
+// redisCache keeps cached values in redis
+type redisCache struct {
+	codec *cache.Codec
+}
+
+// Set adds an item to redis, forces non-local cache use. Each tag is a redis set of the keys set with it, which
+// lives as long as its longest lived item.
+func (rc *redisCache) Set(key string, value string, expiration time.Duration, tags []string) error {
+	item := &cache.Item{
+		Key:               key,
+		Object:            value,
+		Expiration:        expiration,
+		DisableLocalCache: true,
+	}
+	err := rc.codec.Set(item)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		err = rc.tag(tag, key, expiration)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tag adds key to tag's set, keeping the set until an item set with expiration would expire
+func (rc *redisCache) tag(tag, key string, expiration time.Duration) error {
+	existed, err := rc.codec.Ring.Exists(tag).Result()
+	if err != nil {
+		return err
+	}
+	err = rc.codec.Ring.SAdd(tag, key).Err()
+	if err != nil {
+		return err
+	}
+	if !existed {
+		if expiration > 0 {
+			return rc.codec.Ring.Expire(tag, expiration).Err()
+		}
+		return nil
+	}
+	ttl, err := rc.codec.Ring.TTL(tag).Result()
+	if err != nil || ttl < 0 { //already kept for an item without expiration
+		return err
+	}
+	if expiration == 0 {
+		return rc.codec.Ring.Persist(tag).Err()
+	} else if ttl < expiration {
+		return rc.codec.Ring.Expire(tag, expiration).Err()
+	}
+	return nil
+}
+
+// Get returns an item from redis
+func (rc *redisCache) Get(key string) (string, error) {
+	var value string
+	err := rc.codec.Get(key, &value)
+	return value, err
+}
+
+// Delete removes an item from redis
+func (rc *redisCache) Delete(key string) error {
+	return rc.codec.Delete(key)
+}
+
+// DeleteTag removes every item set with tag from redis. Keys in the tag's set that already expired aren't returned.
+func (rc *redisCache) DeleteTag(tag string) ([]string, error) {
+	keys, err := rc.codec.Ring.SMembers(tag).Result()
+	if err != nil {
+		return nil, err
+	}
+	deleted := []string{}
+	for _, key := range keys {
+		n, err := rc.codec.Ring.Del(key).Result() //keys can be on different shards, so one at a time
+		if err != nil {
+			return deleted, err
+		}
+		if n > 0 {
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted, rc.codec.Ring.Del(tag).Err()
+}
+
+// cacheEntry is how an item is kept in the cache, so its age is known
+type cacheEntry struct {
+	Value   string    `json:"value"`
+	Time    time.Time `json:"time"`    //When it was cached
+	Expires time.Time `json:"expires"` //When it goes stale, zero if it doesn't
+}
+
+// Age returns how long ago the entry was cached
+func (entry *cacheEntry) Age() time.Duration {
+	return time.Since(entry.Time)
+}
+
+// Stale returns true if the entry is past its expiration
+func (entry *cacheEntry) Stale() bool {
+	return !entry.Expires.IsZero() && time.Now().After(entry.Expires)
+}
+
+// StaleFor returns true if the entry is stale, but for less than grace
+func (entry *cacheEntry) StaleFor(grace time.Duration) bool {
+	return entry.Stale() && time.Now().Before(entry.Expires.Add(grace))
+}
+
+// SetCacheItem adds an item to cache, tags let it be purged along with other items, see PurgeCache. An item is
+// kept past expiration for as long as the api call's cache policy may still serve it stale.
+func (engine *Engine) SetCacheItem(apicall string, inputjson string, value string, expiration time.Duration, tags ...string) error {
+	key := engine.cacheKey(apicall, inputjson)
+	if engine.cache != nil {
+		entry := cacheEntry{Value: value, Time: time.Now()}
+		keep := expiration
+		if expiration > 0 {
+			entry.Expires = entry.Time.Add(expiration)
+			keep += engine.ConfigExt.Call(apicall).Cache.Grace()
 		}
-		res := engine.cacheCodec.Set(item)
-		return res
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		cacheTags := []string{cacheCallTag(apicall)}
+		for _, tag := range tags {
+			cacheTags = append(cacheTags, cacheTag(tag))
+		}
+		return engine.cache.Set(key, string(data), keep, cacheTags)
 	}
 	return nil
 }
 
-// GetCacheItem tries to get an item from cache if possible
+// GetCacheItem tries to get an item from cache if possible, stale items are a miss
 func (engine *Engine) GetCacheItem(apicall string, inputjson string) (string, error) {
-	key := assembleCacheKey(apicall, inputjson)
-	if engine.cacheCodec != nil {
-		var value string
-		err := engine.cacheCodec.Get(key, &value)
-		return value, err
+	entry, err := engine.getCacheEntry(apicall, inputjson)
+	if err != nil {
+		return "", err
 	}
-	return "", errors.New("No cache enabled")
+	if entry.Stale() {
+		return "", cache.ErrCacheMiss
+	}
+	return entry.Value, nil
+}
+
+// getCacheEntry gets an item from cache along with its age, whether it's stale or not
+func (engine *Engine) getCacheEntry(apicall string, inputjson string) (*cacheEntry, error) {
+	if engine.cache == nil {
+		return nil, errors.New("No cache enabled")
+	}
+	data, err := engine.cache.Get(engine.cacheKey(apicall, inputjson))
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	err = json.Unmarshal([]byte(data), entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
 }
 
 // DelCacheItem attempts to force-delete a cached key
 func (engine *Engine) DelCacheItem(apicall string, inputjson string) error {
-	key := assembleCacheKey(apicall, inputjson)
-	if engine.cacheCodec != nil {
-		err := engine.cacheCodec.Delete(key)
-		return err
+	key := engine.cacheKey(apicall, inputjson)
+	if engine.cache != nil {
+		return engine.cache.Delete(key)
 	}
 	return nil
 }
 
 // CacheCallResult sets the cache for an commandprocess if applicable
 func (engine *Engine) CacheCallResult(cp *commandprocess.CommandProcess) error {
-	if engine.cacheCodec != nil {
+	if engine.cache != nil {
 		if cp.APICall.Cache.Enabled {
 			inputstr := cp.InitialInputString //issue #40, change to use a snapshot/copy of initial input in case workers accidentally change it
+			if engine.ConfigExt.Call(cp.InitialCommand).Cache.StaleIfErrorSec > 0 && hasErrors(cp.Payload) {
+				engine.LogInfo("cache_skip", logrus.Fields{"id": cp.ID, "command": cp.InitialCommand, "input": inputstr}, "Failed result not cached, the stale result is kept")
+				return nil
+			}
 			retval := cp.Payload.Path("return_value").String()
-			err := engine.SetCacheItem(engine.Config.Engine.Advanced.QueuePrefix+cp.InitialCommand, inputstr, retval, cp.APICall.Cache.ExpirationTime)
+			tags := cacheTags(cp.Payload)
+			err := engine.SetCacheItem(cp.InitialCommand, inputstr, retval, cp.APICall.Cache.ExpirationTime, tags...)
 			if err == nil {
-				engine.LogInfo("cache_set", logrus.Fields{"id": cp.ID, "command": cp.InitialCommand, "input": inputstr}, "Cache set")
+				engine.LogInfo("cache_set", logrus.Fields{"id": cp.ID, "command": cp.InitialCommand, "input": inputstr, "tags": tags}, "Cache set")
 			} else {
 				engine.LogWarn("cache_error", nil, err.Error())
 			}
@@ -107,7 +286,62 @@ func (engine *Engine) CacheCallResult(cp *commandprocess.CommandProcess) error {
 	return nil
 }
 
-// assembleCacheKey combines an api call name with the input params for use as a cache key name
+// cacheKey returns the key an api call's result is cached under for inputjson, see assembleCacheKey. Calls with
+// cacheKeyFields only use those fields of the input.
+func (engine *Engine) cacheKey(apicall, inputjson string) string {
+	return assembleCacheKey(apicall, canonicalInput(inputjson, engine.ConfigExt.Call(apicall).CacheKeyFields))
+}
+
+// assembleCacheKey combines an api call name with a hash of the input params for use as a cache key name
 func assembleCacheKey(apicall, inputjson string) string {
-	return apicall + "$$$" + inputjson
+	sum := sha256.Sum256([]byte(inputjson))
+	return apicall + "$$$" + hex.EncodeToString(sum[:])
+}
+
+// canonicalInput returns inputjson with its object keys sorted, whitespace removed and numbers written the same
+// way, so equal inputs make equal cache keys. If fields are given, only those paths of the input are kept, missing
+// ones as null. Input that isn't json is returned as is.
+func canonicalInput(inputjson string, fields []string) string {
+	decoder := json.NewDecoder(strings.NewReader(inputjson))
+	decoder.UseNumber()
+	var input interface{}
+	err := decoder.Decode(&input)
+	if err != nil {
+		return inputjson
+	}
+	if len(fields) > 0 {
+		container, _ := gabs.Consume(input)
+		picked := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			picked[field] = container.Path(field).Data()
+		}
+		input = picked
+	}
+	canonical, err := json.Marshal(canonicalNumbers(input)) //Marshal sorts object keys
+	if err != nil {
+		return inputjson
+	}
+	return string(canonical)
+}
+
+// canonicalNumbers rewrites the json.Numbers in v so the same value is always written the same way, 1.0, 1e0
+// and 1 are all written as 1
+func canonicalNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		f, _, err := big.ParseFloat(string(value), 10, 256, big.ToNearestEven)
+		if err != nil {
+			return value
+		}
+		return json.Number(f.Text('g', -1))
+	case map[string]interface{}:
+		for k, child := range value {
+			value[k] = canonicalNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range value {
+			value[i] = canonicalNumbers(child)
+		}
+	}
+	return v
 }
@@ -0,0 +1,192 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"gopkg.in/go-redis/cache.v1"
+)
+
+// memoryCache is an LRU cache in the engine's memory. When it's over its entry or byte limit, the least recently
+// used items are evicted. Expired items are dropped when they're next read or evicted.
+type memoryCache struct {
+	mutex      sync.Mutex
+	maxEntries int   //0 for no limit
+	maxBytes   int64 //0 for no limit
+	bytes      int64
+	items      map[string]*list.Element
+	order      *list.List                     //Most recently used at the front
+	tags       map[string]map[string]struct{} //Keys set with each tag
+}
+
+// memoryItem is an entry of a memoryCache
+type memoryItem struct {
+	key     string
+	value   string
+	expires time.Time //Zero if it doesn't expire
+	tags    []string
+}
+
+// size is what an item counts against the cache's maxBytes
+func (item *memoryItem) size() int64 {
+	return int64(len(item.key) + len(item.value))
+}
+
+// newMemoryCache returns an empty memoryCache holding up to maxEntries items and maxBytes of keys and values
+func newMemoryCache(maxEntries int, maxBytes int64) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+		tags:       make(map[string]map[string]struct{}),
+	}
+}
+
+// Set adds or replaces an item, an expiration of 0 never expires. Items bigger than maxBytes aren't kept.
+func (mc *memoryCache) Set(key string, value string, expiration time.Duration, tags []string) error {
+	item := &memoryItem{key: key, value: value, tags: tags}
+	if expiration > 0 {
+		item.expires = time.Now().Add(expiration)
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if el, ok := mc.items[key]; ok {
+		mc.remove(el)
+	}
+	if mc.maxBytes > 0 && item.size() > mc.maxBytes {
+		return nil
+	}
+	mc.items[key] = mc.order.PushFront(item)
+	mc.bytes += item.size()
+	for _, tag := range tags {
+		if mc.tags[tag] == nil {
+			mc.tags[tag] = make(map[string]struct{})
+		}
+		mc.tags[tag][key] = struct{}{}
+	}
+	for (mc.maxEntries > 0 && mc.order.Len() > mc.maxEntries) || (mc.maxBytes > 0 && mc.bytes > mc.maxBytes) {
+		mc.remove(mc.order.Back())
+	}
+	return nil
+}
+
+// Get returns an item and marks it as recently used
+func (mc *memoryCache) Get(key string) (string, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	el, ok := mc.items[key]
+	if !ok {
+		return "", cache.ErrCacheMiss
+	}
+	item := el.Value.(*memoryItem)
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		mc.remove(el)
+		return "", cache.ErrCacheMiss
+	}
+	mc.order.MoveToFront(el)
+	return item.value, nil
+}
+
+// Delete removes an item
+func (mc *memoryCache) Delete(key string) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	el, ok := mc.items[key]
+	if !ok {
+		return cache.ErrCacheMiss
+	}
+	mc.remove(el)
+	return nil
+}
+
+// DeleteTag removes every item set with tag
+func (mc *memoryCache) DeleteTag(tag string) ([]string, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	deleted := []string{}
+	for key := range mc.tags[tag] {
+		mc.remove(mc.items[key])
+		deleted = append(deleted, key)
+	}
+	return deleted, nil
+}
+
+// Len returns how many items are cached, including expired ones that haven't been dropped yet
+func (mc *memoryCache) Len() int {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.order.Len()
+}
+
+// remove drops el from the cache, mutex must be held
+func (mc *memoryCache) remove(el *list.Element) {
+	item := mc.order.Remove(el).(*memoryItem)
+	delete(mc.items, item.key)
+	mc.bytes -= item.size()
+	for _, tag := range item.tags {
+		delete(mc.tags[tag], item.key)
+		if len(mc.tags[tag]) == 0 {
+			delete(mc.tags, tag)
+		}
+	}
+}
+
+// tieredCache keeps a short lived memory copy of items in front of a remote cache, so hot items don't need a
+// round trip. Deletes on other engine nodes only reach this node's memory copy when it expires.
+type tieredCache struct {
+	local           *memoryCache
+	remote          cacheBackend
+	localExpiration time.Duration //Longest an item stays in memory
+}
+
+// Set adds an item to both tiers
+func (tc *tieredCache) Set(key string, value string, expiration time.Duration, tags []string) error {
+	tc.local.Set(key, value, tc.localTTL(expiration), tags)
+	return tc.remote.Set(key, value, expiration, tags)
+}
+
+// Get returns an item from memory, or from the remote cache if it isn't in memory
+func (tc *tieredCache) Get(key string) (string, error) {
+	value, err := tc.local.Get(key)
+	if err == nil {
+		return value, nil
+	}
+	value, err = tc.remote.Get(key)
+	if err != nil {
+		return value, err
+	}
+	tc.local.Set(key, value, tc.localExpiration, nil) //the remote cache has the tags, see DeleteTag
+	return value, nil
+}
+
+// Delete removes an item from both tiers
+func (tc *tieredCache) Delete(key string) error {
+	tc.local.Delete(key)
+	return tc.remote.Delete(key)
+}
+
+// DeleteTag removes every item set with tag from both tiers. Memory copies made by Get don't have tags, so they're
+// found through the remote cache's keys.
+func (tc *tieredCache) DeleteTag(tag string) ([]string, error) {
+	tc.local.DeleteTag(tag)
+	deleted, err := tc.remote.DeleteTag(tag)
+	for _, key := range deleted {
+		tc.local.Delete(key)
+	}
+	return deleted, err
+}
+
+// localTTL returns how long an item with expiration stays in memory
+func (tc *tieredCache) localTTL(expiration time.Duration) time.Duration {
+	if expiration > 0 && expiration < tc.localExpiration {
+		return expiration
+	}
+	return tc.localExpiration
+}
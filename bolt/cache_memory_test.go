@@ -0,0 +1,128 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-redis/cache.v1"
+)
+
+func TestMemoryCacheEntries(t *testing.T) {
+	mc := newMemoryCache(2, 0)
+	mc.Set("a", "1", 0, nil)
+	mc.Set("b", "2", 0, nil)
+	_, err := mc.Get("a") //b is now the least recently used
+	assert.Nil(t, err, "a should be cached")
+	mc.Set("c", "3", 0, nil)
+
+	_, err = mc.Get("b")
+	assert.Equal(t, cache.ErrCacheMiss, err, "b should be evicted")
+	value, _ := mc.Get("a")
+	assert.Equal(t, "1", value, "a should be kept")
+	assert.Equal(t, 2, mc.Len(), "Should hold maxEntries")
+
+	mc.Set("a", "4", 0, nil)
+	value, _ = mc.Get("a")
+	assert.Equal(t, "4", value, "Set should replace")
+	assert.Nil(t, mc.Delete("a"), "Delete should succeed")
+	assert.Equal(t, cache.ErrCacheMiss, mc.Delete("a"), "Deleting twice should miss")
+}
+
+func TestMemoryCacheBytes(t *testing.T) {
+	mc := newMemoryCache(0, 10)
+	mc.Set("a", "1234", 0, nil)
+	mc.Set("b", "1234", 0, nil)
+	assert.Equal(t, 2, mc.Len(), "Both should fit")
+	mc.Set("c", "1234", 0, nil)
+	assert.Equal(t, 2, mc.Len(), "Oldest should be evicted")
+	_, err := mc.Get("a")
+	assert.Equal(t, cache.ErrCacheMiss, err, "a should be evicted")
+
+	mc.Set("big", "12345678901", 0, nil)
+	_, err = mc.Get("big")
+	assert.Equal(t, cache.ErrCacheMiss, err, "Items over maxBytes shouldn't be kept")
+	assert.Equal(t, int64(10), mc.bytes, "Should count the kept bytes")
+}
+
+func TestMemoryCacheExpiration(t *testing.T) {
+	mc := newMemoryCache(10, 0)
+	mc.Set("short", "1", 10*time.Millisecond, nil)
+	mc.Set("forever", "2", 0, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := mc.Get("short")
+	assert.Equal(t, cache.ErrCacheMiss, err, "Expired items should miss")
+	_, err = mc.Get("forever")
+	assert.Nil(t, err, "Items without expiration should be kept")
+	assert.Equal(t, 1, mc.Len(), "Expired items should be dropped when read")
+}
+
+func TestMemoryCacheTags(t *testing.T) {
+	mc := newMemoryCache(2, 0)
+	mc.Set("a", "1", 0, []string{"x", "y"})
+	mc.Set("b", "2", 0, []string{"x"})
+	keys, _ := mc.DeleteTag("y")
+	assert.Equal(t, []string{"a"}, keys, "Should delete the tagged item")
+	_, err := mc.Get("b")
+	assert.Nil(t, err, "Other items should be kept")
+
+	mc.Set("c", "3", 0, nil)
+	mc.Set("d", "4", 0, nil) //evicts b
+	keys, _ = mc.DeleteTag("x")
+	assert.Empty(t, keys, "Evicted items should leave the tag")
+	assert.Empty(t, mc.tags, "Empty tags should be dropped")
+}
+
+func TestTieredCache(t *testing.T) {
+	remote := newMemoryCache(10, 0)
+	tc := &tieredCache{local: newMemoryCache(10, 0), remote: remote, localExpiration: time.Minute}
+
+	tc.Set("a", "1", 0, nil)
+	value, _ := remote.Get("a")
+	assert.Equal(t, "1", value, "Set should reach the remote cache")
+
+	remote.Set("b", "2", 0, nil)
+	value, err := tc.Get("b")
+	assert.Nil(t, err, "Remote items should be found")
+	assert.Equal(t, "2", value, "Should get the remote value")
+	remote.Delete("b")
+	value, _ = tc.Get("b")
+	assert.Equal(t, "2", value, "Remote hits should be kept in memory")
+
+	remote.Set("c", "3", 0, []string{"x"})
+	tc.Get("c")
+	keys, _ := tc.DeleteTag("x")
+	assert.Equal(t, []string{"c"}, keys, "Should delete remote tagged items")
+	_, err = tc.local.Get("c")
+	assert.Equal(t, cache.ErrCacheMiss, err, "Memory copies should be deleted with the tag")
+
+	tc.Delete("a")
+	_, err = tc.Get("a")
+	assert.Equal(t, cache.ErrCacheMiss, err, "Delete should clear both tiers")
+	assert.Equal(t, 5*time.Second, tc.localTTL(5*time.Second), "Short expirations should be kept")
+	assert.Equal(t, time.Minute, tc.localTTL(0), "Memory copies should expire")
+}
+
+func TestSetupCacheMemory(t *testing.T) {
+	engine := memoryEngine()
+	engine.Config.Cache.Type = CacheMemory
+	assert.Nil(t, engine.SetupCache(), "Memory cache should set up")
+
+	engine.SetCacheItem("v1/test", `{"a":1}`, `{"b":2}`, time.Minute)
+	value, err := engine.GetCacheItem("v1/test", `{"a":1}`)
+	assert.Nil(t, err, "Should be cached")
+	assert.Equal(t, `{"b":2}`, value, "Should get the cached value")
+	engine.DelCacheItem("v1/test", `{"a":1}`)
+	_, err = engine.GetCacheItem("v1/test", `{"a":1}`)
+	assert.NotNil(t, err, "Should be deleted")
+
+	engine = &Engine{Config: &config.Config{}}
+	engine.Config.Cache.Type = "memcached"
+	assert.NotNil(t, engine.SetupCache(), "Unknown cache types should error")
+}
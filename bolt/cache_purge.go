@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+	"gopkg.in/go-redis/cache.v1"
+)
+
+// CachePurge picks the cached results to purge, see PurgeCache. It's the body of /cache-purge and the
+// cache_purge payload of the CachePurgeCommandName command.
+type CachePurge struct {
+	Call  string          `json:"call"`  //Purges every cached result of the api call, or only the one for input
+	Input json.RawMessage `json:"input"` //Input of the cached result, compared like a cache key so key order doesn't matter
+	Tags  []string        `json:"tags"`  //Purges every cached result a worker tagged with one of these, see CacheTagsKey
+}
+
+// CacheTagsKey is the payload key workers set to a list of tags when a cacheable call's result should be purgeable
+// by tag, e.g. ["product:123"]
+const CacheTagsKey = "cache_tags"
+
+// CachePurgeKey is the payload key holding the CachePurge a CachePurgeCommandName command runs
+const CachePurgeKey = "cache_purge"
+
+// PurgeCache deletes cached results by exact call and input, by call, or by tag. Returns how many were deleted.
+func (engine *Engine) PurgeCache(purge CachePurge) (int, error) {
+	if engine.cache == nil {
+		return 0, errors.New("No cache enabled")
+	}
+	hasInput := len(purge.Input) > 0 && string(purge.Input) != "null"
+	if purge.Call == "" && hasInput {
+		return 0, errors.New("input needs a call")
+	}
+	if purge.Call == "" && len(purge.Tags) == 0 {
+		return 0, errors.New("nothing to purge, give a call or tags")
+	}
+
+	deleted := 0
+	if purge.Call != "" && hasInput {
+		err := engine.DelCacheItem(purge.Call, string(purge.Input))
+		if err == nil {
+			deleted++
+		} else if err != cache.ErrCacheMiss {
+			return deleted, err
+		}
+	} else if purge.Call != "" {
+		keys, err := engine.cache.DeleteTag(cacheCallTag(purge.Call))
+		deleted += len(keys)
+		if err != nil {
+			return deleted, err
+		}
+	}
+	for _, tag := range purge.Tags {
+		keys, err := engine.cache.DeleteTag(cacheTag(tag))
+		deleted += len(keys)
+		if err != nil {
+			return deleted, err
+		}
+	}
+	engine.LogInfo("cache_purge", logrus.Fields{"call": purge.Call, "input": string(purge.Input), "tags": purge.Tags, "deleted": deleted}, "Cache purged")
+	engine.Stats.Ch("general").Ch("cache_purges").Incr()
+	return deleted, nil
+}
+
+// purgeCommand runs the CachePurgeCommandName command for proc, purging what its payload's cache_purge picks.
+// The outcome is added to the trace, or logged with tracing off. A failed purge doesn't stop the call.
+func (engine *Engine) purgeCommand(proc *commandprocess.CommandProcess) {
+	purge := CachePurge{}
+	proc.Mutex.Lock()
+	raw := proc.Payload.Path(CachePurgeKey).String()
+	proc.Payload.DeleteP(CachePurgeKey)
+	proc.Mutex.Unlock()
+
+	deleted := 0
+	err := json.Unmarshal([]byte(raw), &purge)
+	if err == nil {
+		deleted, err = engine.PurgeCache(purge)
+	}
+	fields := map[string]interface{}{"purged": deleted}
+	if err != nil {
+		fields["error"] = err.Error()
+		engine.LogWarn("cache_purge_error", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "err": err}, "Cache purge command failed")
+	}
+	if engine.Config.Engine.TraceEnabled {
+		proc.AddTraceEntryWith(CachePurgeCommandName, fields)
+	} else {
+		engine.LogInfo("cache_purge_command", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "outcome": fields}, "Cache purge command ran")
+	}
+}
+
+// cacheTags returns the tags a worker set on payload, see CacheTagsKey
+func cacheTags(payload *gabs.Container) []string {
+	list, _ := payload.Path(CacheTagsKey).Data().([]interface{})
+	tags := []string{}
+	for _, tag := range list {
+		if s, ok := tag.(string); ok && s != "" {
+			tags = append(tags, s)
+		}
+	}
+	return tags
+}
+
+// cacheCallTag is the tag every cached result of apicall is set with
+func cacheCallTag(apicall string) string {
+	return "$$$call$$$" + apicall
+}
+
+// cacheTag is the backend tag for a tag workers set, kept apart from call tags
+func cacheTag(tag string) string {
+	return "$$$tag$$$" + tag
+}
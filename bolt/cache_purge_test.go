@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+// purgeEngine returns an engine with a memory cache holding a few results of two calls
+func purgeEngine() *Engine {
+	engine := memoryEngine()
+	engine.Config.Cache.Type = CacheMemory
+	engine.SetupCache()
+	engine.SetCacheItem("v1/product", `{"sku": "1"}`, `{}`, time.Minute, "product:1")
+	engine.SetCacheItem("v1/product", `{"sku": "2"}`, `{}`, time.Minute, "product:2")
+	engine.SetCacheItem("v1/list", `{}`, `{}`, time.Minute, "product:1", "product:2")
+	return engine
+}
+
+func TestPurgeCache(t *testing.T) {
+	engine := purgeEngine()
+	deleted, err := engine.PurgeCache(CachePurge{Call: "v1/product", Input: json.RawMessage(`{ "sku":"1" }`)})
+	assert.Nil(t, err, "Exact purge should succeed")
+	assert.Equal(t, 1, deleted, "Should purge the one result")
+	_, err = engine.GetCacheItem("v1/product", `{"sku": "2"}`)
+	assert.Nil(t, err, "Other inputs should be kept")
+	deleted, _ = engine.PurgeCache(CachePurge{Call: "v1/product", Input: json.RawMessage(`{"sku": "1"}`)})
+	assert.Equal(t, 0, deleted, "Purging twice shouldn't find anything")
+
+	engine = purgeEngine()
+	deleted, _ = engine.PurgeCache(CachePurge{Call: "v1/product"})
+	assert.Equal(t, 2, deleted, "Should purge every result of the call")
+	_, err = engine.GetCacheItem("v1/list", `{}`)
+	assert.Nil(t, err, "Other calls should be kept")
+
+	engine = purgeEngine()
+	deleted, _ = engine.PurgeCache(CachePurge{Tags: []string{"product:2"}})
+	assert.Equal(t, 2, deleted, "Should purge every result with the tag")
+	_, err = engine.GetCacheItem("v1/product", `{"sku": "1"}`)
+	assert.Nil(t, err, "Untagged results should be kept")
+
+	_, err = engine.PurgeCache(CachePurge{})
+	assert.NotNil(t, err, "Empty purges should error")
+	_, err = engine.PurgeCache(CachePurge{Input: json.RawMessage(`{}`)})
+	assert.NotNil(t, err, "Input needs a call")
+	_, err = memoryEngine().PurgeCache(CachePurge{Call: "v1/product"})
+	assert.NotNil(t, err, "Purging without a cache should error")
+}
+
+func TestCacheTags(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(`{"cache_tags": ["product:1", 5, "", "sku:1"]}`))
+	assert.Equal(t, []string{"product:1", "sku:1"}, cacheTags(payload), "Should keep the string tags")
+	assert.Empty(t, cacheTags(gabs.New()), "Payloads without tags should be empty")
+
+	engine := memoryEngine()
+	engine.Config.Cache.Type = CacheMemory
+	engine.SetupCache()
+	payload, _ = gabs.ParseJSON([]byte(`{"return_value": {"name": "x"}, "cache_tags": ["product:1"]}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/product", &config.APICall{Cache: config.CacheInfo{Enabled: true}}, payload, "group", "")
+	proc.SetInitialInput(gabs.New())
+	engine.CacheCallResult(proc)
+	deleted, _ := engine.PurgeCache(CachePurge{Tags: []string{"product:1"}})
+	assert.Equal(t, 1, deleted, "CacheCallResult should tag the result")
+}
+
+func TestPurgeCommand(t *testing.T) {
+	engine := purgeEngine()
+	engine.Config.Engine.TraceEnabled = true
+	payload, _ := gabs.ParseJSON([]byte(`{"cache_purge": {"tags": ["product:1"]}}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/update", &config.APICall{}, payload, "group", "")
+	engine.purgeCommand(proc)
+
+	_, err := engine.GetCacheItem("v1/product", `{"sku": "1"}`)
+	assert.NotNil(t, err, "Tagged results should be purged")
+	assert.False(t, proc.Payload.ExistsP(CachePurgeKey), "The purge should be taken out of the payload")
+	trace, _ := proc.Payload.S("trace").Children()
+	assert.Equal(t, CachePurgeCommandName, trace[0].Path("command").Data(), "The purge should be traced")
+	assert.EqualValues(t, 2, trace[0].Path("purged").Data(), "The trace should count the purged results")
+
+	proc = commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/update", &config.APICall{}, gabs.New(), "group", "")
+	engine.purgeCommand(proc)
+	trace, _ = proc.Payload.S("trace").Children()
+	assert.NotNil(t, trace[0].Path("error").Data(), "Failed purges should be traced")
+}
+
+func TestPurgeCommandCall(t *testing.T) {
+	engine := callEngine(t, `{"apiCalls": {"v1/update": {"resultZombieMs": 2000, "commands": [
+		{"name": "product/save"}, {"name": "product/log"}]}}}`,
+		map[string]stubWorker{
+			"product/save": func(payload *gabs.Container) bool {
+				payload.SetP([]interface{}{"product:1"}, "cache_purge.tags")
+				payload.SetP(CachePurgeCommandName, "nextCommand")
+				return true
+			},
+			"product/log": func(payload *gabs.Container) bool {
+				payload.SetP(true, "return_value.logged")
+				return true
+			},
+		})
+	engine.Config.Cache.Type = CacheMemory
+	engine.SetupCache()
+	engine.SetCacheItem("v1/product", `{"sku": "1"}`, `{}`, time.Minute, "product:1")
+
+	proc := runCall(t, engine, "v1/update", `{}`)
+	assert.False(t, hasErrors(proc.Payload), "Call should succeed")
+	assert.Equal(t, true, proc.Payload.Path("return_value.logged").Data(), "Call should carry on after the purge")
+	_, err := engine.GetCacheItem("v1/product", `{"sku": "1"}`)
+	assert.NotNil(t, err, "Tagged results should be purged")
+	trace, _ := proc.Payload.S("trace").Children()
+	assert.Empty(t, trace, "Purges shouldn't be traced with tracing off")
+}
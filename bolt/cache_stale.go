@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+)
+
+// setCacheAge marks payload as a cached result, reporting whether it's stale and how old it is
+func setCacheAge(payload *gabs.Container, entry *cacheEntry) {
+	payload.SetP(true, "cached")
+	payload.SetP(entry.Stale(), "stale")
+	payload.SetP(int64(entry.Age()/time.Second), "cache_age_sec")
+}
+
+// revalidate refreshes the cached result of apicall for input with a work call in the background, while the stale
+// result is served. If an identical call is already in flight, its result refreshes the cache instead. Returns
+// the call doing the refresh.
+func (engine *Engine) revalidate(cmd string, apicall config.APICall, input *gabs.Container, group string) *commandprocess.CommandProcess {
+	payload, _ := gabs.ParseJSON([]byte(commandprocess.EmptyPayload))
+	proc := engine.Requests.CreateRequest(commandprocess.CallTypeWork, cmd, &apicall, payload, group, "")
+	proc.Payload.SetP(time.Now(), "call_in")
+	proc.SetInitialInput(input)
+	proc.Payload.SetP(proc.ID, "id")
+
+	if leader := engine.coalesceCall(proc, input.String()); leader != nil {
+		engine.Requests.RemoveRequest(proc.ID)
+		return leader
+	}
+	engine.LogInfo("cache_revalidate", logrus.Fields{"id": proc.ID, "command": cmd, "input": proc.InitialInputString}, "Refreshing stale cache")
+	engine.Stats.Ch("general").Ch("cache_revalidations").Incr()
+	go engine.processCall(proc)
+	return proc
+}
+
+// followStale stands in for processCall when proc has a stale result to fall back on. work is the call refreshing
+// the cache, see revalidate, proc gets a copy of its result if it succeeds within proc's result timeout. If it
+// fails, or is still running, proc gets entry's result instead. work carries on and refreshes the cache if it
+// succeeds later, it never touches proc.
+func (engine *Engine) followStale(proc, work *commandprocess.CommandProcess, entry *cacheEntry) {
+	done := waitForLeader(proc, work, proc.APICall.ResultTimeout)
+	if proc.IsCancelled() {
+		engine.cancelCall(proc, nil)
+		return
+	}
+
+	failure := gabs.New()
+	switch {
+	case !done:
+		bolterror.NewBoltError(nil, "timeout", "API Call timeout, serving stale cache", proc.InitialCommand, bolterror.Timeout).AddToPayload(failure)
+	case work.IsCancelled():
+		bolterror.NewBoltError(nil, "cancelled", "API Call cancelled, serving stale cache", proc.InitialCommand, bolterror.Cancelled).AddToPayload(failure)
+	default:
+		work.Mutex.RLock()
+		if hasErrors(work.Payload) {
+			failure.SetP(work.Payload.Path("error").Data(), "error")
+		}
+		work.Mutex.RUnlock()
+	}
+	if !hasErrors(failure) {
+		engine.shareResult(proc, work)
+		return
+	}
+	engine.serveStale(proc, entry, failure.Path("error").Data())
+}
+
+// serveStale completes proc with entry's result, keeping the errors of the call that failed as stale_error
+func (engine *Engine) serveStale(proc *commandprocess.CommandProcess, entry *cacheEntry, failure interface{}) {
+	returnvalue, err := gabs.ParseJSON([]byte(entry.Value))
+	proc.Mutex.Lock()
+	if err != nil {
+		bolterror.NewBoltError(err, "cache", "Stale cached value couldn't be parsed to JSON", proc.InitialCommand, bolterror.Internal).AddToPayload(proc.Payload)
+	} else {
+		proc.Payload.SetP(returnvalue.Data(), "return_value")
+		proc.Payload.SetP(failure, "stale_error")
+		setCacheAge(proc.Payload, entry)
+	}
+	proc.Mutex.Unlock()
+	engine.LogWarn("cache_stale", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "error": failure}, "Call failed, serving stale cache")
+	engine.Stats.Ch("general").Ch("cache_stale_errors").Incr()
+
+	engine.completeProcess(proc, nil)
+	if proc.CallType == commandprocess.CallTypeWork {
+		engine.Requests.RemoveRequest(proc.ID)
+	}
+}
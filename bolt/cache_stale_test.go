@@ -0,0 +1,107 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltengine/requestmanager"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+// staleEngine returns an engine with a memory cache, where v1/product results are served stale for a minute
+func staleEngine() *Engine {
+	engine := memoryEngine()
+	engine.Config.Cache.Type = CacheMemory
+	engine.SetupCache()
+	engine.ConfigExt, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/product": {"cache": {"staleWhileRevalidateSec": 60, "staleIfErrorSec": 60}}}}`))
+	return engine
+}
+
+func TestCacheEntry(t *testing.T) {
+	entry := &cacheEntry{Time: time.Now().Add(-time.Minute), Expires: time.Now().Add(-time.Second)}
+	assert.True(t, entry.Stale(), "Should be stale past its expiration")
+	assert.True(t, entry.StaleFor(time.Minute), "Should be within a minute's grace")
+	assert.False(t, entry.StaleFor(time.Millisecond), "Should be past a short grace")
+	assert.Equal(t, 60, int(entry.Age().Seconds()), "Should know its age")
+	assert.False(t, (&cacheEntry{Time: time.Now()}).Stale(), "Entries without expiration shouldn't go stale")
+}
+
+func TestSetCacheItemGrace(t *testing.T) {
+	engine := staleEngine()
+	engine.SetCacheItem("v1/product", `{"sku": "1"}`, `{"name": "widget"}`, 10*time.Millisecond)
+	engine.SetCacheItem("v1/other", `{"sku": "1"}`, `{"name": "widget"}`, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := engine.GetCacheItem("v1/product", `{"sku": "1"}`)
+	assert.NotNil(t, err, "Stale items should miss")
+	entry, err := engine.getCacheEntry("v1/product", `{"sku": "1"}`)
+	assert.Nil(t, err, "Stale items should be kept for the grace window")
+	assert.True(t, entry.Stale(), "Should be stale")
+	assert.Equal(t, `{"name": "widget"}`, entry.Value, "Should keep the value")
+	_, err = engine.getCacheEntry("v1/other", `{"sku": "1"}`)
+	assert.NotNil(t, err, "Calls without a grace window shouldn't keep stale items")
+}
+
+func TestFollowStale(t *testing.T) {
+	engine := staleEngine()
+	entry := &cacheEntry{Value: `{"name": "widget"}`, Time: time.Now().Add(-time.Minute), Expires: time.Now().Add(-time.Second)}
+	apicall := &config.APICall{ResultTimeout: 50 * time.Millisecond}
+
+	work := coalesceProc("work", apicall)
+	work.Payload.SetP("down", "error.product/get.details")
+	work.SetComplete()
+	proc := coalesceProc("abc", apicall)
+	engine.followStale(proc, work, entry)
+	assert.True(t, proc.Complete, "Failed call should complete with the stale result")
+	assert.Equal(t, "widget", proc.Payload.Path("return_value.name").Data(), "Should serve the stale result")
+	assert.Equal(t, true, proc.Payload.Path("stale").Data(), "Should be marked stale")
+	assert.EqualValues(t, 60, proc.Payload.Path("cache_age_sec").Data(), "Should report the age")
+	assert.False(t, hasErrors(proc.Payload), "Stale results shouldn't be errors")
+	assert.Equal(t, "down", proc.Payload.Path("stale_error.product/get.details").Data(), "Should keep the call's errors")
+
+	work = coalesceProc("work", apicall)
+	proc = coalesceProc("abc", apicall)
+	engine.followStale(proc, work, entry)
+	assert.Equal(t, "widget", proc.Payload.Path("return_value.name").Data(), "Slow calls should serve the stale result")
+	assert.True(t, proc.Payload.ExistsP("stale_error.timeout"), "Should report the timeout")
+	assert.False(t, work.Payload.ExistsP("return_value.name"), "The refreshing call should be left alone")
+
+	work = coalesceProc("work", apicall)
+	work.Payload.SetP("fresh", "return_value.name")
+	work.SetComplete()
+	proc = coalesceProc("abc", apicall)
+	engine.followStale(proc, work, entry)
+	assert.Equal(t, "fresh", proc.Payload.Path("return_value.name").Data(), "Successful calls should share their result")
+	assert.Equal(t, "abc", proc.Payload.Path("id").Data(), "Should keep its own id")
+	assert.False(t, proc.Payload.ExistsP("stale"), "Successful calls aren't stale")
+}
+
+func TestCacheSkipsFailedResults(t *testing.T) {
+	engine := staleEngine()
+	apicall := &config.APICall{Cache: config.CacheInfo{Enabled: true, ExpirationTime: time.Minute}}
+	payload, _ := gabs.ParseJSON([]byte(`{"return_value": {}, "error": {"timeout": {}}}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeRequest, "v1/product", apicall, payload, "group", "")
+	proc.SetInitialInput(gabs.New())
+	engine.CacheCallResult(proc)
+	_, err := engine.getCacheEntry("v1/product", "{}")
+	assert.NotNil(t, err, "Failed results shouldn't replace what can be served stale")
+}
+
+func TestRevalidate(t *testing.T) {
+	engine := staleEngine()
+	engine.Requests = requestmanager.NewRequestManager()
+	apicall := config.APICall{Cache: config.CacheInfo{Enabled: true}}
+	input, _ := gabs.ParseJSON([]byte(`{"sku": "1"}`))
+
+	leader := coalesceProc("leader", &apicall)
+	engine.coalesceCall(leader, input.String())
+	assert.Equal(t, leader, engine.revalidate("v1/product", apicall, input, "group"), "Should follow the in-flight call")
+	assert.Equal(t, leader, engine.coalesceCall(coalesceProc("next", &apicall), input.String()), "In-flight calls should refresh the cache instead")
+}
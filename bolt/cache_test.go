@@ -0,0 +1,41 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalInput(t *testing.T) {
+	assert.Equal(t, `{"a":1,"b":[2,{"c":"x","d":true}]}`, canonicalInput(`{ "b": [2.0, {"d": true, "c": "x"}], "a": 1e0 }`, nil), "Should sort keys and normalize numbers")
+	assert.Equal(t, canonicalInput(`{"n": 0.10}`, nil), canonicalInput(`{"n": 1e-1}`, nil), "Equal decimals should match")
+	assert.NotEqual(t, canonicalInput(`{"n": 12345678901234567890}`, nil), canonicalInput(`{"n": 12345678901234567891}`, nil), "Big numbers should keep their precision")
+	assert.Equal(t, `{"sku":"123","store.id":null}`, canonicalInput(`{"sku": "123", "ts": 1500000000}`, []string{"sku", "store.id"}), "Should only keep the key fields")
+	assert.Equal(t, `{"store.id":5}`, canonicalInput(`{"store": {"id": 5, "name": "x"}}`, []string{"store.id"}), "Key fields can be paths")
+	assert.Equal(t, "not json", canonicalInput("not json", nil), "Invalid input should be kept")
+}
+
+func TestCacheKey(t *testing.T) {
+	engine := memoryEngine()
+	engine.ConfigExt, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/product": {"cacheKeyFields": ["sku"]}}}`))
+
+	key := engine.cacheKey("v1/test", `{"a": 1, "b": 2}`)
+	assert.Equal(t, key, engine.cacheKey("v1/test", `{"b":2,"a":1}`), "Key order and whitespace shouldn't matter")
+	assert.NotEqual(t, key, engine.cacheKey("v1/other", `{"a": 1, "b": 2}`), "Different calls shouldn't match")
+	assert.Len(t, key, len("v1/test$$$")+64, "Input should be hashed")
+	engine.Config.Engine.Advanced.QueuePrefix = "dev-"
+	assert.Equal(t, key, engine.cacheKey("v1/test", `{"a": 1, "b": 2}`), "Queue prefix shouldn't change the key")
+	assert.Equal(t, engine.cacheKey("v1/product", `{"sku": "1", "ts": 1}`), engine.cacheKey("v1/product", `{"sku": "1", "ts": 2}`), "Fields outside the key shouldn't matter")
+
+	//CacheCallResult and HandleCall have to agree on the key
+	engine.Config.Cache.Type = CacheMemory
+	engine.SetupCache()
+	engine.SetCacheItem("v1/test", `{"a":1}`, `{}`, time.Minute)
+	_, err := engine.GetCacheItem("v1/test", `{ "a": 1.0 }`)
+	assert.Nil(t, err, "Equal input should hit")
+}
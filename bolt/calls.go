@@ -9,15 +9,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/TeamFairmont/amqp"
 	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/broker"
 	"github.com/TeamFairmont/boltengine/commandprocess"
 	"github.com/TeamFairmont/boltengine/engineutils"
-	"github.com/TeamFairmont/boltshared/mqwrapper"
+	"github.com/TeamFairmont/boltengine/mapping"
 	"github.com/TeamFairmont/boltshared/validation"
 	"github.com/TeamFairmont/gabs"
 )
@@ -36,7 +37,7 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if engine.mqConnection == nil {
+	if engine.broker == nil {
 		ret := gabs.New()
 		bolterror.NewBoltError(errors.New(""), "maintenance", "Engine temporarily unavailable, please try again", "", bolterror.Internal).AddToPayload(ret)
 		fmt.Fprint(w, ret.String())
@@ -80,6 +81,17 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 			return
 		}
 
+		//results of task and work calls can be posted to a callback once complete
+		callback := ""
+		if reqtype != commandprocess.CallTypeRequest {
+			callback, err = engine.callbackURL(r, cmd)
+			if err != nil {
+				engine.LogDebug("request_callback", logrus.Fields{"cmd": cmd, "callback": callback, "err": err, "ip": engineutils.GetIP(r)}, "Callback not allowed")
+				engine.OutputError(w, bolterror.NewBoltError(err, "request", "Callback URL not allowed", callback, bolterror.Request))
+				return
+			}
+		}
+
 		//create request
 		secgroup := hmacGroup
 		token := "" // dont set this
@@ -92,17 +104,27 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 		req.SetInitialInput(payload)
 
 		req.Payload.SetP(req.ID, "id")
+		if callback != "" {
+			req.CallbackURL = callback
+			go engine.deliverCallback(req)
+		}
 		engine.LogInfo("call_in", logrus.Fields{"id": req.ID, "url": r.URL.String(), "cmd": cmd, "payload": payload}, "Api call in")
 		engine.Stats.Ch("performance").Ch("calls").Ch(req.InitialCommand).Ch("hits").Incr()
 
 		noCache := true
+		var stale *cacheEntry //served if the call fails, see CachePolicy
 		//if BOLT-NO-CACHE does not exist, continue normally
 		_, exist := r.Header["Bolt-No-Cache"] //keys cases change. BOLT-NO-CACHE changes to Bolt-No-Cache
 		if !exist {
-			cacheval, err := engine.GetCacheItem(cmd, payload.String())
+			entry, err := engine.getCacheEntry(cmd, payload.String())
+			policy := engine.ConfigExt.Call(cmd).Cache
+			hit := err == nil && (!entry.Stale() || entry.StaleFor(policy.StaleWhileRevalidate()))
+			if err == nil && !hit && entry.StaleFor(policy.StaleIfError()) {
+				stale = entry
+			}
 
-			if err == nil {
-				returnvalue, err := gabs.ParseJSON([]byte(cacheval))
+			if hit {
+				returnvalue, err := gabs.ParseJSON([]byte(entry.Value))
 				if err != nil {
 					engine.DelCacheItem(cmd, payload.String())
 					engine.LogWarn("cache_error", logrus.Fields{"id": req.ID, "command": req.InitialCommand, "cached": true}, "Cached value couldn't be parsed to JSON")
@@ -111,7 +133,11 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 					req.SetComplete()
 					req.Payload.SetP(req.Complete, "complete")
 					req.Payload.SetP(returnvalue.Data(), "return_value")
-					req.Payload.SetP(true, "cached")
+					setCacheAge(req.Payload, entry)
+					if entry.Stale() {
+						engine.Stats.Ch("general").Ch("cache_stale_hits").Incr()
+						engine.revalidate(cmd, apicall, payload, hmacGroup)
+					}
 
 					//really you shouldnt have 'work'-able api calls be cachable as well, but just in case, keep consistent output
 					if reqtype == commandprocess.CallTypeWork {
@@ -138,9 +164,32 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 				engine.Stats.Ch("general").Ch("cache_misses").Incr()
 			}
 
+			//identical cacheable calls share the result of the first one in flight, unless the cache was skipped.
+			//with a stale result to fall back on, the call is run apart from req so a failure can be replaced.
+			run := engine.processCall
+			if stale != nil {
+				run = func(proc *commandprocess.CommandProcess) {
+					engine.followStale(proc, engine.revalidate(cmd, apicall, payload, hmacGroup), stale)
+				}
+			} else if !exist {
+				if leader := engine.coalesceCall(req, payload.String()); leader != nil {
+					run = func(proc *commandprocess.CommandProcess) { engine.followCall(proc, leader) }
+				}
+			}
+
 			switch reqtype {
 			case commandprocess.CallTypeRequest:
-				engine.processCall(req)
+				processed := make(chan bool)
+				go func() {
+					run(req)
+					close(processed)
+				}()
+				select {
+				case <-processed:
+				case <-r.Context().Done():
+					engine.handleDisconnect(req)
+					return
+				}
 
 				req.Mutex.Lock()
 				req.Payload.SetP(req.Complete, "complete")
@@ -150,17 +199,21 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 				engine.LogInfo("call_out", logrus.Fields{"id": req.ID, "command": req.InitialCommand}, "Api call out")
 				if req.Complete {
 					engine.Requests.RemoveRequest(req.ID)
+				} else {
+					req.Responded = true
 				}
 				req.Mutex.Unlock()
+				engine.saveRequest(req)
 
 			case commandprocess.CallTypeTask:
-				go engine.processCall(req)
+				engine.saveRequest(req)
+				go run(req)
 				ret := gabs.New()
 				ret.SetP(req.ID, "id")
 				fmt.Fprint(w, ret.String())
 
 			case commandprocess.CallTypeWork:
-				go engine.processCall(req)
+				go run(req)
 				ret := gabs.New()
 				ret.SetP(nil, "id")
 				fmt.Fprint(w, ret.String())
@@ -170,6 +223,26 @@ func (engine *Engine) HandleCall(reqtype int, w http.ResponseWriter, r *http.Req
 	}
 }
 
+// handleDisconnect is called when a /request/ client goes away before its call returned. Depending on the api call's
+// onDisconnect setting, the call is cancelled or left running as a task whose result can be fetched with /retr.
+func (engine *Engine) handleDisconnect(proc *commandprocess.CommandProcess) {
+	engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("disconnects").Incr()
+	if engine.ConfigExt.Call(proc.InitialCommand).OnDisconnect == DisconnectAbort {
+		if proc.Cancel() {
+			engine.LogInfo("call_disconnect", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "onDisconnect": DisconnectAbort}, "Client disconnected, call aborted")
+		} else {
+			engine.LogInfo("call_disconnect", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "onDisconnect": DisconnectAbort}, "Client disconnected, call already complete")
+		}
+		return
+	}
+
+	proc.Mutex.Lock()
+	proc.CallType = commandprocess.CallTypeTask
+	proc.Mutex.Unlock()
+	engine.saveRequest(proc)
+	engine.LogInfo("call_disconnect", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "onDisconnect": DisconnectTask}, "Client disconnected, call continues as a task")
+}
+
 // callVars pulls the json input and api command name from the http.request struct
 func callVars(r *http.Request) (call string, payload *gabs.Container, err error) {
 	call, _ = ExtractCallName(r)
@@ -181,6 +254,7 @@ func callVars(r *http.Request) (call string, payload *gabs.Container, err error)
 
 // processCall performs initial validation, sets up, and executes an api call's commands via processCommands()
 func (engine *Engine) processCall(proc *commandprocess.CommandProcess) {
+	defer engine.saveRequest(proc)
 
 	engine.LogDebug("processCall reqparams", logrus.Fields{"requiredparams": proc.APICall.RequiredParams}, "")
 	err := validate.CheckPayloadReqParams(proc.APICall.RequiredParams, proc.Payload)
@@ -200,25 +274,19 @@ func (engine *Engine) processCall(proc *commandprocess.CommandProcess) {
 	//setup initial command to start for this call
 	proc.CurrentCommand = &proc.APICall.Commands[0]
 	proc.CurrentCommandIndex = 0
+	if !engine.skipFalseConditions(proc) {
+		proc.SetComplete()
+		engine.CacheCallResult(proc)
+		return
+	}
 
 	//setup 'global' worker config
 	if engine.Config.WorkerConfigObj != nil && engine.Config.WorkerConfigObj.Data() != nil {
 		proc.Payload.SetP(engine.Config.WorkerConfigObj.Data(), "config")
 	}
 
-	//setup mq for this call, try to create a channel just for this call, if it fails fall back to the general channel
-
-	ch, err := engine.mqConnection.Connection.Channel()
-	if err != nil {
-		engine.LogError("mq_error", nil, err.Error())
-		ch = engine.mqConnection.Channel
-	} else {
-		ch.Qos(1, 0, false)
-	}
-
-	//ch := engine.mqConnection.Channel
-	q, res, err := mqwrapper.CreateConsumeTempQueue(ch)
-
+	//setup mq for this call
+	q, err := engine.createReplyQueue(proc.ID)
 	if err != nil {
 		proc.SetComplete()
 		engine.LogError("mq_error", nil, err.Error())
@@ -226,12 +294,82 @@ func (engine *Engine) processCall(proc *commandprocess.CommandProcess) {
 		return
 	}
 
-	engine.processCommands(proc, res, ch, q, false, false)
+	engine.processCommands(proc, q, false, false)
+}
+
+// createReplyQueue opens a route on the engine's reply queue for the replies whose correlation ids belong to key,
+// see replyKey. Closing it frees the route, the reply queue itself stays.
+func (engine *Engine) createReplyQueue(key string) (broker.Queue, error) {
+	router := engine.replies
+	if router == nil {
+		return nil, errNoReplyQueue
+	}
+	return router.open(key), nil
+}
+
+// publishCommand pushes payload to the worker queue for command, the worker replies to replyTo with correlationID.
+// If deadline is set the message expires from the queue at that time, and workers get it in the DeadlineHeader.
+// Returns an unroutableError if no worker has declared the command's queue.
+func (engine *Engine) publishCommand(command, correlationID string, payload *gabs.Container, replyTo string, deadline time.Time) error {
+	msg := broker.Message{
+		CorrelationID: correlationID,
+		ReplyTo:       replyTo,
+		Body:          payload.Bytes(),
+	}
+	if !deadline.IsZero() {
+		msg.Expiration = deadline.Sub(time.Now())
+		if msg.Expiration < time.Millisecond {
+			msg.Expiration = time.Millisecond
+		}
+		msg.Headers = map[string]interface{}{DeadlineHeader: deadline.UnixNano() / int64(time.Millisecond)}
+	}
+	err := engine.broker.Publish(engine.Config.Engine.Advanced.QueuePrefix+command, msg)
+	if err == broker.ErrUnroutable {
+		engine.LogError("cmd_unroutable", logrus.Fields{"correlationId": correlationID, "command": command}, "No worker queue for command")
+		engine.Stats.Ch("commands").Ch(command).Ch("unroutable").Incr()
+		return unroutableError{command: command}
+	}
+	return err
+}
+
+// deadline returns the time the earliest of the positive limits runs out from now, zero if none are set
+func deadline(limits ...time.Duration) time.Time {
+	var earliest time.Duration
+	for _, limit := range limits {
+		if limit > 0 && (earliest == 0 || limit < earliest) {
+			earliest = limit
+		}
+	}
+	if earliest == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(earliest)
+}
+
+// unroutableError is returned by publishCommand when the broker has no queue for the command
+type unroutableError struct {
+	command string
 }
 
+func (e unroutableError) Error() string {
+	return "no worker queue for command " + e.command
+}
+
+// publishReply pushes payload to the reply queue replyTo, the same as a worker replying to a command
+func (engine *Engine) publishReply(replyTo, correlationID string, payload *gabs.Container) error {
+	return engine.broker.Publish(replyTo, broker.Message{
+		CorrelationID: correlationID,
+		Body:          payload.Bytes(),
+	})
+}
+
+// errReplyQueueClosed is set when a call's reply queue closes under it, ie: the broker connection was lost
+var errReplyQueueClosed = errors.New("reply queue closed")
+
 // processCommands starts and continues pushing commands to the mq, assembling and validating the payload at each step
 // also watches for timeouts due to call, command, or zombie and calls itself to continue processing after timeout if applicable.
-func (engine *Engine) processCommands(proc *commandprocess.CommandProcess, res <-chan amqp.Delivery, ch *amqp.Channel, q *amqp.Queue, skipInitialCommand bool, skipTimeouts bool) {
+func (engine *Engine) processCommands(proc *commandprocess.CommandProcess, q broker.Queue, skipInitialCommand bool, skipTimeouts bool) {
+	res := q.Deliveries()
 
 	err := validate.CheckPayloadStructure(proc.Payload)
 	if err != nil {
@@ -264,40 +402,60 @@ func (engine *Engine) processCommands(proc *commandprocess.CommandProcess, res <
 			}
 			proc.Mutex.Lock()
 			proc.NextCommand = ""
-			err = mqwrapper.PublishCommand(engine.mqConnection.Channel, proc.ID, engine.Config.Engine.Advanced.QueuePrefix, nexttmp, proc.Payload, q.Name)
+			proc.PendingCommand = nexttmp
+			proc.CommandAttempt = 1
+			proc.CorrelationID = proc.ID
+			proc.Fallback = false
+			err = engine.publishCommand(nexttmp, proc.ID, proc.Payload, q.Name(), deadline(proc.APICall.ResultZombie))
 			proc.CommandTime = time.Now()
+			notifyCommand(proc, nexttmp, err)
 			proc.Mutex.Unlock()
 		} else {
 			engine.LogDebug("cmd_queued", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, "")
-
-			proc.Mutex.Lock()
-			proc.Payload.SetP(proc.CurrentCommand.ConfigParamsObj.Data(), "params")
-			proc.Mutex.Unlock()
-
-			if engine.Config.Engine.TraceEnabled {
-				proc.AddTraceEntry()
-			}
-			proc.Mutex.Lock()
-			err = mqwrapper.PublishCommand(engine.mqConnection.Channel, proc.ID, engine.Config.Engine.Advanced.QueuePrefix, proc.CurrentCommand.Name, proc.Payload, q.Name)
-			proc.CommandTime = time.Now()
-			proc.Mutex.Unlock()
+			err = engine.publishCurrentCommand(proc, q)
 		}
 	}
 
 	//loop and process subcommands, validate results+params, etc
 	stop := false
+Commands:
 	for !stop {
 
 		if err != nil {
-			bolterror.NewBoltError(err, "request", "Internal error: "+err.Error(), proc.CurrentCommand.Name, bolterror.Internal).AddToPayload(proc.Payload)
-			engine.completeProcess(proc, ch, q)
+			if unroutable, ok := err.(unroutableError); ok {
+				bolterror.NewBoltError(err, unroutable.command, "Command error: "+err.Error(), proc.InitialCommand, bolterror.Internal).AddToPayload(proc.Payload)
+			} else if err != errMapping { //mapping errors are already in the payload
+				bolterror.NewBoltError(err, "request", "Internal error: "+err.Error(), proc.CurrentCommand.Name, bolterror.Internal).AddToPayload(proc.Payload)
+			}
+			engine.compensate(proc, q, compensateInternal)
+			engine.completeProcess(proc, q)
 			return
 		}
 
-		//command-level timeout
+		//save every step, so /retr on other nodes or after a restart doesn't lag behind the call
+		engine.saveRequest(proc)
+
+		//command-level timeout, still set after a call timeout if the command can be retried or fall back on timeout
+		cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+		recoverTimeout := recoversTimeout(proc, cmdExt)
+		resultTimeout := proc.CurrentCommand.ResultTimeout
+		if proc.Fallback && cmdExt.Fallback.Command != nil {
+			resultTimeout = cmdExt.Fallback.Command.ResultTimeout
+		}
+
+		//a retry waiting out its backoff is published from the select, so cancels and timeouts aren't held up by it.
+		//the command timeout starts once it's published.
+		var backoff <-chan time.Time
+		proc.Mutex.RLock()
+		retryTime := proc.RetryTime
+		proc.Mutex.RUnlock()
+		if !retryTime.IsZero() {
+			backoff = time.After(time.Until(retryTime))
+		}
+
 		timeout := make(chan bool, 1)
-		if !skipTimeouts && proc.CurrentCommand.ResultTimeout > 0 {
-			to := proc.CurrentCommand.ResultTimeout
+		if backoff == nil && (!skipTimeouts || recoverTimeout) && resultTimeout > 0 {
+			to := resultTimeout
 			go func(to time.Duration) {
 				time.Sleep(to)
 				timeout <- true
@@ -314,104 +472,204 @@ func (engine *Engine) processCommands(proc *commandprocess.CommandProcess, res <
 			}(to)
 		}
 
-		var d amqp.Delivery
-
-		select {
-		case <-zombie:
-			engine.LogWarn("call_zombie", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
-			engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("zombie_count").Incr()
-			bolterror.NewBoltError(nil, "zombie", "API Call zombie time limit reached, retry request and contact sysadmin if issue persists", proc.CurrentCommand.Name, bolterror.Zombie).AddToPayload(proc.Payload)
-			engine.completeProcess(proc, ch, q)
-			return
+		var d broker.Message
+		received := false
+		for !received {
+			select {
+			case <-zombie:
+				var started bool
+				started, err = engine.startFallback(proc, q, fallbackZombie)
+				if started {
+					continue Commands
+				}
+				engine.LogWarn("call_zombie", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
+				engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("zombie_count").Incr()
+				bolterror.NewBoltError(nil, "zombie", "API Call zombie time limit reached, retry request and contact sysadmin if issue persists", proc.CurrentCommand.Name, bolterror.Zombie).AddToPayload(proc.Payload)
+				engine.compensate(proc, q, fallbackZombie)
+				engine.completeProcess(proc, q)
+				return
 
-		case <-timeout:
-			//note: timeout "errors" don't carry over into the final result, if commands continue to sucessfully process
-			engine.LogInfo("command_timeout", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
-			engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("command_timeouts").Incr()
-			engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("timeouts").Incr()
-			bolterror.NewBoltError(nil, "timeout", "Command timeout, use id to fetch result", proc.CurrentCommand.Name, bolterror.Timeout).AddToPayload(proc.Payload)
-			go engine.processCommands(proc, res, ch, q, true, true) //doesn't skip the current command object pushing to mq before waiting on the channel
-			return
+			case <-backoff:
+				proc.Mutex.Lock()
+				proc.RetryTime = time.Time{}
+				proc.Mutex.Unlock()
+				err = engine.publishPendingCommand(proc, q)
+				if err != nil {
+					engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, "Command retry failed to publish")
+				}
+				continue Commands
 
-		case <-proc.TimeoutChannel:
-			//note: timeout "errors" don't carry over into the final result, if commands continue to sucessfully process
-			engine.LogInfo("call_timeout", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
-			engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("timeouts").Incr()
-			bolterror.NewBoltError(nil, "timeout", "API Call timeout, use id to fetch result", proc.InitialCommand, bolterror.Timeout).AddToPayload(proc.Payload)
-			go engine.processCommands(proc, res, ch, q, true, true) //doesn't skip the current command object pushing to mq before waiting on the channel
-			return
+			case <-timeout:
+				if engine.retryCommand(proc, RetryOnTimeout) {
+					continue Commands
+				}
+				var started bool
+				started, err = engine.startFallback(proc, q, RetryOnTimeout)
+				if started {
+					continue Commands
+				}
+				if skipTimeouts {
+					continue //only set for the retry or fallback, keep waiting as usual after a call timeout
+				}
+				//note: timeout "errors" don't carry over into the final result, if commands continue to sucessfully process
+				engine.LogInfo("command_timeout", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
+				engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("command_timeouts").Incr()
+				engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("timeouts").Incr()
+				bolterror.NewBoltError(nil, "timeout", "Command timeout, use id to fetch result", proc.CurrentCommand.Name, bolterror.Timeout).AddToPayload(proc.Payload)
+				proc.Notify(commandprocess.EventTimeout, proc.CurrentCommand.Name, "command")
+				go engine.processCommands(proc, q, true, true) //doesn't skip the current command object pushing to mq before waiting on the channel
+				return
 
-		case d = <-res:
-			engine.LogDebug("cmd_complete", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationId, "command": proc.CurrentCommand.Name, "body": string(d.Body)}, "")
+			case <-proc.CancelChannel:
+				engine.cancelCall(proc, q)
+				return
 
-			//update command obj payload
-			body, err := gabs.ParseJSON(d.Body)
-			if err != nil {
-				engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("errors").Incr()
-				bolterror.NewBoltError(err, proc.CurrentCommand.Name, "Command error: "+err.Error(), proc.InitialCommand, bolterror.Request).AddToPayload(proc.Payload)
-				engine.completeProcess(proc, ch, q)
+			case <-proc.TimeoutChannel:
+				//note: timeout "errors" don't carry over into the final result, if commands continue to sucessfully process
+				engine.LogInfo("call_timeout", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
+				engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("timeouts").Incr()
+				bolterror.NewBoltError(nil, "timeout", "API Call timeout, use id to fetch result", proc.InitialCommand, bolterror.Timeout).AddToPayload(proc.Payload)
+				proc.Notify(commandprocess.EventTimeout, proc.CurrentCommand.Name, "call")
+				go engine.processCommands(proc, q, true, true) //doesn't skip the current command object pushing to mq before waiting on the channel
 				return
+
+			case reply, ok := <-res:
+				if !ok {
+					res = nil
+					err = errReplyQueueClosed
+					continue Commands
+				}
+				d = reply
+				if isProgress(d) {
+					if d.CorrelationID == proc.CorrelationID {
+						engine.recordProgress(proc, proc.PendingCommand, d)
+					}
+					continue
+				}
+				received = engine.isPendingReply(proc, d)
 			}
-			proc.Payload = body
+		}
 
-			//reset next command in prep
-			proc.NextCommand = ""
-			nexttmp := ""
-			if proc.Payload.Path("nextCommand").Data() != nil {
-				nexttmp = proc.Payload.Path("nextCommand").Data().(string)
+		engine.LogDebug("cmd_complete", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": proc.CurrentCommand.Name, "body": string(d.Body)}, "")
+		proc.Notify(commandprocess.EventReply, proc.PendingCommand, map[string]interface{}{"correlationId": d.CorrelationID})
+
+		//update command obj payload
+		var started bool
+		body, jsonErr := gabs.ParseJSON(d.Body)
+		if jsonErr != nil {
+			if engine.retryCommand(proc, RetryOnInvalidReply) {
+				continue Commands
+			}
+			started, err = engine.startFallback(proc, q, RetryOnInvalidReply)
+			if started {
+				continue Commands
+			}
+			engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("errors").Incr()
+			bolterror.NewBoltError(jsonErr, proc.CurrentCommand.Name, "Command error: "+jsonErr.Error(), proc.InitialCommand, bolterror.Request).AddToPayload(proc.Payload)
+			engine.compensate(proc, q, RetryOnInvalidReply)
+			engine.completeProcess(proc, q)
+			return
+		}
+		errKeys := newErrorKeys(proc.Payload, body)
+		if len(errKeys) > 0 {
+			if engine.retryCommand(proc, RetryOnError) {
+				continue Commands
 			}
+			started, err = engine.startFallback(proc, q, RetryOnError)
+			if started {
+				continue Commands
+			}
+		}
+		if len(errKeys) == 0 && pendingIsPrimary(proc) {
+			if !engine.applyMapping(proc, body, cmdExt.OutputMap, "output") {
+				proc.Payload = body
+				engine.compensate(proc, q, compensateInternal)
+				engine.completeProcess(proc, q)
+				return
+			}
+			proc.CompletedCommands = append(proc.CompletedCommands, proc.CurrentCommandIndex)
+		}
+		proc.Payload = body
 
-			//next command exists, so set it
-			if nexttmp != "" {
-				proc.NextCommand = nexttmp
+		//reset next command in prep
+		proc.NextCommand = ""
+		nexttmp := ""
+		if proc.Payload.Path("nextCommand").Data() != nil {
+			nexttmp = proc.Payload.Path("nextCommand").Data().(string)
+		}
 
-				proc.Mutex.Lock()
-				proc.Payload.SetP("", "nextCommand")
-				proc.Mutex.Unlock()
+		//cache purges run in the engine, then the call carries on as if there was no next command
+		if nexttmp == CachePurgeCommandName {
+			proc.Mutex.Lock()
+			proc.Payload.SetP("", "nextCommand")
+			proc.Mutex.Unlock()
+			engine.purgeCommand(proc)
+			nexttmp = ""
+		}
 
-				//check for 'circuit breaker' set in nextCommand, halt all further processing on this call
-				if proc.NextCommand == HaltCallCommandName { // see constants.go - "HALT_CALL"
-					engine.statCommandTime(proc)
-					engine.statAPICallTime(proc)
-					engine.Stats.Ch("performance").Ch("commands").Ch(proc.CurrentCommand.Name).Ch("halts").Incr()
-					engine.completeProcess(proc, ch, q)
-					engine.CacheCallResult(proc)
-					engine.LogInfo("call_halt", logrus.Fields{"id": proc.ID, "last_command": proc.CurrentCommand.Name, "initial_input": proc.InitialInputString}, "")
-					return
-				}
+		//next command exists, so set it
+		if nexttmp != "" {
+			proc.NextCommand = nexttmp
 
-				engine.LogDebug("cmd_found_next", logrus.Fields{"id": proc.ID, "next": proc.NextCommand}, "")
+			proc.Mutex.Lock()
+			proc.Payload.SetP("", "nextCommand")
+			proc.Mutex.Unlock()
 
-				//reached end of command list for this call, complete and return
-			} else if proc.CurrentCommandIndex >= len(proc.APICall.Commands)-1 {
+			//check for 'circuit breaker' set in nextCommand, halt all further processing on this call
+			if proc.NextCommand == HaltCallCommandName { // see constants.go - "HALT_CALL"
 				engine.statCommandTime(proc)
 				engine.statAPICallTime(proc)
-				engine.completeProcess(proc, ch, q)
-				engine.LogDebug("cmd_last_complete", logrus.Fields{"id": proc.ID}, proc.InitialCommand)
-				if proc.CallType == commandprocess.CallTypeWork {
-					engine.Requests.RemoveRequest(proc.ID)
+				engine.Stats.Ch("performance").Ch("commands").Ch(proc.CurrentCommand.Name).Ch("halts").Incr()
+				if hasErrors(proc.Payload) {
+					engine.compensate(proc, q, compensateHalt)
 				}
+				engine.completeProcess(proc, q)
 				engine.CacheCallResult(proc)
+				engine.LogInfo("call_halt", logrus.Fields{"id": proc.ID, "last_command": proc.CurrentCommand.Name, "initial_input": proc.InitialInputString}, "")
 				return
+			}
 
-				//reached end of a return after command, return but don't "complete" yet
-			} else if proc.CurrentCommand.ReturnAfter {
-				engine.statCommandTime(proc)
-				engine.statAPICallTime(proc)
-				proc.CurrentCommandIndex++
-				proc.CurrentCommand = &proc.APICall.Commands[proc.CurrentCommandIndex]
-				engine.LogDebug("cmd_return_after", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
-				go engine.processCommands(proc, res, ch, q, false, true) //doesn't skip the current command object pushing to mq before waiting on the channel
-				engine.CacheCallResult(proc)
+			engine.LogDebug("cmd_found_next", logrus.Fields{"id": proc.ID, "next": proc.NextCommand}, "")
+
+			//reached end of command list for this call, complete and return
+		} else if proc.CurrentCommandIndex >= len(proc.APICall.Commands)-1 {
+			engine.statCommandTime(proc)
+			engine.statAPICallTime(proc)
+			engine.finishCall(proc, q)
+			return
+
+			//reached end of a return after command, return but don't "complete" yet
+		} else if proc.CurrentCommand.ReturnAfter {
+			engine.statCommandTime(proc)
+			engine.statAPICallTime(proc)
+			proc.CurrentCommandIndex++
+			proc.CurrentCommand = &proc.APICall.Commands[proc.CurrentCommandIndex]
+			if !engine.skipFalseConditions(proc) {
+				engine.finishCall(proc, q)
 				return
+			}
+			engine.LogDebug("cmd_return_after", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
+			go engine.processCommands(proc, q, false, true) //doesn't skip the current command object pushing to mq before waiting on the channel
+			engine.CacheCallResult(proc)
+			return
 
-				//no next command, so setup & queue next main command
-			} else if proc.NextCommand == "" {
-				engine.statCommandTime(proc)
-				proc.CurrentCommandIndex++
-				proc.CurrentCommand = &proc.APICall.Commands[proc.CurrentCommandIndex]
-				engine.LogDebug("cmd_next_main", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
+			//no next command, so setup & queue next main command
+		} else if proc.NextCommand == "" {
+			engine.statCommandTime(proc)
+			proc.CurrentCommandIndex++
+			proc.CurrentCommand = &proc.APICall.Commands[proc.CurrentCommandIndex]
+			if !engine.skipFalseConditions(proc) {
+				engine.statAPICallTime(proc)
+				engine.finishCall(proc, q)
+				return
 			}
+			engine.LogDebug("cmd_next_main", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, proc.InitialCommand)
+		}
+
+		//cancelled while the reply was processed, don't start another command
+		if proc.IsCancelled() {
+			engine.cancelCall(proc, q)
+			return
 		}
 
 		//make command request to mq
@@ -421,8 +679,13 @@ func (engine *Engine) processCommands(proc *commandprocess.CommandProcess, res <
 				proc.AddTraceEntry()
 			}
 			proc.Mutex.Lock()
-			err = mqwrapper.PublishCommand(engine.mqConnection.Channel, proc.ID, engine.Config.Engine.Advanced.QueuePrefix, proc.NextCommand, proc.Payload, q.Name)
+			proc.PendingCommand = proc.NextCommand
+			proc.CommandAttempt = 1
+			proc.CorrelationID = proc.ID
+			proc.Fallback = false
+			err = engine.publishCommand(proc.NextCommand, proc.ID, proc.Payload, q.Name(), deadline(proc.APICall.ResultZombie))
 			proc.CommandTime = time.Now()
+			notifyCommand(proc, proc.NextCommand, err)
 			if err != nil {
 				engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, "Command failed to publish")
 			}
@@ -431,40 +694,220 @@ func (engine *Engine) processCommands(proc *commandprocess.CommandProcess, res <
 
 		} else {
 			engine.LogDebug("cmd_queued", logrus.Fields{"id": proc.ID, "next": proc.CurrentCommand.Name}, "")
-			//setup command params
-			proc.Mutex.Lock()
-			proc.Payload.SetP(proc.CurrentCommand.ConfigParamsObj.Data(), "params")
-			proc.Mutex.Unlock()
-
-			if engine.Config.Engine.TraceEnabled {
-				proc.AddTraceEntry()
-			}
-			proc.Mutex.Lock()
-			err = mqwrapper.PublishCommand(engine.mqConnection.Channel, proc.ID, engine.Config.Engine.Advanced.QueuePrefix, proc.CurrentCommand.Name, proc.Payload, q.Name)
-			proc.CommandTime = time.Now()
+			err = engine.publishCurrentCommand(proc, q)
 			if err != nil {
 				engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name}, "Command failed to publish")
 			}
-			proc.Mutex.Unlock()
 		}
 	}
 
 	//we're out of the loop so mark the request complete
-	engine.completeProcess(proc, ch, q)
+	engine.completeProcess(proc, q)
 	engine.CacheCallResult(proc)
 }
 
-func (engine *Engine) completeProcess(proc *commandprocess.CommandProcess, ch *amqp.Channel, q *amqp.Queue) {
-	if q != nil {
-		//free the temp queue off mq server
-		//err := engine.mqConnection.Channel.Cancel(q.Name, false)
+// publishCurrentCommand sets up the params for the current config-based command and pushes its first attempt to the mq
+func (engine *Engine) publishCurrentCommand(proc *commandprocess.CommandProcess, q broker.Queue) error {
+	proc.Mutex.Lock()
+	proc.Payload.SetP(proc.CurrentCommand.ConfigParamsObj.Data(), "params")
+	proc.LastPrimaryCommand = proc.CurrentCommand.Name
+	proc.PendingCommand = proc.CurrentCommand.Name
+	proc.CommandAttempt = 1
+	proc.CorrelationID = proc.ID
+	proc.Fallback = false
+	proc.Mutex.Unlock()
+
+	cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+	if !engine.applyMapping(proc, proc.Payload, cmdExt.InputMap, "input") {
+		return errMapping
+	}
+	return engine.publishPendingCommand(proc, q)
+}
+
+// errMapping is returned by publishCurrentCommand when the command's input mapping fails
+var errMapping = errors.New("command input mapping failed")
+
+// applyMapping runs the current command's input or output mapping rules against payload. If they fail, a
+// validation error for the command is added to payload and false is returned.
+func (engine *Engine) applyMapping(proc *commandprocess.CommandProcess, payload *gabs.Container, rules mapping.Rules, direction string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	proc.Mutex.Lock()
+	defer proc.Mutex.Unlock()
+	err := rules.Apply(payload)
+	if err != nil {
+		bolterror.NewBoltError(err, "validation", "Error mapping command "+direction+": "+err.Error(), proc.CurrentCommand.Name, bolterror.Request).AddToPayload(payload)
+		engine.LogInfo("validation", logrus.Fields{"err": err, "id": proc.ID, "command": proc.CurrentCommand.Name}, "Error mapping command "+direction)
+		engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("mapping_errors").Incr()
+		return false
+	}
+	return true
+}
 
-		err := ch.Close()
+// publishPendingCommand pushes the current config-based command to the mq with the pending attempt's correlation id.
+// If the command entry is a parallel group, sub-call or foreach, it's started instead and replies to q once it's done.
+func (engine *Engine) publishPendingCommand(proc *commandprocess.CommandProcess, q broker.Queue) error {
+	if engine.Config.Engine.TraceEnabled {
+		proc.AddTraceEntry()
+	}
+
+	cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+	if len(cmdExt.Parallel) > 0 || cmdExt.Call != "" || cmdExt.Foreach != nil {
+		proc.Mutex.Lock()
+		proc.CommandTime = time.Now()
+		correlationID := proc.CorrelationID
+		notifyCommand(proc, proc.CurrentCommand.Name, nil)
+		proc.Mutex.Unlock()
+		switch {
+		case cmdExt.Call != "":
+			go engine.processSubCall(proc, cmdExt, correlationID, q.Name())
+		case cmdExt.Foreach != nil:
+			go engine.processForeach(proc, cmdExt, correlationID, q.Name())
+		default:
+			go engine.processParallel(proc, cmdExt, correlationID, q.Name())
+		}
+		return nil
+	}
+
+	proc.Mutex.Lock()
+	defer proc.Mutex.Unlock()
+	err := engine.publishCommand(proc.CurrentCommand.Name, proc.CorrelationID, proc.Payload, q.Name(), engine.attemptDeadline(proc))
+	proc.CommandTime = time.Now()
+	notifyCommand(proc, proc.CurrentCommand.Name, err)
+	return err
+}
+
+// notifyCommand sends proc's subscribers the command event for its pending attempt, if it was published. proc's
+// mutex must be held.
+func notifyCommand(proc *commandprocess.CommandProcess, command string, err error) {
+	if err != nil {
+		return
+	}
+	proc.Notify(commandprocess.EventCommand, command, map[string]interface{}{"correlationId": proc.CorrelationID, "attempt": proc.CommandAttempt, "fallback": proc.Fallback})
+}
+
+// recoversTimeout returns true if the pending attempt of the current config-based command is retried or falls
+// back once its result timeout passes
+func recoversTimeout(proc *commandprocess.CommandProcess, cmdExt *CommandExt) bool {
+	return pendingIsPrimary(proc) && (cmdExt.Retry.Allows(RetryOnTimeout, proc.CommandAttempt) || cmdExt.Fallback != nil)
+}
+
+// attemptDeadline returns when the engine stops waiting on the pending attempt of the current config-based command.
+// That's the call's zombie limit, or the command's result timeout if the attempt is retried or falls back then.
+func (engine *Engine) attemptDeadline(proc *commandprocess.CommandProcess) time.Time {
+	cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+	if recoversTimeout(proc, cmdExt) {
+		return deadline(proc.APICall.ResultZombie, proc.CurrentCommand.ResultTimeout)
+	}
+	return deadline(proc.APICall.ResultZombie)
+}
+
+// retryCommand starts another attempt of the pending config-based command if the command's retry policy allows one
+// for the kind of failure. The attempt is published by processCommands once its backoff has passed, replies to
+// earlier attempts are stale from now on. Returns false if the command isn't retried.
+func (engine *Engine) retryCommand(proc *commandprocess.CommandProcess, kind string) bool {
+	cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+	if !pendingIsPrimary(proc) || !cmdExt.Retry.Allows(kind, proc.CommandAttempt) {
+		return false
+	}
+
+	wait := cmdExt.Retry.Backoff(proc.CommandAttempt)
+	engine.LogInfo("cmd_retry", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name, "attempt": proc.CommandAttempt + 1, "reason": kind, "backoff": wait.String()}, proc.InitialCommand)
+	engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("retries").Incr()
+
+	proc.Mutex.Lock()
+	proc.CommandAttempt++
+	proc.CorrelationID = retryCorrelationID(proc.ID, proc.CommandAttempt)
+	proc.RetryTime = time.Now().Add(wait)
+	proc.Mutex.Unlock()
+	return true
+}
+
+// isPendingReply returns true if d is the reply to proc's pending command attempt. Late replies to an earlier
+// attempt that has since been retried are logged and dropped.
+func (engine *Engine) isPendingReply(proc *commandprocess.CommandProcess, d broker.Message) bool {
+	if d.CorrelationID == proc.CorrelationID {
+		return true
+	}
+	engine.LogDebug("cmd_stale_reply", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": proc.PendingCommand}, "")
+	engine.Stats.Ch("commands").Ch(proc.PendingCommand).Ch("stale_replies").Incr()
+	return false
+}
+
+// retryCorrelationID builds the correlation id for a retried command, ie: <call id>#r2
+func retryCorrelationID(id string, attempt int) string {
+	return id + "#r" + strconv.Itoa(attempt)
+}
+
+// skipFalseConditions moves proc past any config-based commands whose condition is false, jumping to the
+// command's elseCommand where one is set. Returns false if the end of the command list was reached instead.
+func (engine *Engine) skipFalseConditions(proc *commandprocess.CommandProcess) bool {
+	for {
+		cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+		if cmdExt.ConditionExpr == nil {
+			return true
+		}
+		proc.Mutex.RLock()
+		ok := cmdExt.ConditionExpr.Eval(proc.Payload)
+		proc.Mutex.RUnlock()
+		if ok {
+			return true
+		}
+
+		next := proc.CurrentCommandIndex + 1
+		if cmdExt.ElseIndex > 0 {
+			next = cmdExt.ElseIndex
+		}
+		engine.LogDebug("cmd_skipped", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name, "condition": cmdExt.Condition}, proc.InitialCommand)
+		engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("skips").Incr()
+		if next >= len(proc.APICall.Commands) {
+			return false
+		}
+		proc.CurrentCommandIndex = next
+		proc.CurrentCommand = &proc.APICall.Commands[next]
+	}
+}
+
+// finishCall completes a call that has reached the end of its command list. If the call ends with errors, its
+// completed steps are compensated first.
+func (engine *Engine) finishCall(proc *commandprocess.CommandProcess, q broker.Queue) {
+	if hasErrors(proc.Payload) {
+		engine.compensate(proc, q, compensateFailed)
+	}
+	engine.completeProcess(proc, q)
+	engine.LogDebug("cmd_last_complete", logrus.Fields{"id": proc.ID}, proc.InitialCommand)
+	if proc.CallType == commandprocess.CallTypeWork {
+		engine.Requests.RemoveRequest(proc.ID)
+	}
+	engine.CacheCallResult(proc)
+}
+
+func (engine *Engine) completeProcess(proc *commandprocess.CommandProcess, q broker.Queue) {
+	if q != nil {
+		//free the call's route on the reply queue
+		err := q.Close()
 		if err != nil {
-			engine.LogWarn("queue_error", logrus.Fields{"id": proc.ID, "q": q.Name, "error": err}, "")
+			engine.LogWarn("queue_error", logrus.Fields{"id": proc.ID, "q": q.Name(), "error": err}, "")
 		}
 	}
 	proc.SetComplete()
+	engine.saveRequest(proc)
+}
+
+// saveRequest saves a call that can be fetched with /retr to the request store, so any node can answer for it and
+// its result survives a restart. That's a task call, or a request call that answered its caller before completing.
+func (engine *Engine) saveRequest(proc *commandprocess.CommandProcess) {
+	proc.Mutex.RLock()
+	retr := proc.CallType == commandprocess.CallTypeTask || (proc.CallType == commandprocess.CallTypeRequest && proc.Responded)
+	proc.Mutex.RUnlock()
+	if !retr || engine.Requests == nil {
+		return
+	}
+	err := engine.Requests.SaveRequest(proc)
+	if err != nil {
+		engine.LogWarn("request_store", logrus.Fields{"id": proc.ID, "err": err}, "Couldn't save request")
+	}
 }
 
 func (engine *Engine) statCommandTime(proc *commandprocess.CommandProcess) {
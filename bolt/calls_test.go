@@ -0,0 +1,251 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltengine/requestmanager"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubWorker answers a command by changing the payload it was sent. Returns false to leave the command unanswered.
+type stubWorker func(payload *gabs.Container) bool
+
+// stubConsumers is how many of each stub worker run at once
+const stubConsumers = 8
+
+// callEngine returns a test engine running the api calls in configjson, which holds both the shared and the
+// engine-only settings like a config file does. Commands are answered by the stub workers, keyed by name.
+func callEngine(t *testing.T, configjson string, workers map[string]stubWorker) *Engine {
+	engine := CreateTestEngine("error")
+	cfg, err := config.CustomizeConfig(engine.Config, configjson)
+	assert.Nil(t, err, "Config should parse")
+	for _, apicall := range cfg.APICalls {
+		for i := range apicall.Commands {
+			if apicall.Commands[i].ConfigParams == nil { //required by PostConfig
+				apicall.Commands[i].ConfigParams = []byte("{}")
+			}
+		}
+	}
+	assert.Nil(t, engine.PostConfig(cfg), "Config should be valid")
+	ext, err := ParseConfigExt([]byte(configjson))
+	assert.Nil(t, err, "Engine settings should parse")
+	ext.Engine.Broker = broker.KindMemory
+	assert.Nil(t, ext.Prepare(engine.Config), "Engine settings should be valid")
+	engine.ConfigExt = ext
+
+	for name, work := range workers {
+		q, _ := engine.broker.Consume(name)
+		for i := 0; i < stubConsumers; i++ {
+			go func(work stubWorker) {
+				for d := range q.Deliveries() {
+					payload, _ := gabs.ParseJSON(d.Body)
+					if work(payload) {
+						engine.broker.Publish(d.ReplyTo, broker.Message{CorrelationID: d.CorrelationID, Body: payload.Bytes()})
+					}
+				}
+			}(work)
+		}
+	}
+	return engine
+}
+
+// startCall makes the api call cmd with input on engine, like /request/ does. The channel is closed once
+// processCall returns.
+func startCall(engine *Engine, cmd, input string) (*commandprocess.CommandProcess, chan bool) {
+	apicall := engine.Config.APICalls[cmd]
+	payload, _ := gabs.ParseJSON([]byte(commandprocess.EmptyPayload))
+	proc := engine.Requests.CreateRequest(commandprocess.CallTypeRequest, cmd, &apicall, payload, "group", "")
+	proc.Payload.SetP(time.Now(), "call_in")
+	in, _ := gabs.ParseJSON([]byte(input))
+	proc.SetInitialInput(in)
+	proc.Payload.SetP(proc.ID, "id")
+
+	processed := make(chan bool)
+	go func() {
+		engine.processCall(proc)
+		close(processed)
+	}()
+	return proc, processed
+}
+
+// waitCall waits until proc is complete and processCall has returned
+func waitCall(t *testing.T, proc *commandprocess.CommandProcess, processed chan bool, limit time.Duration) {
+	for _, done := range []chan bool{processed, proc.CompleteChannel} {
+		select {
+		case <-done:
+		case <-time.After(limit):
+			t.Fatal("Call didn't complete")
+		}
+	}
+}
+
+// runCall is startCall, returning once the call is done
+func runCall(t *testing.T, engine *Engine, cmd, input string) *commandprocess.CommandProcess {
+	proc, processed := startCall(engine, cmd, input)
+	waitCall(t, proc, processed, 5*time.Second)
+	return proc
+}
+
+func TestPublishCommandUnroutable(t *testing.T) {
+	engine := memoryEngine()
+	defer engine.broker.Close()
+
+	err := engine.publishCommand("product/missing", "abc", gabs.New(), "replies", time.Time{})
+	assert.Equal(t, unroutableError{command: "product/missing"}, err, "Publishing without a worker queue should be unroutable")
+	assert.Equal(t, "no worker queue for command product/missing", err.Error(), "Error should name the command")
+
+	engine.broker.Consume("product/missing")
+	assert.Nil(t, engine.publishCommand("product/missing", "abc", gabs.New(), "replies", time.Time{}), "Publishing once the queue exists should work")
+}
+
+func TestPublishCommandDeadline(t *testing.T) {
+	engine := memoryEngine()
+	defer engine.broker.Close()
+	q, _ := engine.broker.Consume("product/get")
+
+	due := time.Now().Add(time.Minute)
+	assert.Nil(t, engine.publishCommand("product/get", "abc", gabs.New(), "replies", due), "Publish should work")
+	assert.Nil(t, engine.publishCommand("product/get", "def", gabs.New(), "replies", time.Time{}), "Publish should work")
+
+	d := <-q.Deliveries()
+	assert.Equal(t, due.UnixNano()/int64(time.Millisecond), d.Headers[DeadlineHeader], "Deadline should be in the headers")
+	assert.True(t, d.Expiration > 59*time.Second && d.Expiration <= time.Minute, "Message should expire at the deadline")
+	d = <-q.Deliveries()
+	assert.Nil(t, d.Headers[DeadlineHeader], "No deadline should be sent without one")
+	assert.Equal(t, time.Duration(0), d.Expiration, "Message shouldn't expire without a deadline")
+}
+
+func TestDeadline(t *testing.T) {
+	assert.True(t, deadline().IsZero(), "No limits should be no deadline")
+	assert.True(t, deadline(0, 0).IsZero(), "Unset limits should be ignored")
+	due := deadline(time.Hour, time.Minute, 0)
+	assert.True(t, due.Before(time.Now().Add(time.Minute+time.Second)), "Earliest limit should win")
+	assert.True(t, due.After(time.Now().Add(59*time.Second)), "Earliest limit should be from now")
+}
+
+func TestRetryCommand(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	engine := callEngine(t, `{"engine": {"traceEnabled": true}, "apiCalls": {
+		"v1/product": {"resultTimeoutMs": 2000, "commands": [
+			{"name": "product/get", "resultTimeoutMs": 50, "retry": {"maxAttempts": 2, "backoffMs": 10}}]},
+		"v1/slow": {"resultTimeoutMs": 2000, "commands": [
+			{"name": "product/slow", "resultTimeoutMs": 50, "retry": {"maxAttempts": 2, "backoffMs": 60000}}]}}}`,
+		map[string]stubWorker{
+			"product/get": func(payload *gabs.Container) bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				attempts++
+				payload.SetP(attempts, "return_value.attempt")
+				return attempts > 1 //first attempt times out
+			},
+			"product/slow": func(payload *gabs.Container) bool { return false },
+		})
+
+	proc := runCall(t, engine, "v1/product", `{}`)
+	assert.False(t, hasErrors(proc.Payload), "Retried command should succeed")
+	assert.EqualValues(t, 2, proc.Payload.Path("return_value.attempt").Data(), "Second attempt should answer")
+	trace, _ := proc.Payload.Path("trace").Children()
+	assert.Len(t, trace, 2, "Both attempts should be traced")
+	assert.EqualValues(t, 2, trace[1].Path("attempt").Data(), "Retry should be traced as the second attempt")
+	stats, _ := engine.Stats.JSON()
+	assert.Contains(t, stats, `"retries"`, "Retry should be counted")
+
+	//cancelled while waiting out a long backoff
+	proc, processed := startCall(engine, "v1/slow", `{}`)
+	time.Sleep(100 * time.Millisecond)
+	proc.Cancel()
+	waitCall(t, proc, processed, time.Second)
+	assert.True(t, proc.Payload.ExistsP("error.cancelled"), "Call should be cancelled")
+}
+
+func TestConditionalCommands(t *testing.T) {
+	ran := func(name string) stubWorker {
+		return func(payload *gabs.Container) bool {
+			payload.ArrayAppendP(name, "return_value.ran")
+			return true
+		}
+	}
+	engine := callEngine(t, `{"apiCalls": {"v1/checkout": {"commands": [
+		{"name": "cart/express", "condition": "initial_input.express == true", "elseCommand": "cart/ship"},
+		{"name": "cart/gift", "condition": "exists(initial_input.gift)"},
+		{"name": "cart/ship"}]}}}`,
+		map[string]stubWorker{"cart/express": ran("express"), "cart/gift": ran("gift"), "cart/ship": ran("ship")})
+
+	proc := runCall(t, engine, "v1/checkout", `{"express": true, "gift": "card"}`)
+	assert.Equal(t, []interface{}{"express", "gift", "ship"}, proc.Payload.Path("return_value.ran").Data(), "True conditions should run every command")
+
+	proc = runCall(t, engine, "v1/checkout", `{"express": true}`)
+	assert.Equal(t, []interface{}{"express", "ship"}, proc.Payload.Path("return_value.ran").Data(), "False conditions should skip the command")
+
+	proc = runCall(t, engine, "v1/checkout", `{"express": false, "gift": "card"}`)
+	assert.Equal(t, []interface{}{"ship"}, proc.Payload.Path("return_value.ran").Data(), "Else should jump past the commands in between")
+	assert.False(t, hasErrors(proc.Payload), "Skipped commands aren't errors")
+}
+
+func TestCommandMapping(t *testing.T) {
+	seen := make(chan string, 1)
+	engine := callEngine(t, `{"apiCalls": {
+		"v1/product": {"commands": [{"name": "product/get",
+			"inputMap": [{"op": "copy", "from": "initial_input.sku", "to": "data.productId"}],
+			"outputMap": [{"op": "rename", "from": "return_value.p", "to": "return_value.price"}]}]},
+		"v1/badInput": {"commands": [{"name": "product/get",
+			"inputMap": [{"op": "copy", "from": "initial_input.missing", "to": "data.productId"}]}]},
+		"v1/badOutput": {"commands": [{"name": "product/get",
+			"outputMap": [{"op": "copy", "from": "return_value.missing", "to": "return_value.price"}]}, {"name": "product/next"}]}}}`,
+		map[string]stubWorker{
+			"product/get": func(payload *gabs.Container) bool {
+				seen <- payload.String()
+				payload.SetP(5, "return_value.p")
+				return true
+			},
+		})
+
+	proc := runCall(t, engine, "v1/product", `{"sku": "1"}`)
+	sent, _ := gabs.ParseJSON([]byte(<-seen))
+	assert.Equal(t, "1", sent.Path("data.productId").Data(), "Input should be mapped before the command is published")
+	assert.False(t, hasErrors(proc.Payload), "Call should succeed")
+	assert.EqualValues(t, 5, proc.Payload.Path("return_value.price").Data(), "Output should be mapped")
+	assert.False(t, proc.Payload.ExistsP("return_value.p"), "Renamed output should be moved")
+
+	proc = runCall(t, engine, "v1/badInput", `{"sku": "1"}`)
+	assert.True(t, proc.Payload.ExistsP("error.validation"), "Input mapping errors should fail the call")
+	assert.Len(t, seen, 0, "Command shouldn't be published after an input mapping error")
+
+	proc = runCall(t, engine, "v1/badOutput", `{"sku": "1"}`)
+	<-seen
+	assert.True(t, proc.Payload.ExistsP("error.validation"), "Output mapping errors should fail the call")
+	assert.False(t, proc.Payload.ExistsP("error.product/next"), "Call should stop at the mapping error")
+	assert.EqualValues(t, 5, proc.Payload.Path("return_value.p").Data(), "Should keep the reply the mapping failed on")
+}
+
+func TestSaveRequest(t *testing.T) {
+	store := requestmanager.NewMapStore()
+	other := memoryEngine()
+	other.Config.APICalls = map[string]config.APICall{"v1/test": {}}
+	other.Requests = requestmanager.NewSharedRequestManager(store, "node2")
+	engine := memoryEngine()
+	engine.Requests = requestmanager.NewSharedRequestManager(store, "node1")
+
+	proc := engine.Requests.CreateRequest(commandprocess.CallTypeRequest, "v1/test", &config.APICall{}, gabs.New(), "group", "token")
+	engine.saveRequest(proc)
+	snapshot, _ := other.lookupRequest(proc.ID)
+	assert.Nil(t, snapshot, "Request calls waited on by their caller aren't saved")
+
+	proc.Responded = true
+	engine.saveRequest(proc)
+	snapshot, owned := other.lookupRequest(proc.ID)
+	if assert.NotNil(t, snapshot, "Request calls left for /retr should be saved") {
+		assert.False(t, owned, "Request is owned by the other node")
+	}
+}
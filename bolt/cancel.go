@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+)
+
+// cancelCall ends a call cancelled by the caller. The pending command's reply is no longer waited on, workers are
+// sent a cancel notice, and the steps that already completed are compensated. The payload gets a cancelled error,
+// replacing any timeout error, and cancelled set to true so /retr can tell it apart from a timeout or zombie.
+func (engine *Engine) cancelCall(proc *commandprocess.CommandProcess, q broker.Queue) {
+	engine.LogInfo("call_cancelled", logrus.Fields{"id": proc.ID, "command": proc.PendingCommand}, proc.InitialCommand)
+	engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("cancelled").Incr()
+
+	proc.Mutex.Lock()
+	if proc.Payload.ExistsP("error.timeout") {
+		proc.Payload.DeleteP("error.timeout")
+	}
+	bolterror.NewBoltError(nil, "cancelled", "API Call cancelled", proc.InitialCommand, bolterror.Cancelled).AddToPayload(proc.Payload)
+	proc.Payload.SetP(true, "cancelled")
+	proc.Mutex.Unlock()
+
+	engine.broadcastCancel(proc)
+	engine.compensate(proc, q, compensateCancelled)
+	engine.completeProcess(proc, q)
+}
+
+// broadcastCancel sends the cancel notice for proc to workers listening on the cancel exchange
+func (engine *Engine) broadcastCancel(proc *commandprocess.CommandProcess) {
+	notice := gabs.New()
+	proc.Mutex.RLock()
+	notice.SetP(proc.ID, "id")
+	notice.SetP(proc.InitialCommand, "apiCall")
+	notice.SetP(proc.PendingCommand, "command")
+	proc.Mutex.RUnlock()
+
+	err := engine.broker.Broadcast(engine.Config.Engine.Advanced.QueuePrefix+CancelExchangeName, broker.Message{
+		CorrelationID: proc.ID,
+		Type:          "cancel",
+		Body:          notice.Bytes(),
+	})
+	if err != nil {
+		engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "error": err}, "Cancel notice failed to publish")
+	}
+}
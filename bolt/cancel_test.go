@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelCall(t *testing.T) {
+	engine := memoryEngine()
+	defer engine.broker.Close()
+	assert.Nil(t, engine.startReplyRouter(), "Router should start")
+	notices, _ := engine.broker.Subscribe(CancelExchangeName)
+
+	payload, _ := gabs.ParseJSON([]byte(`{"error": {"timeout": {"type": 2}}}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, payload, "group", "token")
+	proc.PendingCommand = "product/get"
+	q, _ := engine.createReplyQueue(proc.ID)
+
+	assert.True(t, proc.Cancel(), "Cancel should work")
+	engine.cancelCall(proc, q)
+
+	assert.True(t, proc.Complete, "Cancelled call should complete")
+	assert.Equal(t, true, proc.Payload.Path("cancelled").Data(), "Payload should be marked cancelled")
+	assert.Equal(t, bolterror.Cancelled, proc.Payload.Path("error.cancelled.type").Data(), "Cancelled error should be added")
+	assert.Nil(t, proc.Payload.Path("error.timeout").Data(), "Timeout error should be replaced")
+
+	select {
+	case d := <-notices.Deliveries():
+		assert.Equal(t, "abc", d.CorrelationID, "Notice should carry the call id")
+		notice, _ := gabs.ParseJSON(d.Body)
+		assert.Equal(t, "product/get", notice.Path("command").Data(), "Notice should name the pending command")
+	case <-time.After(time.Second):
+		t.Fatal("Cancel notice not broadcast")
+	}
+}
+
+func TestHandleDisconnect(t *testing.T) {
+	engine := memoryEngine()
+	engine.ConfigExt, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/abort": {"onDisconnect": "abort"}}}`))
+
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeRequest, "v1/abort", &config.APICall{}, gabs.New(), "group", "token")
+	engine.handleDisconnect(proc)
+	assert.True(t, proc.IsCancelled(), "Abort should cancel the call")
+
+	proc = commandprocess.NewCommandProcessWithID("def", commandprocess.CallTypeRequest, "v1/other", &config.APICall{}, gabs.New(), "group", "token")
+	engine.handleDisconnect(proc)
+	assert.False(t, proc.IsCancelled(), "Task shouldn't cancel the call")
+	assert.Equal(t, commandprocess.CallTypeTask, proc.CallType, "Task should turn the call into a task")
+}
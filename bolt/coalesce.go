@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+)
+
+// coalescer tracks the in-flight calls of cacheable api calls by cache key, so identical calls can share a result
+type coalescer struct {
+	mutex   sync.Mutex
+	leaders map[string]*commandprocess.CommandProcess
+}
+
+// join returns the in-flight call for key. If there isn't one, proc becomes it and nil is returned.
+func (c *coalescer) join(key string, proc *commandprocess.CommandProcess) *commandprocess.CommandProcess {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.leaders == nil {
+		c.leaders = make(map[string]*commandprocess.CommandProcess)
+	}
+	if leader, ok := c.leaders[key]; ok {
+		return leader
+	}
+	c.leaders[key] = proc
+	return nil
+}
+
+// leave removes proc as the in-flight call for key
+func (c *coalescer) leave(key string, proc *commandprocess.CommandProcess) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.leaders[key] == proc {
+		delete(c.leaders, key)
+	}
+}
+
+// coalesceCall looks for an in-flight call with the same cache key as proc, for api calls with caching enabled.
+// Returns the call proc should follow, see followCall. Otherwise proc is run as usual and identical calls made
+// before it completes follow it.
+func (engine *Engine) coalesceCall(proc *commandprocess.CommandProcess, inputjson string) *commandprocess.CommandProcess {
+	if !proc.APICall.Cache.Enabled {
+		return nil
+	}
+	key := engine.cacheKey(proc.InitialCommand, inputjson)
+	leader := engine.inflight.join(key, proc)
+	if leader != nil {
+		engine.LogInfo("call_coalesced", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "leader": leader.ID}, "")
+		engine.Stats.Ch("general").Ch("coalesced_calls").Incr()
+		return leader
+	}
+	go func() {
+		<-proc.CompleteChannel
+		engine.inflight.leave(key, proc)
+	}()
+	return nil
+}
+
+// followCall stands in for processCall when proc was coalesced onto leader, proc gets a copy of leader's result
+// once it completes. Like processCall, it returns with a timeout error once proc's result timeout passes and the
+// result is copied when it's ready. If leader is cancelled, proc runs on its own instead.
+func (engine *Engine) followCall(proc, leader *commandprocess.CommandProcess) {
+	if waitForLeader(proc, leader, proc.APICall.ResultTimeout) {
+		engine.shareResult(proc, leader)
+		return
+	}
+	if proc.IsCancelled() {
+		engine.cancelCall(proc, nil)
+		return
+	}
+
+	engine.LogInfo("call_timeout", logrus.Fields{"id": proc.ID, "leader": leader.ID}, proc.InitialCommand)
+	engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("timeouts").Incr()
+	proc.Mutex.Lock()
+	bolterror.NewBoltError(nil, "timeout", "API Call timeout, use id to fetch result", proc.InitialCommand, bolterror.Timeout).AddToPayload(proc.Payload)
+	proc.Mutex.Unlock()
+	proc.Notify(commandprocess.EventTimeout, "", "call")
+	go func() {
+		if waitForLeader(proc, leader, 0) {
+			engine.shareResult(proc, leader)
+		} else {
+			engine.cancelCall(proc, nil)
+		}
+	}()
+}
+
+// waitForLeader waits until leader completes, limit has passed if it's more than 0, or proc is cancelled. Returns
+// false if leader didn't complete.
+func waitForLeader(proc, leader *commandprocess.CommandProcess, limit time.Duration) bool {
+	var expired <-chan time.Time
+	if limit > 0 {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-leader.CompleteChannel:
+		return true
+	case <-expired:
+	case <-proc.CancelChannel:
+	}
+	return false
+}
+
+// shareResult completes proc with a copy of leader's result, keeping proc's own id, input and timestamps
+func (engine *Engine) shareResult(proc, leader *commandprocess.CommandProcess) {
+	if leader.IsCancelled() {
+		engine.LogInfo("call_uncoalesced", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "leader": leader.ID}, "Coalesced call was cancelled, running on its own")
+		engine.processCall(proc)
+		return
+	}
+
+	leader.Mutex.RLock()
+	result, err := copyPayload(leader.Payload)
+	leader.Mutex.RUnlock()
+
+	proc.Mutex.Lock()
+	if err != nil {
+		bolterror.NewBoltError(err, "coalesce", "Couldn't copy the coalesced call's result", proc.InitialCommand, bolterror.Internal).AddToPayload(proc.Payload)
+	} else {
+		result.SetP(proc.ID, "id")
+		result.SetP(proc.Payload.Path("call_in").Data(), "call_in")
+		result.SetP(proc.Payload.Path("initial_input").Data(), "initial_input") //key fields can leave out some input
+		result.SetP(true, "coalesced")
+		proc.Payload = result
+	}
+	proc.Mutex.Unlock()
+
+	engine.completeProcess(proc, nil)
+	if proc.CallType == commandprocess.CallTypeWork {
+		engine.Requests.RemoveRequest(proc.ID)
+	}
+	engine.LogDebug("call_shared", logrus.Fields{"id": proc.ID, "leader": leader.ID}, proc.InitialCommand)
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+// coalesceProc returns a task call of v1/product with caching enabled
+func coalesceProc(id string, apicall *config.APICall) *commandprocess.CommandProcess {
+	payload, _ := gabs.ParseJSON([]byte(commandprocess.EmptyPayload))
+	proc := commandprocess.NewCommandProcessWithID(id, commandprocess.CallTypeTask, "v1/product", apicall, payload, "group", "")
+	proc.Payload.SetP(id, "id")
+	return proc
+}
+
+func TestCoalesceCall(t *testing.T) {
+	engine := memoryEngine()
+	cached := &config.APICall{Cache: config.CacheInfo{Enabled: true}}
+	leader := coalesceProc("leader", cached)
+	assert.Nil(t, engine.coalesceCall(leader, `{"sku": "1"}`), "First call should run itself")
+	assert.Equal(t, leader, engine.coalesceCall(coalesceProc("follower", cached), `{ "sku":"1" }`), "Identical calls should follow it")
+	assert.Nil(t, engine.coalesceCall(coalesceProc("other", cached), `{"sku": "2"}`), "Other input should run itself")
+	assert.Nil(t, engine.coalesceCall(coalesceProc("uncached", &config.APICall{}), `{"sku": "1"}`), "Calls without caching shouldn't coalesce")
+
+	leader.SetComplete()
+	for i := 0; i < 100 && engine.coalesceCall(coalesceProc("next", cached), `{"sku": "1"}`) != nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "next", engine.coalesceCall(coalesceProc("after", cached), `{"sku": "1"}`).ID, "Calls after completion should start over")
+}
+
+func TestFollowCall(t *testing.T) {
+	engine := memoryEngine()
+	cached := &config.APICall{Cache: config.CacheInfo{Enabled: true}}
+	leader := coalesceProc("leader", cached)
+	leader.Payload.SetP("widget", "return_value.name")
+	follower := coalesceProc("follower", cached)
+	follower.SetInitialInput(gabs.New())
+
+	go leader.SetComplete()
+	engine.followCall(follower, leader)
+	assert.True(t, follower.Complete, "Follower should complete with the leader")
+	assert.Equal(t, "widget", follower.Payload.Path("return_value.name").Data(), "Follower should get the leader's result")
+	assert.Equal(t, "follower", follower.Payload.Path("id").Data(), "Follower should keep its own id")
+	assert.Equal(t, true, follower.Payload.Path("coalesced").Data(), "Result should be marked as coalesced")
+}
+
+func TestFollowCallTimeout(t *testing.T) {
+	engine := memoryEngine()
+	leader := coalesceProc("leader", &config.APICall{Cache: config.CacheInfo{Enabled: true}})
+	leader.Payload.SetP("widget", "return_value.name")
+	follower := coalesceProc("follower", &config.APICall{Cache: config.CacheInfo{Enabled: true}, ResultTimeout: 10 * time.Millisecond})
+
+	engine.followCall(follower, leader)
+	assert.False(t, follower.Complete, "Follower should time out")
+	assert.True(t, follower.Payload.ExistsP("error.timeout"), "Follower should have a timeout error")
+
+	leader.SetComplete()
+	assert.True(t, waitForComplete(follower, time.Second, nil), "Follower should still complete with the leader")
+	assert.Equal(t, "widget", follower.Payload.Path("return_value.name").Data(), "Follower should get the leader's result")
+	assert.False(t, follower.Payload.ExistsP("error.timeout"), "Timeout error shouldn't carry over")
+}
+
+func TestFollowCallCancelled(t *testing.T) {
+	engine := memoryEngine()
+	leader := coalesceProc("leader", &config.APICall{Cache: config.CacheInfo{Enabled: true}})
+	follower := coalesceProc("follower", &config.APICall{Cache: config.CacheInfo{Enabled: true}})
+	leader.Cancel()
+	leader.SetComplete()
+
+	engine.followCall(follower, leader)
+	assert.True(t, follower.Complete, "Follower should run on its own")
+	assert.False(t, follower.Payload.ExistsP("coalesced"), "Follower shouldn't share a cancelled result")
+}
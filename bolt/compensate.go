@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+)
+
+// Reasons a call's completed steps are compensated, along with RetryOnInvalidReply and fallbackZombie
+const (
+	compensateHalt      = "halt"      //A worker set HALT_CALL along with an error
+	compensateFailed    = "failed"    //The call reached the end of its commands with errors
+	compensateInternal  = "internal"  //The engine couldn't continue the call, ie: a command failed to publish
+	compensateCancelled = "cancelled" //The caller cancelled the call
+)
+
+// Outcomes of a single compensation
+const (
+	compensationOK          = "ok"          //The compensating command replied without a new error
+	compensationError       = "error"       //The compensating command replied with a new error, or invalid JSON
+	compensationTimeout     = "timeout"     //No reply before the compensation's resultTimeoutMs, or the call's zombie limit
+	compensationSent        = "sent"        //Published without waiting, as neither timeout is set
+	compensationUnpublished = "unpublished" //The compensating command couldn't be published
+)
+
+// compensate publishes the compensating command of every completed step of a failed call, newest step first.
+// Each compensation is waited on before the next, and its outcome is added to the payload's compensations list
+// and the trace. Completed steps are cleared afterwards so a call is never compensated twice.
+func (engine *Engine) compensate(proc *commandprocess.CommandProcess, q broker.Queue, reason string) {
+	steps := proc.CompletedCommands
+	proc.CompletedCommands = nil
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		index := steps[i]
+		comp := engine.ConfigExt.Command(proc.InitialCommand, index).Compensate
+		if comp == nil {
+			continue
+		}
+		command := proc.APICall.Commands[index].Name
+
+		outcome := engine.runCompensation(proc, q, index, comp)
+		engine.LogInfo("cmd_compensate", logrus.Fields{"id": proc.ID, "command": command, "compensate": comp.Name, "reason": reason, "outcome": outcome}, proc.InitialCommand)
+		engine.Stats.Ch("commands").Ch(comp.Name).Ch("compensations").Incr()
+		if outcome != compensationOK && outcome != compensationSent {
+			engine.Stats.Ch("commands").Ch(comp.Name).Ch("compensation_failures").Incr()
+		}
+
+		proc.Mutex.Lock()
+		proc.Payload.ArrayAppendP(map[string]interface{}{
+			"command":      command,
+			"commandIndex": index,
+			"compensate":   comp.Name,
+			"reason":       reason,
+			"outcome":      outcome,
+		}, "compensations")
+		proc.Mutex.Unlock()
+		if engine.Config.Engine.TraceEnabled {
+			proc.AddTraceEntryWith(comp.Name, map[string]interface{}{"compensates": command, "outcome": outcome})
+		}
+	}
+}
+
+// runCompensation publishes a single compensating command with a copy of the call's payload and waits on its
+// reply, returning the outcome
+func (engine *Engine) runCompensation(proc *commandprocess.CommandProcess, q broker.Queue, index int, comp *config.CommandInfo) string {
+	correlationID := compensationCorrelationID(proc.ID, index)
+	wait := comp.ResultTimeout
+	if wait == 0 {
+		wait = proc.APICall.ResultZombie
+	}
+
+	proc.Mutex.RLock()
+	payload, err := copyPayload(proc.Payload)
+	proc.Mutex.RUnlock()
+	if err == nil {
+		payload.SetP(comp.ConfigParamsObj.Data(), "params")
+		err = engine.publishCommand(comp.Name, correlationID, payload, q.Name(), deadline(wait))
+	}
+	if err != nil {
+		engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": comp.Name, "error": err}, "Compensation failed to publish")
+		return compensationUnpublished
+	}
+
+	if wait == 0 {
+		return compensationSent
+	}
+	timeout := time.After(wait)
+	for {
+		select {
+		case <-timeout:
+			return compensationTimeout
+
+		case d, ok := <-q.Deliveries():
+			if !ok {
+				return compensationTimeout
+			}
+			if d.CorrelationID != correlationID || isProgress(d) {
+				engine.LogDebug("cmd_stale_reply", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": comp.Name}, "")
+				continue
+			}
+			body, err := gabs.ParseJSON(d.Body)
+			if err != nil || len(newErrorKeys(payload, body)) > 0 {
+				return compensationError
+			}
+			return compensationOK
+		}
+	}
+}
+
+// compensationCorrelationID builds the correlation id for the compensation of a step, ie: <call id>#c1
+func compensationCorrelationID(id string, index int) string {
+	return id + "#c" + strconv.Itoa(index)
+}
@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompensate(t *testing.T) {
+	var mutex sync.Mutex
+	var undone []string
+	undo := func(name string) stubWorker {
+		return func(payload *gabs.Container) bool {
+			mutex.Lock()
+			undone = append(undone, name)
+			mutex.Unlock()
+			return true
+		}
+	}
+	ok := func(payload *gabs.Container) bool { return true }
+	engine := callEngine(t, `{"apiCalls": {"v1/order": {"resultZombieMs": 2000, "commands": [
+		{"name": "stock/reserve", "compensate": {"name": "stock/release", "resultTimeoutMs": 1000}},
+		{"name": "order/log"},
+		{"name": "card/charge", "compensate": {"name": "card/refund", "resultTimeoutMs": 1000}},
+		{"name": "order/ship"}]}}}`,
+		map[string]stubWorker{
+			"stock/reserve": ok,
+			"order/log":     ok,
+			"card/charge":   ok,
+			"order/ship": func(payload *gabs.Container) bool {
+				payload.SetP("no courier", "error.order/ship")
+				payload.SetP(HaltCallCommandName, "nextCommand")
+				return true
+			},
+			"stock/release": undo("stock/release"),
+			"card/refund":   undo("card/refund"),
+		})
+
+	proc := runCall(t, engine, "v1/order", `{}`)
+	assert.True(t, proc.Payload.ExistsP("error.order/ship"), "Call should fail")
+	mutex.Lock()
+	assert.Equal(t, []string{"card/refund", "stock/release"}, undone, "Completed steps should be compensated newest first")
+	mutex.Unlock()
+
+	compensations, _ := proc.Payload.Path("compensations").Children()
+	assert.Len(t, compensations, 2, "Only steps with a compensating command should be listed")
+	assert.Equal(t, "card/charge", compensations[0].Path("command").Data(), "Newest step should be first")
+	assert.Equal(t, "stock/reserve", compensations[1].Path("command").Data(), "Oldest step should be last")
+	assert.Equal(t, compensateHalt, compensations[0].Path("reason").Data(), "Should give the reason")
+	assert.Equal(t, compensationOK, compensations[0].Path("outcome").Data(), "Should give the outcome")
+}
+
+func TestCompensateFailedCall(t *testing.T) {
+	undone := make(chan string, 2)
+	ok := func(payload *gabs.Container) bool { return true }
+	engine := callEngine(t, `{"apiCalls": {"v1/order": {"resultZombieMs": 2000, "commands": [
+		{"name": "stock/reserve", "compensate": {"name": "stock/release", "resultTimeoutMs": 1000}},
+		{"name": "card/charge", "compensate": {"name": "card/refund", "resultTimeoutMs": 1000}}]}}}`,
+		map[string]stubWorker{
+			"stock/reserve": ok,
+			"card/charge": func(payload *gabs.Container) bool {
+				payload.SetP("declined", "error.card/charge")
+				return true
+			},
+			"stock/release": func(payload *gabs.Container) bool {
+				undone <- "stock/release"
+				return true
+			},
+			"card/refund": func(payload *gabs.Container) bool {
+				undone <- "card/refund"
+				return true
+			},
+		})
+
+	proc := runCall(t, engine, "v1/order", `{}`)
+	assert.True(t, proc.Payload.ExistsP("error.card/charge"), "Call should fail")
+	compensations, _ := proc.Payload.Path("compensations").Children()
+	if assert.Len(t, compensations, 1, "Only the step that completed should be compensated") {
+		assert.Equal(t, "stock/reserve", compensations[0].Path("command").Data(), "Should compensate the completed step")
+		assert.Equal(t, compensateFailed, compensations[0].Path("reason").Data(), "Should give the reason")
+	}
+	assert.Equal(t, "stock/release", <-undone, "Completed step should be compensated")
+	assert.Len(t, undone, 0, "Errored step shouldn't be compensated")
+}
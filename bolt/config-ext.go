@@ -0,0 +1,605 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/condition"
+	"github.com/TeamFairmont/boltengine/mapping"
+	"github.com/TeamFairmont/boltengine/requestmanager"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+)
+
+// ConfigExt holds engine-only settings that are written in config.json next to the
+// shared settings, but that config.BuildConfig doesn't know about. Entries line up with
+// the shared config by api call name and command index.
+type ConfigExt struct {
+	Engine   EngineExt              `json:"engine"`
+	Cache    CacheExt               `json:"cache"`
+	APICalls map[string]*APICallExt `json:"apiCalls"`
+}
+
+// Cache defaults, used when CacheExt leaves a setting at 0
+const (
+	defaultCacheEntries       = 10000
+	defaultLocalExpirationSec = 10
+)
+
+// CacheExt sizes the memory cache of the "memory" and "tiered" cache types, see SetupCache
+type CacheExt struct {
+	MaxEntries         int   `json:"maxEntries"`         //Items kept before the least recently used are evicted. Defaults to 10000 unless maxBytes is set
+	MaxBytes           int64 `json:"maxBytes"`           //Bytes of keys and values kept before the least recently used are evicted, 0 for no limit
+	LocalExpirationSec int   `json:"localExpirationSec"` //Longest a "tiered" cache keeps an item in memory. Defaults to 10
+}
+
+// Entries returns how many items the memory cache keeps, 0 if only maxBytes limits it
+func (c CacheExt) Entries() int {
+	if c.MaxEntries == 0 && c.MaxBytes == 0 {
+		return defaultCacheEntries
+	}
+	return c.MaxEntries
+}
+
+// LocalExpiration returns the longest a tiered cache keeps an item in memory
+func (c CacheExt) LocalExpiration() time.Duration {
+	if c.LocalExpirationSec <= 0 {
+		return defaultLocalExpirationSec * time.Second
+	}
+	return time.Duration(c.LocalExpirationSec) * time.Second
+}
+
+// EngineExt holds the engine-only settings of the engine section
+type EngineExt struct {
+	Broker       string          `json:"broker"` //Message broker kind, "amqp" (default) connects to mqUrl, "memory" runs in process, see package broker
+	RequestStore RequestStoreExt `json:"requestStore"`
+	LongPoll     LongPollExt     `json:"longPoll"`
+	Webhooks     WebhooksExt     `json:"webhooks"`
+}
+
+// Long-poll defaults, used when LongPollExt leaves a setting at 0
+const (
+	defaultMaxWaitMs  = 30000
+	defaultMaxWaiters = 10
+)
+
+// LongPollExt limits /retr calls made with the wait parameter, which hold the connection until the request
+// completes
+type LongPollExt struct {
+	MaxWaitMs  int            `json:"maxWaitMs"`  //Longest wait allowed, longer waits are cut to it. Defaults to 30000
+	MaxWaiters int            `json:"maxWaiters"` //Waiting calls each group may have at once. Defaults to 10, -1 for no limit
+	Groups     map[string]int `json:"groups"`     //maxWaiters for specific groups
+}
+
+// Webhook defaults, used when WebhooksExt leaves a setting at 0
+const (
+	defaultCallbackAttempts  = 5
+	defaultCallbackBackoffMs = 1000
+	defaultCallbackTimeoutMs = 5000
+)
+
+// WebhooksExt sets how call results are posted to callback URLs, given per call with the Bolt-Callback-Url header
+// or per api call with its callback setting
+type WebhooksExt struct {
+	AllowHosts  []string `json:"allowHosts"`  //Hosts callbacks may be posted to, ".example.com" allows its subdomains. Empty allows none
+	MaxAttempts int      `json:"maxAttempts"` //Deliveries tried before giving up. Defaults to 5
+	BackoffMs   int      `json:"backoffMs"`   //Wait before the first retry, doubled after each one. Defaults to 1000
+	TimeoutMs   int      `json:"timeoutMs"`   //How long a delivery waits on the callback to answer. Defaults to 5000
+}
+
+// Attempts returns how many deliveries are tried
+func (wh WebhooksExt) Attempts() int {
+	if wh.MaxAttempts <= 0 {
+		return defaultCallbackAttempts
+	}
+	return wh.MaxAttempts
+}
+
+// Backoff returns the wait before the first retry
+func (wh WebhooksExt) Backoff() time.Duration {
+	if wh.BackoffMs <= 0 {
+		return defaultCallbackBackoffMs * time.Millisecond
+	}
+	return time.Duration(wh.BackoffMs) * time.Millisecond
+}
+
+// Timeout returns how long a delivery waits on the callback
+func (wh WebhooksExt) Timeout() time.Duration {
+	if wh.TimeoutMs <= 0 {
+		return defaultCallbackTimeoutMs * time.Millisecond
+	}
+	return time.Duration(wh.TimeoutMs) * time.Millisecond
+}
+
+// MaxWait returns the longest a /retr call may wait
+func (lp LongPollExt) MaxWait() time.Duration {
+	if lp.MaxWaitMs <= 0 {
+		return defaultMaxWaitMs * time.Millisecond
+	}
+	return time.Duration(lp.MaxWaitMs) * time.Millisecond
+}
+
+// Waiters returns how many waiting /retr calls group may have at once, less than 0 if there's no limit
+func (lp LongPollExt) Waiters(group string) int {
+	waiters, ok := lp.Groups[group]
+	if !ok {
+		waiters = lp.MaxWaiters
+	}
+	if waiters == 0 {
+		return defaultMaxWaiters
+	}
+	return waiters
+}
+
+// defaultRequestExpirationSec is how long a file or redis store keeps a request after its last save, unless
+// RequestStoreExt sets it
+const defaultRequestExpirationSec = 3600
+
+// RequestStoreExt sets where the engine keeps requests and their results, see requestmanager.NewStore
+type RequestStoreExt struct {
+	Type          string `json:"type"`          //"map" (default) keeps them in memory, "file" or "redis" keep task results across restarts
+	Path          string `json:"path"`          //Directory of a file store, key prefix of a redis store. A redis store uses the cache's host and pass
+	Shared        bool   `json:"shared"`        //Store shared by several engine nodes, so /retr works for requests made on any node
+	Node          string `json:"node"`          //Unique name of this node in a shared store, defaults to the hostname and bind address
+	ExpirationSec int    `json:"expirationSec"` //How long a file or redis store keeps a request after its last save. Defaults to 3600
+}
+
+// Expiration returns how long a request is kept after its last save. Requests are saved at every step, so it
+// needs to outlast the slowest command and completeResultExpiration.
+func (rs RequestStoreExt) Expiration() time.Duration {
+	if rs.ExpirationSec <= 0 {
+		return defaultRequestExpirationSec * time.Second
+	}
+	return time.Duration(rs.ExpirationSec) * time.Second
+}
+
+// What happens to a /request/ call whose client disconnects before it returned, see APICallExt.OnDisconnect
+const (
+	DisconnectTask  = "task"  //Keep running, the result can be fetched with /retr like a /task/ call. The default
+	DisconnectAbort = "abort" //Cancel the call, the same as /cancel
+)
+
+// APICallExt holds the engine-only settings of an apiCalls entry
+type APICallExt struct {
+	OnDisconnect   string       `json:"onDisconnect"`   //DisconnectTask or DisconnectAbort
+	Callback       string       `json:"callback"`       //URL task and work call results are posted to, see WebhooksExt
+	CacheKeyFields []string     `json:"cacheKeyFields"` //Input paths the cache key is made from, all of the input if empty
+	Cache          CachePolicy  `json:"cache"`
+	Commands       []CommandExt `json:"commands"`
+}
+
+// CachePolicy holds the engine-only settings of an api call's cache section, for serving results past their
+// expirationTimeSec
+type CachePolicy struct {
+	StaleWhileRevalidateSec int `json:"staleWhileRevalidateSec"` //How long an expired result is still served while one background call refreshes it
+	StaleIfErrorSec         int `json:"staleIfErrorSec"`         //How long an expired result is served instead of a call that errors, times out or goes zombie
+}
+
+// StaleWhileRevalidate returns how long an expired result is still served while it's refreshed
+func (cp CachePolicy) StaleWhileRevalidate() time.Duration {
+	return time.Duration(cp.StaleWhileRevalidateSec) * time.Second
+}
+
+// StaleIfError returns how long an expired result is served instead of a failed call
+func (cp CachePolicy) StaleIfError() time.Duration {
+	return time.Duration(cp.StaleIfErrorSec) * time.Second
+}
+
+// Grace returns how long an expired result has to be kept for
+func (cp CachePolicy) Grace() time.Duration {
+	if cp.StaleWhileRevalidateSec > cp.StaleIfErrorSec {
+		return cp.StaleWhileRevalidate()
+	}
+	return cp.StaleIfError()
+}
+
+// CommandExt holds the engine-only settings of a single entry in an api call's commands list
+type CommandExt struct {
+	Name string `json:"name"`
+
+	Parallel []config.CommandInfo `json:"parallel"` //Commands published to the mq at once instead of the entry itself
+	Quorum   int                  `json:"quorum"`   //Number of parallel replies needed before continuing, 0 waits for all
+
+	Condition     string          `json:"condition"`   //Expression checked against the payload before the command runs, see package condition
+	ElseCommand   string          `json:"elseCommand"` //Later command in the list to jump to when the condition is false, otherwise the command is skipped
+	ConditionExpr *condition.Expr `json:"-"`
+	ElseIndex     int             `json:"-"` //Index of ElseCommand, 0 if not set
+
+	Retry    RetryPolicy     `json:"retry"`
+	Fallback *FallbackPolicy `json:"fallback"`
+
+	Compensate *config.CommandInfo `json:"compensate"` //Command that undoes this one, published if the call fails after this command succeeded
+
+	Call string `json:"call"` //Another api call whose full pipeline is run in place of the entry itself
+
+	Foreach *ForeachPolicy `json:"foreach"`
+
+	InputMap  mapping.Rules `json:"inputMap"`  //Applied to the payload before the command is published
+	OutputMap mapping.Rules `json:"outputMap"` //Applied to the command's reply before it becomes the payload
+}
+
+// ForeachPolicy runs a command once per element of an array in the payload. Each element is published with an
+// empty return_value and the element in params.item, its index in params.index. Whatever the worker puts in
+// return_value is the element's result.
+type ForeachPolicy struct {
+	Path          string `json:"path"`          //Payload path of the array, ie: initial_input.skus
+	Output        string `json:"output"`        //Payload path the results are written to in element order, under data or return_value
+	Concurrency   int    `json:"concurrency"`   //Most elements waiting on a worker at once, 0 for no limit
+	ItemTimeoutMs int64  `json:"itemTimeoutMs"` //Time to wait on an element before it's failed, 0 waits until the zombie limit
+	FailOnError   bool   `json:"failOnError"`   //Halt the call if any element fails, otherwise failed elements are null in the output
+
+	ItemTimeout time.Duration `json:"-"`
+}
+
+// prepare validates the policy and fills in the item timeout
+func (f *ForeachPolicy) prepare() error {
+	if !hasRoot(f.Path, condition.Roots...) {
+		return fmt.Errorf("path must start with one of %s", strings.Join(condition.Roots, ", "))
+	}
+	if !hasRoot(f.Output, "data", "return_value") {
+		return errors.New("output must start with data or return_value")
+	}
+	if f.Concurrency < 0 || f.ItemTimeoutMs < 0 {
+		return errors.New("concurrency and itemTimeoutMs can't be negative")
+	}
+	f.ItemTimeout = time.Duration(f.ItemTimeoutMs) * time.Millisecond
+	return nil
+}
+
+// hasRoot returns true if path is a dotted payload path below one of roots
+func hasRoot(path string, roots ...string) bool {
+	for _, root := range roots {
+		if strings.HasPrefix(path, root+".") && !strings.Contains(path, "..") && !strings.HasSuffix(path, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Failure kinds a RetryPolicy can retry on
+const (
+	RetryOnTimeout      = "timeout"      //No reply within the command's resultTimeoutMs
+	RetryOnInvalidReply = "invalidReply" //The worker's reply wasn't valid JSON
+	RetryOnError        = "error"        //The worker added an entry to the payload's error section
+)
+
+// RetryPolicy sets when a failed command is republished to its queue with the same payload
+type RetryPolicy struct {
+	MaxAttempts       int      `json:"maxAttempts"`       //Total attempts including the first, 0 or 1 never retries
+	BackoffMs         int64    `json:"backoffMs"`         //Wait before the first retry
+	BackoffMultiplier float64  `json:"backoffMultiplier"` //Each following wait is the previous one times this, defaults to 1
+	On                []string `json:"on"`                //Failure kinds to retry, defaults to timeout and invalidReply
+}
+
+// Allows returns true if a command that failed with kind on the given attempt should be tried again
+func (r *RetryPolicy) Allows(kind string, attempt int) bool {
+	if attempt >= r.MaxAttempts {
+		return false
+	}
+	for _, on := range r.On {
+		if on == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns how long to wait before republishing a command whose given attempt failed
+func (r *RetryPolicy) Backoff(attempt int) time.Duration {
+	wait := float64(r.BackoffMs)
+	for i := 1; i < attempt; i++ {
+		wait *= r.BackoffMultiplier
+	}
+	return time.Duration(wait) * time.Millisecond
+}
+
+// FallbackPolicy sets what serves a command's step instead when the command times out, goes zombie or
+// replies with an error. Only one of Command or ReturnValue can be set.
+type FallbackPolicy struct {
+	Command     *config.CommandInfo    `json:"command"`     //Command published in place of the failed one, with its own timeout and params
+	ReturnValue map[string]interface{} `json:"returnValue"` //Static object merged into return_value in place of a reply
+}
+
+// Name returns the fallback command's name, or "returnValue" for a static fallback
+func (f *FallbackPolicy) Name() string {
+	if f.Command != nil {
+		return f.Command.Name
+	}
+	return "returnValue"
+}
+
+// prepare validates the policy and fills in the fallback command's timeout and params
+func (f *FallbackPolicy) prepare() error {
+	if (f.Command == nil) == (f.ReturnValue == nil) {
+		return errors.New("set one of command or returnValue")
+	}
+	if f.Command == nil {
+		return nil
+	}
+	if f.Command.Name == "" {
+		return errors.New("command is missing a name")
+	}
+	return prepareCommandInfo(f.Command)
+}
+
+// prepare validates the policy and fills in defaults
+func (r *RetryPolicy) prepare() error {
+	if r.MaxAttempts < 0 || r.BackoffMs < 0 {
+		return errors.New("maxAttempts and backoffMs can't be negative")
+	}
+	if r.BackoffMultiplier == 0 {
+		r.BackoffMultiplier = 1
+	} else if r.BackoffMultiplier < 1 {
+		return errors.New("backoffMultiplier must be at least 1")
+	}
+	if len(r.On) == 0 {
+		r.On = []string{RetryOnTimeout, RetryOnInvalidReply}
+	}
+	for _, on := range r.On {
+		switch on {
+		case RetryOnTimeout, RetryOnInvalidReply, RetryOnError:
+		default:
+			return fmt.Errorf("unknown failure kind %q in on", on)
+		}
+	}
+	return nil
+}
+
+// LoadConfigExt reads the engine-only settings from the config file at path. A missing
+// file or a blank path returns an empty ConfigExt.
+func LoadConfigExt(path string) (*ConfigExt, error) {
+	if path == "" {
+		return &ConfigExt{}, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &ConfigExt{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseConfigExt(raw)
+}
+
+// ParseConfigExt parses the engine-only settings out of a config.json document
+func ParseConfigExt(raw []byte) (*ConfigExt, error) {
+	ext := &ConfigExt{}
+	err := json.Unmarshal(raw, ext)
+	if err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// Call returns the settings for apicall. Returns an empty APICallExt if nothing extra was configured.
+func (ext *ConfigExt) Call(apicall string) *APICallExt {
+	if ext != nil {
+		if call, ok := ext.APICalls[apicall]; ok {
+			return call
+		}
+	}
+	return &APICallExt{}
+}
+
+// Command returns the settings for the command at index in apicall. Returns an empty
+// CommandExt if nothing extra was configured, so callers don't need to nil check.
+func (ext *ConfigExt) Command(apicall string, index int) *CommandExt {
+	if ext != nil {
+		if call, ok := ext.APICalls[apicall]; ok && index >= 0 && index < len(call.Commands) {
+			return &call.Commands[index]
+		}
+	}
+	return &CommandExt{}
+}
+
+// Prepare validates the settings against the shared config and fills in durations, parsed
+// params, etc. It is called from PostConfig so bad settings are caught at load time.
+func (ext *ConfigExt) Prepare(cfg *config.Config) error {
+	if !broker.IsKind(ext.Engine.Broker) {
+		return fmt.Errorf("engine.broker: unknown broker %s", ext.Engine.Broker)
+	}
+	if !requestmanager.IsStoreType(ext.Engine.RequestStore.Type) {
+		return fmt.Errorf("engine.requestStore.type: unknown store %s", ext.Engine.RequestStore.Type)
+	}
+	if ext.Engine.RequestStore.Type == requestmanager.StoreFile && ext.Engine.RequestStore.Path == "" {
+		return fmt.Errorf("engine.requestStore.path: a file store needs a directory")
+	}
+	if ext.Engine.RequestStore.Shared && (ext.Engine.RequestStore.Type == "" || ext.Engine.RequestStore.Type == requestmanager.StoreMap) {
+		return fmt.Errorf("engine.requestStore.shared: a map store can't be shared, use a file or redis store")
+	}
+	if ext.Cache.MaxEntries < 0 || ext.Cache.MaxBytes < 0 {
+		return fmt.Errorf("cache: maxEntries and maxBytes can't be negative")
+	}
+	for callName, callExt := range ext.APICalls {
+		apicall, ok := cfg.APICalls[callName]
+		if !ok {
+			continue
+		}
+		if callExt.OnDisconnect != "" && callExt.OnDisconnect != DisconnectTask && callExt.OnDisconnect != DisconnectAbort {
+			return fmt.Errorf("apiCalls.%s.onDisconnect: must be %s or %s", callName, DisconnectTask, DisconnectAbort)
+		}
+		if callExt.Callback != "" {
+			err := ext.Engine.Webhooks.Allowed(callExt.Callback)
+			if err != nil {
+				return fmt.Errorf("apiCalls.%s.callback: %s", callName, err)
+			}
+		}
+		if callExt.Cache.StaleWhileRevalidateSec < 0 || callExt.Cache.StaleIfErrorSec < 0 {
+			return fmt.Errorf("apiCalls.%s.cache: stale windows can't be negative", callName)
+		}
+		for _, field := range callExt.CacheKeyFields {
+			if field == "" {
+				return fmt.Errorf("apiCalls.%s.cacheKeyFields: fields can't be blank", callName)
+			}
+		}
+		if len(callExt.Commands) > len(apicall.Commands) {
+			return fmt.Errorf("apiCalls.%s: more commands than the shared config has", callName)
+		}
+		for i := range callExt.Commands {
+			cmdExt := &callExt.Commands[i]
+			if cmdExt.Name != apicall.Commands[i].Name {
+				return fmt.Errorf("apiCalls.%s.commands[%d]: expected %s, found %s", callName, i, apicall.Commands[i].Name, cmdExt.Name)
+			}
+			err := cmdExt.prepare(callName, i, &apicall)
+			if err != nil {
+				return err
+			}
+			if _, ok := cfg.APICalls[cmdExt.Call]; cmdExt.Call != "" && !ok {
+				return fmt.Errorf("apiCalls.%s.commands[%d].call: unknown api call %s", callName, i, cmdExt.Call)
+			}
+		}
+	}
+	return ext.checkSubCallCycles()
+}
+
+// checkSubCallCycles makes sure no api call ends up running itself through its sub-calls
+func (ext *ConfigExt) checkSubCallCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+
+	var visit func(callName string, path []string) error
+	visit = func(callName string, path []string) error {
+		switch state[callName] {
+		case visiting:
+			return fmt.Errorf("apiCalls.%s: sub-call cycle %s", callName, strings.Join(append(path, callName), " -> "))
+		case done:
+			return nil
+		}
+		state[callName] = visiting
+		if callExt, ok := ext.APICalls[callName]; ok {
+			for _, cmdExt := range callExt.Commands {
+				if cmdExt.Call != "" {
+					err := visit(cmdExt.Call, append(path, callName))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		state[callName] = done
+		return nil
+	}
+
+	for callName := range ext.APICalls {
+		err := visit(callName, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare validates and fills in a single command entry
+func (cmdExt *CommandExt) prepare(callName string, index int, apicall *config.APICall) error {
+	where := fmt.Sprintf("apiCalls.%s.commands[%d]", callName, index)
+
+	if cmdExt.Condition != "" {
+		expr, err := condition.Parse(cmdExt.Condition)
+		if err != nil {
+			return fmt.Errorf("%s.condition: %s", where, err)
+		}
+		cmdExt.ConditionExpr = expr
+	}
+	if cmdExt.ElseCommand != "" {
+		if cmdExt.ConditionExpr == nil {
+			return fmt.Errorf("%s.elseCommand: set without a condition", where)
+		}
+		//only allow jumping forward, so a call can't loop forever
+		for i := index + 1; i < len(apicall.Commands); i++ {
+			if apicall.Commands[i].Name == cmdExt.ElseCommand {
+				cmdExt.ElseIndex = i
+				break
+			}
+		}
+		if cmdExt.ElseIndex == 0 {
+			return fmt.Errorf("%s.elseCommand: %s isn't a later command in this call", where, cmdExt.ElseCommand)
+		}
+	}
+
+	for i := range cmdExt.Parallel {
+		branch := &cmdExt.Parallel[i]
+		if branch.Name == "" {
+			return fmt.Errorf("%s.parallel[%d]: missing name", where, i)
+		}
+		err := prepareCommandInfo(branch)
+		if err != nil {
+			return fmt.Errorf("%s.parallel[%d]: %s", where, i, err)
+		}
+	}
+	modes := 0
+	for _, set := range []bool{cmdExt.Call != "", len(cmdExt.Parallel) > 0, cmdExt.Foreach != nil} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("%s: only one of call, parallel or foreach can be set", where)
+	}
+	if cmdExt.Foreach != nil {
+		err := cmdExt.Foreach.prepare()
+		if err != nil {
+			return fmt.Errorf("%s.foreach: %s", where, err)
+		}
+	}
+	if cmdExt.Quorum < 0 || cmdExt.Quorum > len(cmdExt.Parallel) {
+		return fmt.Errorf("%s: quorum must be between 0 and the number of parallel commands", where)
+	}
+
+	err := cmdExt.Retry.prepare()
+	if err != nil {
+		return fmt.Errorf("%s.retry: %s", where, err)
+	}
+	err = cmdExt.InputMap.Validate()
+	if err != nil {
+		return fmt.Errorf("%s.inputMap: %s", where, err)
+	}
+	err = cmdExt.OutputMap.Validate()
+	if err != nil {
+		return fmt.Errorf("%s.outputMap: %s", where, err)
+	}
+	if cmdExt.Fallback != nil {
+		err = cmdExt.Fallback.prepare()
+		if err != nil {
+			return fmt.Errorf("%s.fallback: %s", where, err)
+		}
+	}
+	if cmdExt.Compensate != nil {
+		if cmdExt.Compensate.Name == "" {
+			return fmt.Errorf("%s.compensate: missing name", where)
+		}
+		err = prepareCommandInfo(cmdExt.Compensate)
+		if err != nil {
+			return fmt.Errorf("%s.compensate: %s", where, err)
+		}
+	}
+	return nil
+}
+
+// prepareCommandInfo does the same duration/params prep for an engine-only command that
+// PostConfig does for the shared config's commands
+func prepareCommandInfo(cmd *config.CommandInfo) error {
+	cmd.ResultTimeout = time.Duration(cmd.ResultTimeoutMs) * time.Millisecond
+	if len(cmd.ConfigParams) == 0 {
+		cmd.ConfigParamsObj = gabs.New()
+		return nil
+	}
+	ccfg, err := gabs.ParseJSON(cmd.ConfigParams)
+	if err != nil {
+		return err
+	}
+	cmd.ConfigParamsObj = ccfg
+	return nil
+}
@@ -0,0 +1,265 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// testExtConfig builds a shared config with a single api call for testing ConfigExt against
+func testExtConfig(commands ...string) *config.Config {
+	cfg := &config.Config{APICalls: map[string]config.APICall{}}
+	call := config.APICall{}
+	for _, name := range commands {
+		call.Commands = append(call.Commands, config.CommandInfo{Name: name})
+	}
+	cfg.APICalls["v1/test"] = call
+	return cfg
+}
+
+func TestParseConfigExtParallel(t *testing.T) {
+	ext, err := ParseConfigExt([]byte(`{
+		"apiCalls": {
+			"v1/test": {
+				"commands": [{
+					"name": "fetchAll",
+					"quorum": 1,
+					"parallel": [
+						{"name": "price/get", "resultTimeoutMs": 300, "configParams": {"currency": "usd"}},
+						{"name": "stock/get"}
+					]
+				}]
+			}
+		}
+	}`))
+	assert.Nil(t, err, "Should parse")
+	assert.Nil(t, ext.Prepare(testExtConfig("fetchAll")), "Should prepare")
+
+	cmdExt := ext.Command("v1/test", 0)
+	assert.Equal(t, 2, len(cmdExt.Parallel), "Should have 2 parallel commands")
+	assert.Equal(t, 300*time.Millisecond, cmdExt.Parallel[0].ResultTimeout, "Timeout should be converted")
+	assert.Equal(t, "usd", cmdExt.Parallel[0].ConfigParamsObj.Path("currency").Data(), "Params should be parsed")
+	assert.NotNil(t, cmdExt.Parallel[1].ConfigParamsObj, "Missing params should be empty")
+}
+
+func TestConfigExtCommandMissing(t *testing.T) {
+	var ext *ConfigExt
+	assert.NotNil(t, ext.Command("v1/test", 0), "Nil ext should still return settings")
+	ext = &ConfigExt{}
+	assert.Equal(t, 0, len(ext.Command("v1/unknown", 3).Parallel), "Unknown command should have no settings")
+}
+
+func TestConfigExtPrepareErrors(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "other"}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("fetchAll")), "Mismatched command names should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "fetchAll", "quorum": 3, "parallel": [{"name": "a"}]}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("fetchAll")), "Quorum larger than the group should error")
+}
+
+func TestConfigExtCondition(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [
+		{"name": "a", "condition": "data.stock > 0", "elseCommand": "c"},
+		{"name": "b", "condition": "exists(initial_input.sku)"}
+	]}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a", "b", "c")), "Should prepare")
+	assert.NotNil(t, ext.Command("v1/test", 0).ConditionExpr, "Condition should be parsed")
+	assert.Equal(t, 2, ext.Command("v1/test", 0).ElseIndex, "elseCommand should point at c")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "condition": "data.stock >"}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Bad condition should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a"}, {"name": "b", "condition": "true", "elseCommand": "a"}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a", "b")), "elseCommand can only jump forward")
+}
+
+func TestConfigExtRetry(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [
+		{"name": "a", "retry": {"maxAttempts": 3, "backoffMs": 100, "backoffMultiplier": 2}},
+		{"name": "b", "retry": {"maxAttempts": 2, "on": ["error"]}}
+	]}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a", "b")), "Should prepare")
+
+	retry := ext.Command("v1/test", 0).Retry
+	assert.True(t, retry.Allows(RetryOnTimeout, 1), "Timeouts should be retried by default")
+	assert.True(t, retry.Allows(RetryOnInvalidReply, 2), "Invalid replies should be retried by default")
+	assert.False(t, retry.Allows(RetryOnError, 1), "Errors shouldn't be retried by default")
+	assert.False(t, retry.Allows(RetryOnTimeout, 3), "Shouldn't retry past maxAttempts")
+	assert.Equal(t, 100*time.Millisecond, retry.Backoff(1), "First backoff should be backoffMs")
+	assert.Equal(t, 200*time.Millisecond, retry.Backoff(2), "Backoff should be multiplied")
+
+	retry = ext.Command("v1/test", 1).Retry
+	assert.True(t, retry.Allows(RetryOnError, 1), "Listed kind should be retried")
+	assert.False(t, retry.Allows(RetryOnTimeout, 1), "Unlisted kind shouldn't be retried")
+	assert.False(t, ext.Command("v1/test", 2).Retry.Allows(RetryOnTimeout, 1), "No policy shouldn't retry")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "retry": {"maxAttempts": 2, "on": ["crash"]}}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Unknown failure kind should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "retry": {"maxAttempts": 2, "backoffMultiplier": 0.5}}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Shrinking backoff should error")
+}
+
+func TestConfigExtFallback(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [
+		{"name": "a", "fallback": {"command": {"name": "a/cached", "resultTimeoutMs": 200}}},
+		{"name": "b", "fallback": {"returnValue": {"related": []}}}
+	]}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a", "b")), "Should prepare")
+	assert.Equal(t, "a/cached", ext.Command("v1/test", 0).Fallback.Name(), "Should name the fallback command")
+	assert.Equal(t, 200*time.Millisecond, ext.Command("v1/test", 0).Fallback.Command.ResultTimeout, "Timeout should be converted")
+	assert.Equal(t, "returnValue", ext.Command("v1/test", 1).Fallback.Name(), "Static fallback should be named returnValue")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "fallback": {}}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Empty fallback should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "fallback": {"command": {"name": "x"}, "returnValue": {}}}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Fallback with both command and returnValue should error")
+}
+
+func TestConfigExtCompensate(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [
+		{"name": "a", "compensate": {"name": "a/undo", "resultTimeoutMs": 300, "configParams": {"hard": true}}}
+	]}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	comp := ext.Command("v1/test", 0).Compensate
+	assert.Equal(t, 300*time.Millisecond, comp.ResultTimeout, "Timeout should be converted")
+	assert.Equal(t, true, comp.ConfigParamsObj.Path("hard").Data(), "Params should be parsed")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "compensate": {"resultTimeoutMs": 300}}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Compensate without a name should error")
+}
+
+func TestConfigExtSubCall(t *testing.T) {
+	cfg := testExtConfig("a", "details")
+	cfg.APICalls["v1/details"] = config.APICall{Commands: []config.CommandInfo{{Name: "b"}}}
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a"}, {"name": "details", "call": "v1/details"}]}}}`))
+	assert.Nil(t, ext.Prepare(cfg), "Should prepare")
+	assert.Equal(t, "v1/details", ext.Command("v1/test", 1).Call, "Should reference the call")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "call": "v1/missing"}]}}}`))
+	assert.NotNil(t, ext.Prepare(cfg), "Unknown call should error")
+
+	cfg.APICalls["v1/details"] = config.APICall{Commands: []config.CommandInfo{{Name: "b"}, {Name: "back"}}}
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {
+		"v1/test": {"commands": [{"name": "a"}, {"name": "details", "call": "v1/details"}]},
+		"v1/details": {"commands": [{"name": "b"}, {"name": "back", "call": "v1/test"}]}
+	}}`))
+	assert.NotNil(t, ext.Prepare(cfg), "Cycle should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "call": "v1/test"}]}}}`))
+	assert.NotNil(t, ext.Prepare(cfg), "Calling itself should error")
+}
+
+func TestConfigExtForeach(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [
+		{"name": "a", "foreach": {"path": "initial_input.skus", "output": "return_value.prices", "concurrency": 5, "itemTimeoutMs": 250}}
+	]}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, 250*time.Millisecond, ext.Command("v1/test", 0).Foreach.ItemTimeout, "Timeout should be converted")
+
+	bad := []string{
+		`{"path": "config.skus", "output": "data.prices"}`,
+		`{"path": "initial_input.skus", "output": "initial_input.prices"}`,
+		`{"path": "initial_input.", "output": "data.prices"}`,
+		`{"path": "initial_input.skus", "output": "data.prices", "concurrency": -1}`,
+	}
+	for _, foreach := range bad {
+		ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "foreach": ` + foreach + `}]}}}`))
+		assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Should error: "+foreach)
+	}
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "parallel": [{"name": "b"}], "foreach": {"path": "data.x", "output": "data.y"}}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Foreach and parallel together should error")
+}
+
+func TestConfigExtMapping(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a",
+		"inputMap": [{"op": "copy", "from": "initial_input.sku", "to": "data.productId"}],
+		"outputMap": [{"op": "rename", "from": "return_value.cost", "to": "return_value.price"}]
+	}]}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, 1, len(ext.Command("v1/test", 0).InputMap), "Should have input rules")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [{"name": "a", "outputMap": [{"op": "copy", "from": "data.a", "to": "initial_input.a"}]}]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Writing to initial_input should error")
+}
+
+func TestConfigExtBroker(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"engine": {"broker": "memory"}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, "memory", ext.Engine.Broker, "Should have the broker kind")
+
+	ext, _ = ParseConfigExt([]byte(`{"engine": {"broker": "kafka"}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Unknown brokers should error")
+}
+
+func TestConfigExtOnDisconnect(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"onDisconnect": "abort", "commands": []}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, DisconnectAbort, ext.Call("v1/test").OnDisconnect, "Should have the setting")
+	assert.Equal(t, "", ext.Call("v1/other").OnDisconnect, "Unconfigured calls should be empty")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"onDisconnect": "ignore"}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Unknown setting should error")
+}
+
+func TestConfigExtRequestStore(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"engine": {"requestStore": {"type": "file", "path": "/var/lib/bolt/requests"}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, "/var/lib/bolt/requests", ext.Engine.RequestStore.Path, "Should have the path")
+	assert.Equal(t, time.Hour, ext.Engine.RequestStore.Expiration(), "Should default the expiration")
+	ext, _ = ParseConfigExt([]byte(`{"engine": {"requestStore": {"type": "redis", "expirationSec": 60}}}`))
+	assert.Equal(t, time.Minute, ext.Engine.RequestStore.Expiration(), "Should have the expiration")
+
+	ext, _ = ParseConfigExt([]byte(`{"engine": {"requestStore": {"type": "file"}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "File stores need a path")
+
+	ext, _ = ParseConfigExt([]byte(`{"engine": {"requestStore": {"type": "mongo"}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Unknown stores should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"engine": {"requestStore": {"type": "redis", "shared": true}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Redis stores can be shared")
+	ext, _ = ParseConfigExt([]byte(`{"engine": {"requestStore": {"shared": true}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Map stores can't be shared")
+}
+
+func TestConfigExtCallback(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"engine": {"webhooks": {"allowHosts": ["hooks.example.com"]}}, "apiCalls": {"v1/test": {"callback": "https://hooks.example.com/done"}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, "https://hooks.example.com/done", ext.Call("v1/test").Callback, "Should have the callback")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"callback": "https://hooks.example.com/done"}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Callbacks must be on allowed hosts")
+}
+
+func TestConfigExtCache(t *testing.T) {
+	ext, _ := ParseConfigExt([]byte(`{"cache": {"type": "memory", "maxBytes": 1048576}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, 0, ext.Cache.Entries(), "maxBytes alone shouldn't limit entries")
+	assert.Equal(t, int64(1048576), ext.Cache.MaxBytes, "Should have the byte limit")
+	assert.Equal(t, 10*time.Second, ext.Cache.LocalExpiration(), "Should default the local expiration")
+
+	ext, _ = ParseConfigExt([]byte(`{}`))
+	assert.Equal(t, defaultCacheEntries, ext.Cache.Entries(), "Should default the entries")
+
+	ext, _ = ParseConfigExt([]byte(`{"cache": {"maxEntries": -1}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Negative sizes should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"cacheKeyFields": ["sku", ""]}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Blank key fields should error")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"cache": {"enabled": true, "staleWhileRevalidateSec": 30, "staleIfErrorSec": 300}}}}`))
+	assert.Nil(t, ext.Prepare(testExtConfig("a")), "Should prepare")
+	assert.Equal(t, 30*time.Second, ext.Call("v1/test").Cache.StaleWhileRevalidate(), "Should have the revalidate window")
+	assert.Equal(t, 300*time.Second, ext.Call("v1/test").Cache.Grace(), "Grace should be the longer window")
+
+	ext, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"cache": {"staleIfErrorSec": -1}}}}`))
+	assert.NotNil(t, ext.Prepare(testExtConfig("a")), "Negative windows should error")
+}
@@ -16,3 +16,19 @@ const ConfigPath = "/etc/bolt/config.json"
 // HaltCallCommandName is the string pased to payload.nextCommand to stop all further processing of an api call
 const HaltCallCommandName = "HALT_CALL"
 
+// DeadlineHeader is the message header holding the time, in unix milliseconds, after which the engine no longer
+// waits on a command's reply. Workers can skip or abandon work past it.
+const DeadlineHeader = "deadline"
+
+// CancelExchangeName is the fanout exchange, after the queue prefix, that cancel notices are broadcast to. A notice
+// has the cancelled call's id as its correlation id, workers can drop any command whose correlation id starts with it.
+const CancelExchangeName = "bolt.cancel"
+
+// ProgressMessageType is the message type a worker replies with to report progress on a command without
+// finishing it. The body is json: {"percent": 40, "message": "...", "data": {...}}, all optional.
+const ProgressMessageType = "progress"
+
+// CachePurgeCommandName is the string passed to payload.nextCommand to purge cached results instead of publishing a
+// command. The payload's cache_purge picks what to purge, see CachePurge. The call then carries on as if the
+// command had replied.
+const CachePurgeCommandName = "CACHE_PURGE"
@@ -61,7 +61,7 @@ func (ah Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		w.Header().Add("Access-Control-Allow-Credentials", "true")
-		w.Header().Add("Access-Control-Allow-Headers", "Authorization, Bolt-No-Cache")
+		w.Header().Add("Access-Control-Allow-Headers", "Authorization, Bolt-No-Cache, Bolt-Callback-Url")
 		w.Header().Add("Access-Control-Allow-Methods", "OPTIONS, GET, POST")
 	}
 
@@ -16,18 +16,15 @@ import (
 	"syscall"
 	"time"
 
-	"gopkg.in/go-redis/cache.v1"
-
 	"github.com/Sirupsen/logrus"
-	"github.com/TeamFairmont/amqp"
 	"github.com/TeamFairmont/gabs"
 
 	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/broker"
 	"github.com/TeamFairmont/boltengine/commandprocess"
 	"github.com/TeamFairmont/boltengine/requestmanager"
 	"github.com/TeamFairmont/boltengine/throttling"
 	"github.com/TeamFairmont/boltshared/config"
-	"github.com/TeamFairmont/boltshared/mqwrapper"
 	"github.com/TeamFairmont/boltshared/stats"
 	"github.com/TeamFairmont/boltshared/utils"
 )
@@ -106,6 +103,7 @@ func (listenerD *ListenerD) Stop() {
 // Engine holds config info, server struct, etc for a running engine
 type Engine struct {
 	Config     *config.Config
+	ConfigExt  *ConfigExt
 	ConfigPath string
 
 	Server        *http.Server
@@ -118,8 +116,11 @@ type Engine struct {
 	Stats    *stats.Collector
 	Throttle map[string]map[int]time.Time
 
-	mqConnection *mqwrapper.Connection
-	cacheCodec   *cache.Codec
+	broker   broker.Broker
+	replies  *replyRouter
+	waiters  waitLimiter
+	cache    cacheBackend
+	inflight coalescer
 
 	shutdown bool //set to true when .Shutdown() is called
 }
@@ -173,6 +174,18 @@ func (engine *Engine) PostConfig(cfg *config.Config) error {
 		cfg.APICalls[k] = v
 	}
 
+	//engine-only settings for the api calls, read from the same config file
+	ext, err := LoadConfigExt(engine.ConfigPath)
+	if err == nil {
+		err = ext.Prepare(cfg)
+	}
+	if err != nil {
+		engine.LogError("init", logrus.Fields{"error": err}, "CustomizeConfig error in engine settings")
+		engine.Config = cfg
+		return err
+	}
+	engine.ConfigExt = ext
+
 	//set auth mode
 	switch cfg.Engine.AuthMode {
 	case "hmac":
@@ -208,8 +221,9 @@ func (engine *Engine) ListenAndServe() error {
 	//Initialize throttling for all the groups
 	engine.Throttle = throttle.InitThrottleGroups(&engine.Config.Security.Groups, engine.Throttle)
 
-	//create request manager
-	engine.Requests = requestmanager.NewRequestManager()
+	//create request manager, restoring the requests saved before the engine last stopped
+	engine.Requests = engine.openRequests()
+	defer engine.Requests.Close()
 
 	if engine.Config != nil {
 		// start expiring results, stat log
@@ -240,17 +254,26 @@ func (engine *Engine) ListenAndServe() error {
 			Handler:        engine.Mux,
 		}
 
-		//connect to MQ
-		engine.mqConnection, err = mqwrapper.ConnectMQ(engine.Config.Engine.MQUrl)
+		//connect to MQ, dropping the connection a test engine is created with
+		if engine.broker != nil {
+			engine.broker.Close()
+		}
+		engine.broker, err = engine.connectBroker()
 		if err != nil {
 			engine.LogFatal("start", logrus.Fields{
 				"err": err,
 			}, "Couldn't connect to mqUrl")
 		} else {
+			err = engine.startReplyRouter()
+			if err != nil {
+				engine.LogFatal("start", logrus.Fields{
+					"err": err,
+				}, "Couldn't create the reply queue")
+			}
 			// recoverMqConnection also sets up the worker error queue goroutine
 			go engine.recoverMqConnection()
 		}
-		defer engine.mqConnection.Close()
+		defer engine.broker.Close()
 
 		//setup cache
 		err = engine.SetupCache()
@@ -339,8 +362,22 @@ func CreateTestEngine(loglevel string) *Engine {
 	}
 	cfg.Logging.Level = loglevel
 	engine.PostConfig(cfg)
+	if engine.ConfigExt != nil { //tests run without a live broker
+		engine.ConfigExt.Engine.Broker = broker.KindMemory
+	}
 	BuiltinHandlers(engine)
 
+	//ready to run calls without ListenAndServe, which replaces these
+	engine.Requests = requestmanager.NewRequestManager()
+	engine.broker, err = engine.connectBroker()
+	if err != nil {
+		return nil
+	}
+	err = engine.startReplyRouter()
+	if err != nil {
+		return nil
+	}
+
 	//if engine.ListenAndServe() != nil {
 	//	engine.LogFatal("critical", nil, "Error starting server, check config and ports")
 	//}
@@ -399,26 +436,31 @@ func (engine *Engine) IsShutdown() bool {
 // used as a go routine
 func (engine *Engine) workerErrorQueue(reconnectsig chan bool) {
 	//engine.Config.Engine.Advanced.QueuePrefix+engine.Config.Engine.Advanced.ErrorQueue
-	_, res, err := mqwrapper.CreateConsumeNamedQueue(engine.Config.Engine.Advanced.QueuePrefix+config.ErrorQueueName, engine.mqConnection.Channel)
+	q, err := engine.broker.Consume(engine.Config.Engine.Advanced.QueuePrefix + config.ErrorQueueName)
 	if err != nil {
 		engine.LogWarn("worker_log", logrus.Fields{"error": err}, "Could not connect to worker error queue")
 	} else {
-
+		res := q.Deliveries()
 		for {
 			select { // allow the go routine to exit on reboot
 			case <-utils.GetDoneChannel():
 				return
 			case <-reconnectsig:
-				_, res, err = mqwrapper.CreateConsumeNamedQueue(engine.Config.Engine.Advanced.QueuePrefix+config.ErrorQueueName, engine.mqConnection.Channel)
+				q, err = engine.broker.Consume(engine.Config.Engine.Advanced.QueuePrefix + config.ErrorQueueName)
 				if err != nil {
 					engine.LogWarn("worker_log", logrus.Fields{"error": err}, "Could not connect to worker error queue")
+					res = nil
+				} else {
+					res = q.Deliveries()
 				}
 
-			case d := <-res:
-				if d.RoutingKey != "" {
-					engine.LogWarn("worker_log", logrus.Fields{"data": string(d.Body)}, "")
+			case d, ok := <-res:
+				if !ok { //connection lost, wait for the reconnect
+					res = nil
+					continue
 				}
-				d.Ack(false)
+				engine.LogWarn("worker_log", logrus.Fields{"data": string(d.Body)}, "")
+				d.Ack()
 			}
 		}
 	}
@@ -430,7 +472,7 @@ func (engine *Engine) recoverMqConnection() {
 	reconnectsig := make(chan bool)
 	go engine.workerErrorQueue(reconnectsig)
 
-	disc := engine.mqConnection.Connection.NotifyClose(make(chan *amqp.Error))
+	disc := engine.broker.NotifyClose()
 	d, _ := time.ParseDuration("1s")
 	go func() { // set currentIteration to the current boltIteration
 		currentIteration := utils.GetBoltIteration()
@@ -442,29 +484,116 @@ func (engine *Engine) recoverMqConnection() {
 			if !keepAlive { //if currentIteration does not match boltIteration, close the go routine
 				return
 			}
-		DisconnectEvent:
-			for ev := range disc {
-				engine.LogDebug("mq_ev", logrus.Fields{"ev": ev}, "Range disc")
-				for { //enter reconnect loop
-					engine.LogWarn("mq_error", logrus.Fields{}, "Attempt reconnect to mqUrl")
-					var err error
-					engine.mqConnection, err = mqwrapper.ConnectMQ(engine.Config.Engine.MQUrl)
+			ev, ok := <-disc
+			if !ok { //closed on purpose, ie: reboot or shutdown
+				return
+			}
+			engine.LogDebug("mq_ev", logrus.Fields{"ev": ev}, "Range disc")
+			for { //enter reconnect loop
+				engine.LogWarn("mq_error", logrus.Fields{}, "Attempt reconnect to mqUrl")
+				var err error
+				engine.broker, err = engine.connectBroker()
+				if err != nil {
+					engine.LogError("mq_error", logrus.Fields{"err": err}, "Couldn't reconnect to mqUrl")
+					time.Sleep(d)
+				} else {
+					engine.LogInfo("mq_connect", logrus.Fields{}, "Successfully reconnected to mqUrl")
+					err = engine.startReplyRouter()
 					if err != nil {
-						engine.LogError("mq_error", logrus.Fields{"err": err}, "Couldn't reconnect to mqUrl")
-						time.Sleep(d)
-					} else {
-						engine.LogInfo("mq_connect", logrus.Fields{}, "Successfully reconnected to mqUrl")
-						reconnectsig <- true
-						defer engine.mqConnection.Close()
-						disc = engine.mqConnection.Connection.NotifyClose(make(chan *amqp.Error))
-						break DisconnectEvent
+						engine.LogError("mq_error", logrus.Fields{"err": err}, "Couldn't recreate the reply queue")
 					}
+					reconnectsig <- true
+					defer engine.broker.Close()
+					disc = engine.broker.NotifyClose()
+					break
 				}
 			}
 		}
 	}()
 }
 
+// connectBroker connects to the message broker set by engine.broker in the config, RabbitMQ at mqUrl by default
+func (engine *Engine) connectBroker() (broker.Broker, error) {
+	kind := ""
+	if engine.ConfigExt != nil {
+		kind = engine.ConfigExt.Engine.Broker
+	}
+	return broker.New(kind, engine.Config.Engine.MQUrl)
+}
+
+// openRequests creates the request manager on the store set by engine.requestStore and restores the requests
+// saved in it. Falls back to keeping requests in memory if the store can't be opened.
+func (engine *Engine) openRequests() *requestmanager.RequestManager {
+	storeExt := RequestStoreExt{}
+	if engine.ConfigExt != nil {
+		storeExt = engine.ConfigExt.Engine.RequestStore
+	}
+	store, err := requestmanager.NewStore(storeExt.Type, storeExt.Path, engine.Config.Cache.Host, engine.Config.Cache.Pass, storeExt.Expiration())
+	if err != nil {
+		engine.LogError("request_store", logrus.Fields{"err": err, "type": storeExt.Type}, "Couldn't open the request store, requests are kept in memory only")
+		return requestmanager.NewRequestManager()
+	}
+
+	rm := requestmanager.NewRequestManagerWithStore(store)
+	if storeExt.Shared {
+		node := storeExt.Node
+		if node == "" {
+			host, _ := os.Hostname()
+			node = host + engine.Config.Engine.Bind
+		}
+		rm = requestmanager.NewSharedRequestManager(store, node)
+		engine.LogInfo("request_store", logrus.Fields{"node": node, "type": storeExt.Type}, "Sharing requests with other nodes")
+	}
+	count, err := rm.Restore(engine.restoreRequest)
+	if err != nil {
+		engine.LogError("request_store", logrus.Fields{"err": err, "type": storeExt.Type}, "Couldn't load saved requests")
+	} else if count > 0 {
+		engine.LogInfo("request_store", logrus.Fields{"count": count, "type": storeExt.Type}, "Restored saved requests")
+	}
+	return rm
+}
+
+// restoreRequest prepares a request loaded from the request store. Requests for api calls that are no longer
+// configured are dropped. Requests that were still running are completed with an error, nothing is left to
+// process their commands.
+func (engine *Engine) restoreRequest(proc *commandprocess.CommandProcess) bool {
+	apicall, ok := engine.Config.APICalls[proc.InitialCommand]
+	if !ok {
+		return false
+	}
+	proc.APICall = &apicall
+	if !proc.Complete {
+		bolterror.NewBoltError(nil, "restart", "Engine restarted before the call completed", proc.InitialCommand, bolterror.Internal).AddToPayload(proc.Payload)
+		proc.SetComplete()
+		proc.Payload.SetP(proc.Complete, "complete")
+		engine.LogWarn("call_interrupted", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand}, "Call didn't complete before the engine restarted")
+	}
+	return true
+}
+
+// lookupRequest finds a request by id. With a shared request store, requests made on other nodes are found too,
+// as of their owner's last save, and owned is false.
+func (engine *Engine) lookupRequest(id string) (req *commandprocess.CommandProcess, owned bool) {
+	req = engine.Requests.GetRequest(id)
+	if req != nil {
+		return req, true
+	}
+	req, err := engine.Requests.GetSharedRequest(id)
+	if err != nil {
+		engine.LogWarn("request_store", logrus.Fields{"id": id, "err": err}, "Couldn't read shared request")
+		return nil, false
+	}
+	if req == nil {
+		return nil, false
+	}
+	apicall, ok := engine.Config.APICalls[req.InitialCommand]
+	if !ok {
+		return nil, false
+	}
+	req.APICall = &apicall
+	return req, false
+}
+
 // expireResults periodically clears all completed results from the request manager
 func (engine *Engine) expireResults() {
 	d, err := time.ParseDuration(engine.Config.Engine.Advanced.CompleteResultLoopFreq)
@@ -559,6 +688,11 @@ func OutputError(w http.ResponseWriter, err *bolterror.BoltError) {
 
 // OutputRequest filters the payload and writes a call request to w
 func (engine *Engine) OutputRequest(w http.ResponseWriter, req *commandprocess.CommandProcess, filterKeys []string) {
+	fmt.Fprint(w, engine.FormatRequest(req, filterKeys))
+}
+
+// FormatRequest returns req's payload as OutputRequest writes it, filtered by filterKeys if they're not nil
+func (engine *Engine) FormatRequest(req *commandprocess.CommandProcess, filterKeys []string) string {
 	var ret string
 	//ret = ""
 	var payload *gabs.Container
@@ -577,8 +711,7 @@ func (engine *Engine) OutputRequest(w http.ResponseWriter, req *commandprocess.C
 	} else {
 		ret = payload.String()
 	}
-
-	fmt.Fprint(w, ret)
+	return ret
 }
 
 type debugFormFields struct {
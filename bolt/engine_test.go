@@ -21,6 +21,10 @@ import (
 func TestCreateTestEngine(t *testing.T) {
 	testengine := CreateTestEngine("error")
 	assert.NotNil(t, testengine, "Engine 1 was created successfully")
+	assert.NotNil(t, testengine.Requests, "Engine should track requests before ListenAndServe")
+	q, err := testengine.createReplyQueue("abc")
+	assert.Nil(t, err, "Engine should route replies before ListenAndServe")
+	q.Close()
 	go testengine.ListenAndServe()
 	testengine2 := CreateTestEngine("error")
 	assert.NotNil(t, testengine2, "Engine 2 was created successfully")
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+)
+
+// eventKeepAlive is how often an idle event stream gets a comment, so proxies don't close it
+const eventKeepAlive = 15 * time.Second
+
+// eventComplete is the last event of a stream, its data is the call's filtered result
+const eventComplete = "complete"
+
+// streamEvents writes req's events to w as server-sent events until req completes or the client goes away. The
+// last event is the request's result, filtered the same as OutputRequest.
+func (engine *Engine) streamEvents(w http.ResponseWriter, r *http.Request, req *commandprocess.CommandProcess) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		engine.OutputError(w, bolterror.NewBoltError(errors.New("no flusher"), "events", "Streaming not supported", req.ID, bolterror.Internal))
+		return
+	}
+	events, unsubscribe := req.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	engine.LogInfo("events_in", logrus.Fields{"id": req.ID, "command": req.InitialCommand}, "")
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			writeEvent(w, ev.Type, eventJSON(ev))
+		case <-req.CompleteChannel:
+			//events sent before completion go first
+			for pending := true; pending; {
+				select {
+				case ev := <-events:
+					writeEvent(w, ev.Type, eventJSON(ev))
+				default:
+					pending = false
+				}
+			}
+			req.Mutex.Lock()
+			req.Payload.SetP(req.Complete, "complete")
+			writeEvent(w, eventComplete, engine.FormatRequest(req, req.APICall.FilterKeys))
+			req.Mutex.Unlock()
+			flusher.Flush()
+			engine.LogInfo("events_out", logrus.Fields{"id": req.ID, "command": req.InitialCommand}, "")
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// eventJSON formats an event for a stream
+func eventJSON(ev commandprocess.Event) string {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// writeEvent writes one server-sent event. Every line of data gets its own data field, so pretty printed json
+// survives.
+func writeEvent(w io.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
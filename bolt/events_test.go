@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteEvent(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeEvent(buf, "complete", "{\n\t\"a\": 1\n}")
+	assert.Equal(t, "event: complete\ndata: {\ndata: \t\"a\": 1\ndata: }\n\n", buf.String(), "Every line should be a data field")
+}
+
+func TestStreamEvents(t *testing.T) {
+	engine := memoryEngine()
+	payload, _ := gabs.ParseJSON([]byte(`{"return_value": {"a": 1}}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, payload, "group", "")
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		proc.Notify(commandprocess.EventCommand, "first", nil)
+		proc.Notify(commandprocess.EventReply, "first", nil)
+		proc.SetComplete()
+	}()
+	w := httptest.NewRecorder()
+	engine.streamEvents(w, httptest.NewRequest("GET", "/events/abc", nil), proc)
+
+	body := w.Body.String()
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"), "Should be an event stream")
+	command := strings.Index(body, "event: command")
+	reply := strings.Index(body, "event: reply")
+	complete := strings.Index(body, "event: complete")
+	assert.True(t, command >= 0 && command < reply && reply < complete, "Events should be in order, ending with complete")
+	assert.Contains(t, body[complete:], `"complete":true`, "Complete should carry the result")
+}
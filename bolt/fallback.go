@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+)
+
+// fallbackZombie is the fallback reason when the zombie limit is hit, the other reasons are the RetryOn kinds
+const fallbackZombie = "zombie"
+
+// startFallback switches the current config-based command over to its fallback after the given kind of failure.
+// The step is added to the payload's fallbacks list, then the fallback command is published, or for a static
+// fallback the payload with the return value merged in is published straight back to q. Either way the reply
+// comes back with the fallback's correlation id and is processed like the command's own reply would have been.
+// Returns false if the command has no fallback, or it's already running.
+func (engine *Engine) startFallback(proc *commandprocess.CommandProcess, q broker.Queue, reason string) (bool, error) {
+	cmdExt := engine.ConfigExt.Command(proc.InitialCommand, proc.CurrentCommandIndex)
+	if cmdExt.Fallback == nil || !pendingIsPrimary(proc) {
+		return false, nil
+	}
+	fallback := cmdExt.Fallback
+	name := fallback.Name()
+
+	engine.LogInfo("cmd_fallback", logrus.Fields{"id": proc.ID, "command": proc.CurrentCommand.Name, "fallback": name, "reason": reason}, proc.InitialCommand)
+	engine.Stats.Ch("commands").Ch(proc.CurrentCommand.Name).Ch("fallbacks").Incr()
+	engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("fallbacks").Incr()
+
+	proc.Mutex.Lock()
+	proc.Fallback = true
+	proc.RetryTime = time.Time{}
+	proc.PendingCommand = name
+	proc.CommandAttempt = 1
+	proc.CorrelationID = fallbackCorrelationID(proc.ID)
+	proc.Payload.ArrayAppendP(map[string]interface{}{
+		"command":      proc.CurrentCommand.Name,
+		"commandIndex": proc.CurrentCommandIndex,
+		"fallback":     name,
+		"reason":       reason,
+	}, "fallbacks")
+	proc.Mutex.Unlock()
+
+	var err error
+	if fallback.Command != nil {
+		proc.Mutex.Lock()
+		proc.Payload.SetP(fallback.Command.ConfigParamsObj.Data(), "params")
+		proc.Mutex.Unlock()
+		if engine.Config.Engine.TraceEnabled {
+			proc.AddCommandTraceEntry(name)
+		}
+
+		proc.Mutex.Lock()
+		err = engine.publishCommand(name, proc.CorrelationID, proc.Payload, q.Name(), deadline(proc.APICall.ResultZombie))
+		proc.CommandTime = time.Now()
+		proc.Mutex.Unlock()
+	} else {
+		proc.Mutex.RLock()
+		var result *gabs.Container
+		result, err = fallbackResult(proc.Payload, fallback.ReturnValue)
+		proc.Mutex.RUnlock()
+		if err == nil {
+			err = engine.publishReply(q.Name(), proc.CorrelationID, result)
+		}
+	}
+	if err != nil {
+		engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": name, "error": err}, "Fallback failed to publish")
+	}
+	return true, err
+}
+
+// fallbackResult builds a static fallback's reply, a copy of payload with returnValue merged into its return_value
+func fallbackResult(payload *gabs.Container, returnValue map[string]interface{}) (*gabs.Container, error) {
+	result, err := copyPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	static, err := gabs.Consume(returnValue)
+	if err == nil {
+		static, err = copyPayload(static)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.SetP(mergeJSONValue(result.Path("return_value").Data(), static.Data()), "return_value")
+	return result, nil
+}
+
+// pendingIsPrimary returns true if the command waiting on a reply is the current config-based command itself,
+// rather than a nextCommand override or a fallback
+func pendingIsPrimary(proc *commandprocess.CommandProcess) bool {
+	return !proc.Fallback && proc.PendingCommand == proc.CurrentCommand.Name
+}
+
+// fallbackCorrelationID builds the correlation id for a fallback, ie: <call id>#f
+func fallbackCorrelationID(id string) string {
+	return id + "#f"
+}
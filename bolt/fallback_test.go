@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallback(t *testing.T) {
+	engine := callEngine(t, `{"apiCalls": {
+		"v1/price": {"resultTimeoutMs": 2000, "commands": [
+			{"name": "price/get", "fallback": {"command": {"name": "price/cached", "configParams": {"source": "cache"}}}}]},
+		"v1/stock": {"resultTimeoutMs": 2000, "commands": [
+			{"name": "stock/get", "resultTimeoutMs": 50, "fallback": {"returnValue": {"stock": 0, "estimated": true}}}]}}}`,
+		map[string]stubWorker{
+			"price/get": func(payload *gabs.Container) bool {
+				payload.SetP("down", "error.price/get")
+				return true
+			},
+			"price/cached": func(payload *gabs.Container) bool {
+				payload.SetP(9, "return_value.price")
+				payload.SetP(payload.Path("params.source").Data(), "return_value.source")
+				return true
+			},
+			"stock/get": func(payload *gabs.Container) bool { return false },
+		})
+
+	proc := runCall(t, engine, "v1/price", `{}`)
+	assert.EqualValues(t, 9, proc.Payload.Path("return_value.price").Data(), "Fallback command should serve the step")
+	assert.Equal(t, "cache", proc.Payload.Path("return_value.source").Data(), "Fallback should get its own params")
+	fallbacks, _ := proc.Payload.Path("fallbacks").Children()
+	assert.Len(t, fallbacks, 1, "Fallback should be marked")
+	assert.Equal(t, "price/get", fallbacks[0].Path("command").Data(), "Marker should name the failed command")
+	assert.Equal(t, "price/cached", fallbacks[0].Path("fallback").Data(), "Marker should name the fallback")
+	assert.Equal(t, RetryOnError, fallbacks[0].Path("reason").Data(), "Marker should give the reason")
+
+	proc = runCall(t, engine, "v1/stock", `{}`)
+	assert.EqualValues(t, 0, proc.Payload.Path("return_value.stock").Data(), "Static fallback should be merged into return_value")
+	assert.Equal(t, true, proc.Payload.Path("return_value.estimated").Data(), "Static fallback should be merged into return_value")
+	assert.False(t, hasErrors(proc.Payload), "Fallbacks aren't errors")
+	fallbacks, _ = proc.Payload.Path("fallbacks").Children()
+	assert.Len(t, fallbacks, 1, "Fallback should be marked")
+	assert.Equal(t, "returnValue", fallbacks[0].Path("fallback").Data(), "Marker should name the static fallback")
+	assert.Equal(t, RetryOnTimeout, fallbacks[0].Path("reason").Data(), "Marker should give the reason")
+}
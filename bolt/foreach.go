@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+)
+
+// processForeach runs a foreach command and publishes the collected results to replyTo with the given
+// correlation id, the same as a single worker would. See processParallel.
+func (engine *Engine) processForeach(proc *commandprocess.CommandProcess, entry *CommandExt, correlationID, replyTo string) {
+	engine.replyAsWorker(proc, entry.Name, correlationID, replyTo, engine.runForeach(proc, entry, correlationID))
+}
+
+// runForeach publishes the command once per element of the foreach array, keeping at most the concurrency limit
+// waiting on workers at once, and writes each element's result to the output array in element order. A failed
+// element is null in the output and gets its own error, ie: error["product/getPrice[3]"]. The call is only halted
+// if failOnError is set.
+func (engine *Engine) runForeach(proc *commandprocess.CommandProcess, entry *CommandExt, correlationID string) *gabs.Container {
+	foreach := entry.Foreach
+
+	proc.Mutex.RLock()
+	base, err := copyPayload(proc.Payload)
+	proc.Mutex.RUnlock()
+	if err != nil {
+		return engine.haltGroup(proc, entry, proc.Payload, err, "Foreach couldn't copy payload", bolterror.Internal)
+	}
+
+	var items []interface{}
+	if value := base.Path(foreach.Path).Data(); value != nil {
+		var ok bool
+		items, ok = value.([]interface{})
+		if !ok {
+			err = errors.New(foreach.Path + " isn't an array")
+			return engine.haltGroup(proc, entry, base, err, "Foreach path "+foreach.Path+" isn't an array", bolterror.Request)
+		}
+	}
+	count := len(items)
+	results := make([]interface{}, count)
+	if count == 0 {
+		base.SetP(results, foreach.Output)
+		return base
+	}
+
+	key := groupReplyKey(correlationID)
+	q, err := engine.createReplyQueue(key)
+	if err != nil {
+		engine.LogError("mq_error", nil, err.Error())
+		return engine.haltGroup(proc, entry, base, err, "Error creating MQ queue", bolterror.Internal)
+	}
+	defer q.Close()
+	res := q.Deliveries()
+
+	done := make([]bool, count)
+	sent := make([]time.Time, count)
+	failures := 0
+	fail := func(i int, err error, details string) {
+		done[i] = true
+		failures++
+		engine.Stats.Ch("commands").Ch(entry.Name).Ch("errors").Incr()
+		bolterror.NewBoltError(err, itemParent(entry.Name, i), details, proc.InitialCommand, bolterror.Request).AddToPayload(base)
+	}
+
+	timeout := make(chan int, count)
+	pending := 0
+	next := 0
+	concurrency := foreach.Concurrency
+	if concurrency == 0 || concurrency > count {
+		concurrency = count
+	}
+
+	//publishes elements until the concurrency limit is reached
+	fill := func() {
+		for ; next < count && pending < concurrency; next++ {
+			i := next
+			payload, err := copyPayload(base)
+			if err == nil {
+				payload.SetP(map[string]interface{}{}, "return_value")
+				payload.SetP(items[i], "params.item")
+				payload.SetP(i, "params.index")
+				err = engine.publishCommand(entry.Name, branchCorrelationID(key, i), payload, q.Name(), deadline(foreach.ItemTimeout, proc.APICall.ResultZombie))
+			}
+			if err != nil {
+				engine.LogError("foreach_error", logrus.Fields{"id": proc.ID, "command": entry.Name, "index": i, "error": err}, "Foreach item couldn't be published")
+				fail(i, err, "Command error: "+err.Error())
+				continue
+			}
+			sent[i] = time.Now()
+			pending++
+			if foreach.ItemTimeout > 0 {
+				go func(i int, to time.Duration) {
+					time.Sleep(to)
+					timeout <- i
+				}(i, foreach.ItemTimeout)
+			}
+		}
+	}
+
+	zombie := make(chan bool, 1)
+	if proc.APICall.ResultZombie > 0 {
+		go func(to time.Duration) {
+			time.Sleep(to)
+			zombie <- true
+		}(proc.APICall.ResultZombie)
+	}
+
+	fill()
+Wait:
+	for pending > 0 {
+		select {
+		case <-proc.CancelChannel:
+			engine.LogDebug("foreach_cancelled", logrus.Fields{"id": proc.ID, "command": entry.Name}, "")
+			return base
+
+		case <-zombie:
+			engine.LogWarn("foreach_zombie", logrus.Fields{"id": proc.ID, "command": entry.Name, "pending": pending}, proc.InitialCommand)
+			break Wait
+
+		case i := <-timeout:
+			if !done[i] {
+				engine.LogInfo("command_timeout", logrus.Fields{"id": proc.ID, "command": entry.Name, "index": i}, proc.InitialCommand)
+				engine.Stats.Ch("commands").Ch(entry.Name).Ch("timeouts").Incr()
+				fail(i, errors.New("item timeout"), "Command timeout")
+				pending--
+				fill()
+			}
+
+		case d, ok := <-res:
+			if !ok {
+				engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": entry.Name}, errReplyQueueClosed.Error())
+				break Wait
+			}
+			i, ok := branchIndex(key, d.CorrelationID, count)
+			if ok && isProgress(d) {
+				engine.recordProgress(proc, entry.Name, d)
+				continue
+			}
+			if !ok || done[i] {
+				engine.LogDebug("foreach_unknown_reply", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID}, "")
+				continue
+			}
+			engine.LogDebug("cmd_complete", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": entry.Name, "index": i, "body": string(d.Body)}, "")
+			pending--
+
+			body, err := gabs.ParseJSON(d.Body)
+			if err != nil {
+				fail(i, err, "Command error: "+err.Error())
+			} else if keys := newErrorKeys(base, body); len(keys) > 0 {
+				fail(i, errors.New("worker error"), "Command error: "+workerErrorDetails(body, keys))
+			} else {
+				engine.Stats.Ch("performance").Ch("commands").Ch(entry.Name).Ch("avg_time").Avg(float32(time.Now().Sub(sent[i]) / time.Millisecond))
+				results[i] = body.Path("return_value").Data()
+				done[i] = true
+			}
+			fill()
+		}
+	}
+
+	for i := range done {
+		if !done[i] {
+			fail(i, errors.New("item zombie"), "API Call zombie time limit reached before the item completed")
+		}
+	}
+	base.SetP(results, foreach.Output)
+
+	if failures > 0 && foreach.FailOnError {
+		msg := fmt.Sprintf("Foreach failed, %d of %d items had errors", failures, count)
+		return engine.haltGroup(proc, entry, base, errors.New(msg), msg, bolterror.Request)
+	}
+
+	engine.LogDebug("foreach_complete", logrus.Fields{"id": proc.ID, "command": entry.Name, "items": count, "failures": failures}, "")
+	return base
+}
+
+// itemParent builds the error parent for a single foreach element, ie: product/getPrice[3]
+func itemParent(command string, index int) string {
+	return command + "[" + strconv.Itoa(index) + "]"
+}
+
+// workerErrorDetails joins the details of the given error entries of a worker's reply
+func workerErrorDetails(reply *gabs.Container, keys []string) string {
+	details := make([]string, 0, len(keys))
+	for _, k := range keys {
+		detail, _ := reply.Search("error", k, "details").Data().(string)
+		details = append(details, k+": "+detail)
+	}
+	return strings.Join(details, "; ")
+}
@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForeach(t *testing.T) {
+	var mutex sync.Mutex
+	inflight, most := 0, 0
+	engine := callEngine(t, `{"apiCalls": {
+		"v1/prices": {"resultZombieMs": 2000, "commands": [{"name": "price/get",
+			"foreach": {"path": "initial_input.skus", "output": "return_value.prices", "concurrency": 2}}]},
+		"v1/strict": {"resultZombieMs": 2000, "commands": [{"name": "price/get",
+			"foreach": {"path": "initial_input.skus", "output": "return_value.prices", "failOnError": true}}]}}}`,
+		map[string]stubWorker{
+			"price/get": func(payload *gabs.Container) bool {
+				mutex.Lock()
+				inflight++
+				if inflight > most {
+					most = inflight
+				}
+				mutex.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mutex.Lock()
+				inflight--
+				mutex.Unlock()
+
+				sku := payload.Path("params.item").Data().(float64)
+				if sku == 3 {
+					payload.SetP("unknown sku", "error.price/get.details")
+				} else {
+					payload.SetP(sku*10, "return_value.price")
+				}
+				return true
+			},
+		})
+
+	proc := runCall(t, engine, "v1/prices", `{"skus": [1, 2, 3, 4, 5]}`)
+	prices, _ := proc.Payload.Path("return_value.prices").Children()
+	assert.Len(t, prices, 5, "Every element should have a result")
+	assert.EqualValues(t, 10, prices[0].Path("price").Data(), "Results should be in element order")
+	assert.EqualValues(t, 50, prices[4].Path("price").Data(), "Results should be in element order")
+	assert.Nil(t, prices[2].Data(), "Failed elements should be null")
+	assert.NotNil(t, proc.Payload.Search("error", "price/get[2]").Data(), "Failed elements should get their own error")
+	assert.Nil(t, proc.Payload.Search("error", "price/get[1]").Data(), "Other elements shouldn't have errors")
+	assert.False(t, proc.Payload.ExistsP("error.price/get"), "Element errors shouldn't halt the call by default")
+	mutex.Lock()
+	assert.Equal(t, 2, most, "Elements should run up to the concurrency limit at once")
+	mutex.Unlock()
+
+	proc = runCall(t, engine, "v1/strict", `{"skus": [1, 2, 3]}`)
+	assert.True(t, proc.Payload.ExistsP("error.price/get"), "failOnError should halt the call")
+	assert.NotNil(t, proc.Payload.Search("error", "price/get[2]").Data(), "Failed elements should get their own error")
+}
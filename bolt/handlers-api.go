@@ -50,10 +50,20 @@ func apicallHandlers(engine *Engine) {
 			w.Header().Set("Content-Type", "application/json")
 
 			vars := mux.Vars(r)
-			req := ctx.Engine.Requests.GetRequest(vars["id"])
+			req, owned := ctx.Engine.lookupRequest(vars["id"])
 			if req == nil {
 				ctx.Engine.OutputError(w, bolterror.NewBoltError(nil, "retr", "Invalid request ID", vars["id"], bolterror.Request))
 			} else {
+				//with ?wait=<ms>, hold the call until the request completes
+				if wait := retrWait(r); wait > 0 {
+					var err error
+					req, err = ctx.Engine.waitOnRequest(r, req, owned, HMACGroup, wait)
+					if err != nil {
+						ctx.Engine.OutputError(w, bolterror.NewBoltError(err, "retr", "Too many waiting requests", vars["id"], bolterror.Request))
+						return nil
+					}
+				}
+
 				req.UpdatePeekTime()
 
 				req.Payload.SetP(req.Complete, "complete")
@@ -67,7 +77,7 @@ func apicallHandlers(engine *Engine) {
 					reqjson, _ := json.MarshalIndent(req, "", "\t")
 					fmt.Fprint(w, string(reqjson))
 				} else {
-					ctx.Engine.OutputRequest(w, req, req.APICall.FilterKeys)
+					ctx.Engine.OutputPeek(w, req, req.APICall.FilterKeys)
 					engine.LogInfo("peek_call", logrus.Fields{"vars": vars, "command": req.InitialCommand}, "")
 					if req.Complete {
 						ctx.Engine.Requests.RemoveRequest(vars["id"])
@@ -78,5 +88,46 @@ func apicallHandlers(engine *Engine) {
 			return nil
 		}})
 
+	//cancels an in-flight request, no further commands are published and workers are sent a cancel notice
+	hand.Handle("/cancel/{id}", Handler{Context: engine.ContextAuth,
+		H: func(ctx *Context, w http.ResponseWriter, r *http.Request, HMACGroup string) error {
+			w.Header().Set("Content-Type", "application/json")
+
+			vars := mux.Vars(r)
+			req, owned := ctx.Engine.lookupRequest(vars["id"])
+			if req == nil {
+				ctx.Engine.OutputError(w, bolterror.NewBoltError(nil, "cancel", "Invalid request ID", vars["id"], bolterror.Request))
+			} else if !owned {
+				ctx.Engine.OutputError(w, bolterror.NewBoltError(nil, "cancel", "Request not owned by this node, cancel it on the node it was made on", vars["id"], bolterror.Request))
+			} else if !req.Cancel() {
+				ctx.Engine.OutputError(w, bolterror.NewBoltError(nil, "cancel", "Request already complete or cancelled", vars["id"], bolterror.Request))
+			} else {
+				engine.LogInfo("cancel_call", logrus.Fields{"id": req.ID, "command": req.InitialCommand}, "")
+				fmt.Fprintf(w, "{\"id\": %q, \"cancelled\": true}", req.ID)
+			}
+
+			return nil
+		}})
+
+	//streams an in-flight request's progress as server-sent events, ending with its result once complete
+	hand.Handle("/events/{id}", Handler{Context: engine.ContextAuth,
+		H: func(ctx *Context, w http.ResponseWriter, r *http.Request, HMACGroup string) error {
+			vars := mux.Vars(r)
+			req, owned := ctx.Engine.lookupRequest(vars["id"])
+			if req == nil {
+				w.Header().Set("Content-Type", "application/json")
+				ctx.Engine.OutputError(w, bolterror.NewBoltError(nil, "events", "Invalid request ID", vars["id"], bolterror.Request))
+			} else if !owned {
+				w.Header().Set("Content-Type", "application/json")
+				ctx.Engine.OutputError(w, bolterror.NewBoltError(nil, "events", "Request not owned by this node, stream its events from the node it was made on", vars["id"], bolterror.Request))
+			} else {
+				ctx.Engine.streamEvents(w, r, req)
+			}
+
+			return nil
+		}})
+
 	engine.Mux.Handle("/retr/", hand)
+	engine.Mux.Handle("/cancel/", hand)
+	engine.Mux.Handle("/events/", hand)
 }
@@ -6,6 +6,7 @@ package bolt
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltshared/config"
 	"github.com/TeamFairmont/boltshared/mqwrapper"
 	"github.com/TeamFairmont/boltshared/utils"
 	"github.com/TeamFairmont/gabs"
@@ -88,6 +90,28 @@ func coreHandleStats(ctx *Context, w http.ResponseWriter, r *http.Request, group
 	return nil
 }
 
+// coreHandleCachePurge purges cached results picked by a json CachePurge body. Access should be restricted using
+// config.json > security > handlerAccess, the same as /get-config
+func coreHandleCachePurge(ctx *Context, w http.ResponseWriter, r *http.Request, group string) error {
+	if strings.ToUpper(r.Method) != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil
+	}
+	purge := CachePurge{}
+	err := json.NewDecoder(r.Body).Decode(&purge)
+	if err != nil {
+		ctx.Engine.OutputError(w, bolterror.NewBoltError(err, "cache-purge", "Malformed purge, expected json with call, input or tags", "", bolterror.Request))
+		return nil
+	}
+	deleted, err := ctx.Engine.PurgeCache(purge)
+	if err != nil {
+		ctx.Engine.OutputError(w, bolterror.NewBoltError(err, "cache-purge", "Cache purge failed", purge.Call, bolterror.Request))
+		return nil
+	}
+	fmt.Fprintf(w, "{\"purged\": %d}", deleted)
+	return nil
+}
+
 // coreHandleGetConfig should restrict access using config.json > security > handlerAccess > handler":"/get-config", "allowGroups":["allowed_groupname_here"]
 func coreHandleGetConfig(ctx *Context, w http.ResponseWriter, r *http.Request, group string) error {
 	c, err := ctx.Engine.Config.JSON()
@@ -99,6 +123,23 @@ func coreHandleGetConfig(ctx *Context, w http.ResponseWriter, r *http.Request, g
 	return nil
 }
 
+// checkConfig returns an error if the config.json document in body couldn't be prepared by PostConfig
+func checkConfig(body []byte) error {
+	cfg, err := config.DefaultConfig()
+	if err != nil {
+		return err
+	}
+	cfg, err = config.CustomizeConfig(cfg, string(body))
+	if err != nil {
+		return err
+	}
+	ext, err := ParseConfigExt(body)
+	if err != nil {
+		return err
+	}
+	return ext.Prepare(cfg)
+}
+
 // coreHandleSaveConfig should restrict access using config.json > security > handlerAccess > handler":"/get-config", "allowGroups":["allowed_groupname_here"]
 func coreHandleSaveConfig(ctx *Context, w http.ResponseWriter, r *http.Request, group string) error {
 	// Error messages sent back to the client are intentionally vague when it comes to security.
@@ -117,6 +158,21 @@ func coreHandleSaveConfig(ctx *Context, w http.ResponseWriter, r *http.Request,
 		}, "Error reading request body of new config")
 	}
 
+	// A config PostConfig can't prepare would stop the engine from restarting, so it's never saved
+	if !securityError {
+		err = checkConfig(body)
+		if err != nil {
+			ctx.Engine.LogWarn("coreHandleSaveConfig", logrus.Fields{
+				"method":     r.Method,
+				"url":        r.URL.Path,
+				"remoteaddr": r.RemoteAddr,
+				"err":        err,
+			}, "New config is invalid, not saved")
+			ctx.Engine.OutputError(w, bolterror.NewBoltError(err, "save-config", "Invalid config: "+err.Error(), "", bolterror.Request))
+			return nil
+		}
+	}
+
 	// Save the config out to a file
 	if !securityError {
 		jsonByte := []byte(body)
@@ -88,3 +88,16 @@ func TestCoreHandlePending(t *testing.T) {
 	assert.Nil(t, err, "err should be nil")
 	assert.Contains(t, w.Body.String(), "reqTime", "Should contain reqTime")
 }
+
+func TestCoreHandleSaveConfigInvalid(t *testing.T) {
+	saveCtx := &Context{Engine: memoryEngine()}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/save-config", strings.NewReader(`{"engine": {"broker": "carrier-pigeon"}}`))
+
+	err := coreHandleSaveConfig(saveCtx, w, r, "")
+	assert.Nil(t, err, "err should be nil")
+	assert.Contains(t, w.Body.String(), "unknown broker", "Should answer with why the config is invalid")
+
+	assert.NotNil(t, checkConfig([]byte(`{"apiCalls": "nope"}`)), "Configs the shared config can't parse should error")
+	assert.Nil(t, checkConfig([]byte(`{}`)), "Empty config should be valid")
+}
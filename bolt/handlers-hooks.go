@@ -75,6 +75,9 @@ func BuiltinHandlers(eng *Engine) {
 	//save custom bolt configs and reload the config
 	eng.Mux.Handle("/save-config", Handler{Context: eng.ContextAuth, H: coreHandleSaveConfig})
 
+	//purges cached api call results
+	eng.Mux.Handle("/cache-purge", Handler{Context: eng.ContextAuth, H: coreHandleCachePurge})
+
 	// handler for engine reboot
 	eng.Mux.Handle("/engine-reboot", Handler{Context: eng.ContextAuth, H: coreHandleReboot})
 
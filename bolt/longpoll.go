@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+)
+
+// errTooManyWaiters is returned by waitOnRequest when the caller's group already has its limit of waiting calls
+var errTooManyWaiters = errors.New("too many waiting requests for this group")
+
+// waitLimiter counts the /retr calls waiting on a request, per group
+type waitLimiter struct {
+	mutex   sync.Mutex
+	waiting map[string]int
+}
+
+// acquire adds a waiter for group, returns false if group already has limit waiters. limit less than 0 is no limit.
+func (wl *waitLimiter) acquire(group string, limit int) bool {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+	if wl.waiting == nil {
+		wl.waiting = make(map[string]int)
+	}
+	if limit >= 0 && wl.waiting[group] >= limit {
+		return false
+	}
+	wl.waiting[group]++
+	return true
+}
+
+// release removes a waiter added by acquire
+func (wl *waitLimiter) release(group string) {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+	wl.waiting[group]--
+	if wl.waiting[group] <= 0 {
+		delete(wl.waiting, group)
+	}
+}
+
+// retrWait reads the wait parameter of a /retr call, in milliseconds. Returns 0 if it's missing or invalid.
+func retrWait(r *http.Request) time.Duration {
+	ms, err := strconv.Atoi(r.URL.Query().Get("wait"))
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// sharedPollInterval is how often waitOnRequest reads a request owned by another node from the shared store
+const sharedPollInterval = 250 * time.Millisecond
+
+// waitOnRequest blocks a /retr call until req completes, wait passes or the client goes away. wait is cut to
+// the engine's longPoll.maxWaitMs. A request owned by another node is a snapshot, so the shared store is polled
+// for its owner's saves instead. Returns the request as of the end of the wait, or errTooManyWaiters if group
+// is at its limit of waiting calls.
+func (engine *Engine) waitOnRequest(r *http.Request, req *commandprocess.CommandProcess, owned bool, group string, wait time.Duration) (*commandprocess.CommandProcess, error) {
+	longPoll := LongPollExt{}
+	if engine.ConfigExt != nil {
+		longPoll = engine.ConfigExt.Engine.LongPoll
+	}
+	if wait > longPoll.MaxWait() {
+		wait = longPoll.MaxWait()
+	}
+
+	if isComplete(req) {
+		return req, nil
+	}
+
+	if !engine.waiters.acquire(group, longPoll.Waiters(group)) {
+		engine.LogWarn("retr_wait", logrus.Fields{"id": req.ID, "group": group}, errTooManyWaiters.Error())
+		engine.Stats.Ch("general").Ch("rejected_waits").Incr()
+		return req, errTooManyWaiters
+	}
+	defer engine.waiters.release(group)
+
+	var stop <-chan struct{}
+	if r != nil {
+		stop = r.Context().Done()
+	}
+	complete := false
+	if owned {
+		complete = waitForComplete(req, wait, stop)
+	} else {
+		req, complete = engine.pollShared(req, wait, stop)
+	}
+	if !complete {
+		engine.Stats.Ch("general").Ch("expired_waits").Incr()
+	}
+	return req, nil
+}
+
+// pollShared reads req from the shared store until its owner saves it complete, limit passes or stop is closed.
+// Returns the last snapshot read, and false if it isn't complete.
+func (engine *Engine) pollShared(req *commandprocess.CommandProcess, limit time.Duration, stop <-chan struct{}) (*commandprocess.CommandProcess, bool) {
+	poll := time.NewTicker(sharedPollInterval)
+	defer poll.Stop()
+	expired := time.NewTimer(limit)
+	defer expired.Stop()
+	for {
+		select {
+		case <-poll.C:
+		case <-expired.C:
+			return req, false
+		case <-stop:
+			return req, false
+		}
+		latest, _ := engine.lookupRequest(req.ID)
+		if latest == nil { //removed by its owner or fetched meanwhile
+			return req, false
+		}
+		req = latest
+		if isComplete(req) {
+			return req, true
+		}
+	}
+}
+
+// isComplete reads req's Complete flag
+func isComplete(req *commandprocess.CommandProcess) bool {
+	req.Mutex.RLock()
+	defer req.Mutex.RUnlock()
+	return req.Complete
+}
@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltengine/requestmanager"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitLimiter(t *testing.T) {
+	wl := waitLimiter{}
+	assert.True(t, wl.acquire("a", 2), "Should be under the limit")
+	assert.True(t, wl.acquire("a", 2), "Should be under the limit")
+	assert.False(t, wl.acquire("a", 2), "Should be at the limit")
+	assert.True(t, wl.acquire("b", 2), "Groups have their own limits")
+	assert.True(t, wl.acquire("c", -1), "Negative limits are unlimited")
+	wl.release("a")
+	assert.True(t, wl.acquire("a", 2), "Released waiters should free a spot")
+}
+
+func TestLongPollExt(t *testing.T) {
+	lp := LongPollExt{}
+	assert.Equal(t, 30*time.Second, lp.MaxWait(), "Should default the wait")
+	assert.Equal(t, 10, lp.Waiters("a"), "Should default the waiters")
+
+	lp = LongPollExt{MaxWaitMs: 500, MaxWaiters: 3, Groups: map[string]int{"b": -1}}
+	assert.Equal(t, 500*time.Millisecond, lp.MaxWait(), "Should use the max wait")
+	assert.Equal(t, 3, lp.Waiters("a"), "Should use the max waiters")
+	assert.Equal(t, -1, lp.Waiters("b"), "Should use the group's waiters")
+}
+
+func TestRetrWait(t *testing.T) {
+	assert.Equal(t, 250*time.Millisecond, retrWait(httptest.NewRequest("GET", "/retr/peek/abc?wait=250", nil)), "Should read the wait")
+	assert.Equal(t, time.Duration(0), retrWait(httptest.NewRequest("GET", "/retr/peek/abc", nil)), "No wait is 0")
+	assert.Equal(t, time.Duration(0), retrWait(httptest.NewRequest("GET", "/retr/peek/abc?wait=soon", nil)), "Invalid waits are 0")
+}
+
+func TestWaitOnRequest(t *testing.T) {
+	engine := memoryEngine()
+	engine.ConfigExt, _ = ParseConfigExt([]byte(`{"engine": {"longPoll": {"maxWaitMs": 50, "maxWaiters": 1}}}`))
+	r := httptest.NewRequest("GET", "/retr/peek/abc?wait=1000", nil)
+
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, gabs.New(), "group", "token")
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		proc.SetComplete()
+	}()
+	req, err := engine.waitOnRequest(r, proc, true, "group", time.Second)
+	assert.Nil(t, err, "Should wait")
+	assert.True(t, isComplete(req), "Should return once complete")
+
+	proc = commandprocess.NewCommandProcessWithID("def", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, gabs.New(), "group", "token")
+	start := time.Now()
+	_, err = engine.waitOnRequest(r, proc, true, "group", time.Second)
+	assert.Nil(t, err, "Should wait")
+	assert.True(t, time.Since(start) < time.Second, "Wait should be cut to maxWaitMs")
+
+	engine.waiters.acquire("group", -1)
+	_, err = engine.waitOnRequest(r, proc, true, "group", time.Second)
+	assert.Equal(t, errTooManyWaiters, err, "Should be over the group's limit")
+}
+
+func TestWaitOnSharedRequest(t *testing.T) {
+	store := requestmanager.NewMapStore()
+	owner := requestmanager.NewSharedRequestManager(store, "node1")
+	engine := memoryEngine()
+	engine.Config.APICalls = map[string]config.APICall{"v1/test": {}}
+	engine.Requests = requestmanager.NewSharedRequestManager(store, "node2")
+	r := httptest.NewRequest("GET", "/retr/peek/abc?wait=2000", nil)
+
+	proc := owner.CreateRequest(commandprocess.CallTypeTask, "v1/test", &config.APICall{}, gabs.New(), "group", "token")
+	owner.SaveRequest(proc)
+	snapshot, owned := engine.lookupRequest(proc.ID)
+	assert.False(t, owned, "Request is owned by the other node")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		proc.SetComplete()
+		owner.SaveRequest(proc)
+	}()
+	req, err := engine.waitOnRequest(r, snapshot, owned, "group", 2*time.Second)
+	assert.Nil(t, err, "Should wait")
+	assert.True(t, isComplete(req), "Should return the owner's complete snapshot")
+	assert.False(t, isComplete(snapshot), "The first snapshot isn't updated")
+}
@@ -0,0 +1,213 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/validation"
+	"github.com/TeamFairmont/gabs"
+)
+
+// processParallel runs a parallel command group and publishes the merged result to replyTo with the given
+// correlation id, the same as a single worker would. This lets processCommands treat the whole group as one command,
+// so the group's own timeout, zombie, nextCommand, etc. work as usual.
+func (engine *Engine) processParallel(proc *commandprocess.CommandProcess, group *CommandExt, correlationID, replyTo string) {
+	engine.replyAsWorker(proc, group.Name, correlationID, replyTo, engine.runParallel(proc, group, correlationID))
+}
+
+// replyAsWorker publishes the result of a command the engine ran itself to replyTo, the same as a worker replying would
+func (engine *Engine) replyAsWorker(proc *commandprocess.CommandProcess, command, correlationID, replyTo string, result *gabs.Container) {
+	err := engine.publishReply(replyTo, correlationID, result)
+	if err != nil {
+		engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": command, "error": err}, "Engine run command result failed to publish")
+	}
+}
+
+// runParallel publishes every command of the group at once, then waits for replies until the quorum is reached,
+// every command replied, or the call goes zombie. The data and return_value of each reply are merged, in config
+// order, into a copy of the payload the group started with. Replies with new errors don't count toward the quorum,
+// only their errors are merged. If the quorum isn't reached the result halts the call.
+// Branch replies come back on their own route, keyed off the group's correlation id.
+func (engine *Engine) runParallel(proc *commandprocess.CommandProcess, group *CommandExt, correlationID string) *gabs.Container {
+	branches := group.Parallel
+
+	for _, branch := range branches {
+		if engine.Config.Engine.TraceEnabled {
+			proc.AddCommandTraceEntry(branch.Name)
+		}
+	}
+	proc.Mutex.RLock()
+	base, err := copyPayload(proc.Payload)
+	proc.Mutex.RUnlock()
+	if err != nil {
+		return engine.haltGroup(proc, group, proc.Payload, err, "Parallel group couldn't copy payload", bolterror.Internal)
+	}
+
+	key := groupReplyKey(correlationID)
+	q, err := engine.createReplyQueue(key)
+	if err != nil {
+		engine.LogError("mq_error", nil, err.Error())
+		return engine.haltGroup(proc, group, base, err, "Error creating MQ queue", bolterror.Internal)
+	}
+	defer q.Close()
+	res := q.Deliveries()
+
+	//publish every branch, each with its own copy of the payload and params
+	replies := make([]*gabs.Container, len(branches))
+	failed := make([]bool, len(branches))
+	failures := 0
+	sent := time.Now()
+	for i := range branches {
+		branch := &branches[i]
+		err = validate.CheckPayloadReqParams(engine.Config.CommandMetas[branch.Name].RequiredParams, base)
+		if err == nil {
+			var payload *gabs.Container
+			payload, err = copyPayload(base)
+			if err == nil {
+				payload.SetP(branch.ConfigParamsObj.Data(), "params")
+				engine.LogDebug("cmd_queued", logrus.Fields{"id": proc.ID, "command": branch.Name, "group": group.Name}, "")
+				err = engine.publishCommand(branch.Name, branchCorrelationID(key, i), payload, q.Name(), deadline(proc.APICall.ResultZombie))
+			}
+		}
+		if err != nil {
+			engine.LogError("parallel_error", logrus.Fields{"id": proc.ID, "command": branch.Name, "error": err}, "Parallel command couldn't be published")
+			engine.Stats.Ch("commands").Ch(branch.Name).Ch("errors").Incr()
+			bolterror.NewBoltError(err, branch.Name, "Command error: "+err.Error(), proc.InitialCommand, bolterror.Request).AddToPayload(base)
+			failed[i] = true
+			failures++
+		}
+	}
+
+	//per command timeouts, same as sequential commands these are reported but don't stop the wait
+	timeout := make(chan int, len(branches))
+	for i := range branches {
+		if branches[i].ResultTimeout > 0 {
+			go func(i int, to time.Duration) {
+				time.Sleep(to)
+				timeout <- i
+			}(i, branches[i].ResultTimeout)
+		}
+	}
+
+	zombie := make(chan bool, 1)
+	if proc.APICall.ResultZombie > 0 {
+		go func(to time.Duration) {
+			time.Sleep(to)
+			zombie <- true
+		}(proc.APICall.ResultZombie)
+	}
+
+	quorum := group.Quorum
+	if quorum == 0 {
+		quorum = len(branches)
+	}
+	received := 0
+
+Wait:
+	for received < quorum && received+failures < len(branches) {
+		select {
+		case <-proc.CancelChannel:
+			engine.LogDebug("parallel_cancelled", logrus.Fields{"id": proc.ID, "command": group.Name}, "")
+			return base
+
+		case <-zombie:
+			engine.LogWarn("parallel_zombie", logrus.Fields{"id": proc.ID, "command": group.Name, "received": received}, proc.InitialCommand)
+			break Wait
+
+		case i := <-timeout:
+			if replies[i] == nil && !failed[i] {
+				engine.LogInfo("command_timeout", logrus.Fields{"id": proc.ID, "command": branches[i].Name, "group": group.Name}, proc.InitialCommand)
+				engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("command_timeouts").Incr()
+				engine.Stats.Ch("commands").Ch(branches[i].Name).Ch("timeouts").Incr()
+			}
+
+		case d, ok := <-res:
+			if !ok {
+				engine.LogError("mq_error", logrus.Fields{"id": proc.ID, "command": group.Name}, errReplyQueueClosed.Error())
+				break Wait
+			}
+			i, ok := branchIndex(key, d.CorrelationID, len(branches))
+			if ok && isProgress(d) {
+				engine.recordProgress(proc, branches[i].Name, d)
+				continue
+			}
+			if !ok || replies[i] != nil || failed[i] {
+				engine.LogDebug("parallel_unknown_reply", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID}, "")
+				continue
+			}
+			engine.LogDebug("cmd_complete", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": branches[i].Name, "body": string(d.Body)}, "")
+
+			body, err := gabs.ParseJSON(d.Body)
+			if err != nil {
+				engine.Stats.Ch("commands").Ch(branches[i].Name).Ch("errors").Incr()
+				bolterror.NewBoltError(err, branches[i].Name, "Command error: "+err.Error(), proc.InitialCommand, bolterror.Request).AddToPayload(base)
+				failed[i] = true
+				failures++
+				continue
+			}
+			if keys := newErrorKeys(base, body); len(keys) > 0 {
+				engine.LogInfo("parallel_error", logrus.Fields{"id": proc.ID, "command": branches[i].Name, "error": workerErrorDetails(body, keys)}, "Parallel command replied with errors")
+				engine.Stats.Ch("commands").Ch(branches[i].Name).Ch("errors").Incr()
+				for _, k := range keys {
+					base.Set(body.Search("error", k).Data(), "error", k)
+				}
+				failed[i] = true
+				failures++
+				continue
+			}
+			engine.Stats.Ch("performance").Ch("commands").Ch(branches[i].Name).Ch("avg_time").Avg(float32(time.Now().Sub(sent) / time.Millisecond))
+			replies[i] = body
+			received++
+		}
+	}
+
+	for i := range replies {
+		if replies[i] != nil {
+			mergePayloadSections(base, replies[i], "data", "return_value")
+		}
+	}
+
+	if received < quorum {
+		engine.Stats.Ch("commands").Ch(group.Name).Ch("quorum_failures").Incr()
+		msg := fmt.Sprintf("Parallel group quorum not reached, %d of %d replies", received, quorum)
+		return engine.haltGroup(proc, group, base, errors.New(msg), msg, bolterror.Request)
+	}
+
+	engine.LogDebug("parallel_complete", logrus.Fields{"id": proc.ID, "command": group.Name, "received": received}, "")
+	return base
+}
+
+// haltGroup adds the error to a parallel group or foreach result and sets it to halt all further processing of the call
+func (engine *Engine) haltGroup(proc *commandprocess.CommandProcess, group *CommandExt, result *gabs.Container, err error, details string, errtype int) *gabs.Container {
+	engine.LogInfo("parallel_error", logrus.Fields{"id": proc.ID, "command": group.Name, "error": err}, details)
+	bolterror.NewBoltError(err, group.Name, details, proc.InitialCommand, errtype).AddToPayload(result)
+	result.SetP(HaltCallCommandName, "nextCommand")
+	return result
+}
+
+// branchCorrelationID builds the correlation id for a parallel branch or foreach element, ie: <group key>#2
+func branchCorrelationID(id string, index int) string {
+	return id + "#" + strconv.Itoa(index)
+}
+
+// branchIndex pulls the branch index back out of a reply's correlation id
+func branchIndex(id, correlationID string, count int) (int, bool) {
+	if !strings.HasPrefix(correlationID, id+"#") {
+		return 0, false
+	}
+	i, err := strconv.Atoi(correlationID[len(id)+1:])
+	if err != nil || i < 0 || i >= count {
+		return 0, false
+	}
+	return i, true
+}
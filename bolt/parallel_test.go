@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelGroup(t *testing.T) {
+	engine := callEngine(t, `{"apiCalls": {
+		"v1/quorum": {"resultZombieMs": 2000, "commands": [{"name": "product/all", "quorum": 2, "parallel": [
+			{"name": "product/price"}, {"name": "product/stock"}, {"name": "product/silent"}]}]},
+		"v1/all": {"resultZombieMs": 2000, "commands": [{"name": "product/all", "parallel": [
+			{"name": "product/price"}, {"name": "product/missing"}]}]},
+		"v1/errored": {"resultZombieMs": 2000, "commands": [{"name": "product/all", "parallel": [
+			{"name": "product/price"}, {"name": "product/stock", "configParams": {"fail": true}}]}]},
+		"v1/slow": {"resultZombieMs": 2000, "commands": [{"name": "product/all", "parallel": [
+			{"name": "product/price"}, {"name": "product/slow", "resultTimeoutMs": 20}]}]}}}`,
+		map[string]stubWorker{
+			"product/price": func(payload *gabs.Container) bool {
+				payload.SetP(10, "return_value.price")
+				return true
+			},
+			"product/stock": func(payload *gabs.Container) bool {
+				if payload.ExistsP("params.fail") {
+					payload.Set(map[string]interface{}{"details": "out of stock"}, "error", "product/stock")
+					return true
+				}
+				payload.SetP(3, "return_value.stock")
+				return true
+			},
+			"product/slow": func(payload *gabs.Container) bool {
+				time.Sleep(80 * time.Millisecond)
+				payload.SetP("late", "return_value.slow")
+				return true
+			},
+			"product/silent": func(payload *gabs.Container) bool { return false },
+		})
+
+	proc := runCall(t, engine, "v1/quorum", `{}`)
+	assert.False(t, hasErrors(proc.Payload), "Quorum should be enough")
+	assert.EqualValues(t, 10, proc.Payload.Path("return_value.price").Data(), "Replies should be merged")
+	assert.EqualValues(t, 3, proc.Payload.Path("return_value.stock").Data(), "Replies should be merged")
+
+	proc = runCall(t, engine, "v1/all", `{}`)
+	assert.True(t, proc.Payload.ExistsP("error.product/all"), "Missing the quorum should fail the group")
+	assert.EqualValues(t, 10, proc.Payload.Path("return_value.price").Data(), "Replies received should still be merged")
+	assert.True(t, proc.Payload.ExistsP("error.product/missing"), "Failed branches should be reported")
+
+	proc = runCall(t, engine, "v1/errored", `{}`)
+	assert.True(t, proc.Payload.ExistsP("error.product/all"), "Errored replies shouldn't count toward the quorum")
+	assert.Equal(t, "out of stock", proc.Payload.Search("error", "product/stock", "details").Data(), "Branch errors should be merged")
+	assert.Nil(t, proc.Payload.Path("return_value.stock").Data(), "Errored replies shouldn't be merged")
+
+	proc = runCall(t, engine, "v1/slow", `{}`)
+	assert.False(t, hasErrors(proc.Payload), "Branch timeouts shouldn't fail the group")
+	assert.Equal(t, "late", proc.Payload.Path("return_value.slow").Data(), "Branches past their timeout should still be waited on")
+}
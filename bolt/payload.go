@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import "github.com/TeamFairmont/gabs"
+
+// copyPayload returns a deep copy of payload, so it can be sent to a worker while the original keeps changing
+func copyPayload(payload *gabs.Container) (*gabs.Container, error) {
+	return gabs.ParseJSON(payload.Bytes())
+}
+
+// mergePayloadSections merges the given top level sections (ie: data, return_value) of src into dst.
+// Objects are merged key by key, anything else in src replaces what's in dst.
+func mergePayloadSections(dst, src *gabs.Container, sections ...string) {
+	for _, section := range sections {
+		srcval := src.Path(section).Data()
+		if srcval == nil {
+			continue
+		}
+		dst.SetP(mergeJSONValue(dst.Path(section).Data(), srcval), section)
+	}
+}
+
+// mergeJSONValue merges src into dst if both are JSON objects, otherwise returns src
+func mergeJSONValue(dst, src interface{}) interface{} {
+	dstmap, dstok := dst.(map[string]interface{})
+	srcmap, srcok := src.(map[string]interface{})
+	if !dstok || !srcok {
+		return src
+	}
+	for k, v := range srcmap {
+		dstmap[k] = mergeJSONValue(dstmap[k], v)
+	}
+	return dstmap
+}
+
+// newErrorKeys returns the keys of reply's error section that weren't in the payload sent to the worker
+func newErrorKeys(sent, reply *gabs.Container) []string {
+	keys := []string{}
+	replyErrors, ok := reply.Path("error").Data().(map[string]interface{})
+	if !ok {
+		return keys
+	}
+	sentErrors, _ := sent.Path("error").Data().(map[string]interface{})
+	for k := range replyErrors {
+		if _, ok := sentErrors[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// hasErrors returns true if payload has any errors, including timeouts and zombies
+func hasErrors(payload *gabs.Container) bool {
+	errs, _ := payload.Path("error").Data().(map[string]interface{})
+	return len(errs) > 0
+}
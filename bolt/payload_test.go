@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePayloadSections(t *testing.T) {
+	dst, _ := gabs.ParseJSON([]byte(`{"data": {"a": 1, "nested": {"x": 1}}, "return_value": {}, "error": {}}`))
+	src, _ := gabs.ParseJSON([]byte(`{"data": {"b": 2, "nested": {"y": 2}}, "return_value": {"price": 10}, "error": {"e": 1}}`))
+	mergePayloadSections(dst, src, "data", "return_value")
+
+	assert.Equal(t, float64(1), dst.Path("data.a").Data(), "Existing data should be kept")
+	assert.Equal(t, float64(2), dst.Path("data.b").Data(), "New data should be merged")
+	assert.Equal(t, float64(1), dst.Path("data.nested.x").Data(), "Nested objects should be merged")
+	assert.Equal(t, float64(2), dst.Path("data.nested.y").Data(), "Nested objects should be merged")
+	assert.Equal(t, float64(10), dst.Path("return_value.price").Data(), "return_value should be merged")
+	assert.Nil(t, dst.Path("error.e").Data(), "Unlisted sections should be left alone")
+}
+
+func TestBranchIndex(t *testing.T) {
+	i, ok := branchIndex("abc", branchCorrelationID("abc", 2), 3)
+	assert.True(t, ok, "Should find the branch")
+	assert.Equal(t, 2, i, "Should be branch 2")
+
+	_, ok = branchIndex("abc", "abc#5", 3)
+	assert.False(t, ok, "Out of range branch should be ignored")
+	_, ok = branchIndex("abc", "xyz#1", 3)
+	assert.False(t, ok, "Other call's reply should be ignored")
+}
+
+func TestNewErrorKeys(t *testing.T) {
+	sent, _ := gabs.ParseJSON([]byte(`{"error": {"timeout": {}}}`))
+	reply, _ := gabs.ParseJSON([]byte(`{"error": {"timeout": {}, "price/get": {}}}`))
+	assert.Equal(t, []string{"price/get"}, newErrorKeys(sent, reply), "Should only find the worker's error")
+	assert.Equal(t, 0, len(newErrorKeys(reply, reply)), "Unchanged errors aren't new")
+}
+
+func TestFallbackResult(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(`{"data": {"a": 1}, "return_value": {"price": 10}}`))
+	returnValue := map[string]interface{}{"related": []interface{}{}}
+	result, err := fallbackResult(payload, returnValue)
+	assert.Nil(t, err, "Should build result")
+	assert.Equal(t, float64(10), result.Path("return_value.price").Data(), "Existing return_value should be kept")
+	assert.Equal(t, []interface{}{}, result.Path("return_value.related").Data(), "Static value should be merged")
+	assert.Nil(t, payload.Path("return_value.related").Data(), "Original payload shouldn't change")
+
+	result.SetP("changed", "return_value.related")
+	assert.Equal(t, []interface{}{}, returnValue["related"], "Configured value shouldn't change")
+}
+
+func TestWorkerErrorDetails(t *testing.T) {
+	reply, _ := gabs.ParseJSON([]byte(`{"error": {"price/get": {"details": "Unknown sku", "type": 1}}}`))
+	assert.Equal(t, "price/get: Unknown sku", workerErrorDetails(reply, []string{"price/get"}), "Should include the worker's details")
+	assert.Equal(t, "price/get[3]", itemParent("price/get", 3), "Should index the command name")
+}
@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+)
+
+// isProgress returns true if d is a worker's progress message rather than its reply, see ProgressMessageType
+func isProgress(d broker.Message) bool {
+	return d.Type == ProgressMessageType
+}
+
+// recordProgress keeps a progress message from the worker running command as proc's latest progress. Messages
+// that can't be read are logged and dropped.
+func (engine *Engine) recordProgress(proc *commandprocess.CommandProcess, command string, d broker.Message) {
+	body := struct {
+		Percent float64     `json:"percent"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}{}
+	err := json.Unmarshal(d.Body, &body)
+	if err != nil {
+		engine.LogDebug("progress_invalid", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": command, "err": err}, "")
+		return
+	}
+	if body.Percent < 0 {
+		body.Percent = 0
+	} else if body.Percent > 100 {
+		body.Percent = 100
+	}
+	engine.LogDebug("cmd_progress", logrus.Fields{"id": proc.ID, "correlationId": d.CorrelationID, "command": command, "percent": body.Percent}, body.Message)
+	proc.SetProgress(commandprocess.Progress{Command: command, Percent: body.Percent, Message: body.Message, Data: body.Data, Time: time.Now()})
+	engine.saveRequest(proc)
+}
+
+// OutputPeek writes req like OutputRequest, adding the latest progress while req is still running
+func (engine *Engine) OutputPeek(w http.ResponseWriter, req *commandprocess.CommandProcess, filterKeys []string) {
+	req.Mutex.Lock()
+	if req.Progress == nil || req.Complete {
+		req.Mutex.Unlock()
+		engine.OutputRequest(w, req, filterKeys)
+		return
+	}
+	//progress isn't part of the payload workers see, so it's only there while formatting
+	req.Payload.SetP(req.Progress, "progress")
+	if filterKeys != nil {
+		filterKeys = append(filterKeys[:len(filterKeys):len(filterKeys)], "progress")
+	}
+	ret := engine.FormatRequest(req, filterKeys)
+	req.Payload.DeleteP("progress")
+	req.Mutex.Unlock()
+	w.Write([]byte(ret))
+}
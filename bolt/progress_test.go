@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordProgress(t *testing.T) {
+	engine := memoryEngine()
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, gabs.New(), "group", "")
+	events, unsubscribe := proc.Subscribe()
+	defer unsubscribe()
+
+	assert.True(t, isProgress(broker.Message{Type: ProgressMessageType}), "Progress type should be progress")
+	assert.False(t, isProgress(broker.Message{}), "Replies aren't progress")
+
+	engine.recordProgress(proc, "cmd", broker.Message{Type: ProgressMessageType, Body: []byte(`{"percent": 40, "message": "halfway", "data": {"rows": 10}}`)})
+	assert.Equal(t, 40.0, proc.Progress.Percent, "Should keep the percent")
+	assert.Equal(t, "halfway", proc.Progress.Message, "Should keep the message")
+	assert.Equal(t, "cmd", proc.Progress.Command, "Should keep the command")
+	ev := <-events
+	assert.Equal(t, commandprocess.EventProgress, ev.Type, "Should send a progress event")
+
+	engine.recordProgress(proc, "cmd", broker.Message{Type: ProgressMessageType, Body: []byte(`{"percent": 250}`)})
+	assert.Equal(t, 100.0, proc.Progress.Percent, "Percent should be capped")
+	engine.recordProgress(proc, "cmd", broker.Message{Type: ProgressMessageType, Body: []byte(`not json`)})
+	assert.Equal(t, 100.0, proc.Progress.Percent, "Invalid progress should be dropped")
+}
+
+func TestOutputPeek(t *testing.T) {
+	engine := memoryEngine()
+	payload, _ := gabs.ParseJSON([]byte(`{"return_value": {}}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, payload, "group", "")
+	proc.SetProgress(commandprocess.Progress{Command: "cmd", Percent: 40})
+
+	w := httptest.NewRecorder()
+	engine.OutputPeek(w, proc, nil)
+	assert.Contains(t, w.Body.String(), `"percent":40`, "Peek should show progress while running")
+	assert.False(t, proc.Payload.ExistsP("progress"), "Progress shouldn't stay in the payload")
+
+	proc.SetComplete()
+	w = httptest.NewRecorder()
+	engine.OutputPeek(w, proc, nil)
+	assert.NotContains(t, w.Body.String(), `"percent"`, "Peek shouldn't show progress once complete")
+}
@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/broker"
+)
+
+// replyBuffer is how many replies a route holds before its call reads them, extra replies are dropped
+const replyBuffer = 64
+
+// errNoReplyQueue is returned by createReplyQueue when the shared reply queue isn't being consumed
+var errNoReplyQueue = errors.New("reply queue not available")
+
+// replyRouter consumes the engine's single reply queue and hands each reply to the route waiting on it. Calls,
+// parallel groups and foreach commands each open a route keyed by their correlation id, see replyKey. Replies
+// for routes that are already closed, ie: a worker replying after the call completed, are counted and dropped.
+type replyRouter struct {
+	engine *Engine
+	queue  broker.Queue
+	mutex  sync.Mutex
+	routes map[string]*replyRoute
+}
+
+// startReplyRouter creates the engine's reply queue and starts routing its replies
+func (engine *Engine) startReplyRouter() error {
+	q, err := engine.broker.TempQueue()
+	if err != nil {
+		return err
+	}
+	router := &replyRouter{engine: engine, queue: q, routes: make(map[string]*replyRoute)}
+	engine.replies = router
+	go router.run()
+	return nil
+}
+
+// run dispatches replies until the reply queue closes, then closes every open route so their calls stop waiting
+func (router *replyRouter) run() {
+	engine := router.engine
+	for d := range router.queue.Deliveries() {
+		key := replyKey(d.CorrelationID)
+		router.mutex.Lock()
+		route := router.routes[key]
+		router.mutex.Unlock()
+
+		if route == nil {
+			engine.LogDebug("late_reply", logrus.Fields{"correlationId": d.CorrelationID}, "")
+			engine.Stats.Ch("general").Ch("late_replies").Incr()
+			continue
+		}
+		if !route.deliver(d) {
+			engine.LogWarn("reply_dropped", logrus.Fields{"correlationId": d.CorrelationID}, "Reply dropped, too many unread replies")
+			engine.Stats.Ch("general").Ch("dropped_replies").Incr()
+		}
+	}
+
+	router.mutex.Lock()
+	for key, route := range router.routes {
+		route.close()
+		delete(router.routes, key)
+	}
+	router.mutex.Unlock()
+}
+
+// open registers a route for key. Replies are published to the shared queue, so the route's Name is the queue's.
+func (router *replyRouter) open(key string) *replyRoute {
+	route := &replyRoute{router: router, key: key, deliveries: make(chan broker.Message, replyBuffer)}
+	router.mutex.Lock()
+	router.routes[key] = route
+	router.mutex.Unlock()
+	return route
+}
+
+// replyRoute receives the replies for one key of a replyRouter. It implements broker.Queue, so the code waiting
+// on replies doesn't need to know the queue is shared.
+type replyRoute struct {
+	router     *replyRouter
+	key        string
+	mutex      sync.Mutex
+	closed     bool
+	deliveries chan broker.Message
+}
+
+func (route *replyRoute) Name() string {
+	return route.router.queue.Name()
+}
+
+func (route *replyRoute) Deliveries() <-chan broker.Message {
+	return route.deliveries
+}
+
+// Close removes the route, later replies for its key are counted as late
+func (route *replyRoute) Close() error {
+	route.router.mutex.Lock()
+	if route.router.routes[route.key] == route {
+		delete(route.router.routes, route.key)
+	}
+	route.router.mutex.Unlock()
+	route.close()
+	return nil
+}
+
+// deliver queues a reply on the route without blocking, returns false if the route is full or closed
+func (route *replyRoute) deliver(d broker.Message) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+	if route.closed {
+		return false
+	}
+	select {
+	case route.deliveries <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+func (route *replyRoute) close() {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+	if !route.closed {
+		route.closed = true
+		close(route.deliveries)
+	}
+}
+
+// replyKey returns the route a reply belongs to, its correlation id up to the last #. Call ids and their
+// retry, fallback and compensation ids (<call id>#r2, etc.) share the call's route, group branch ids
+// (<group key>#3) go to the group's route.
+func replyKey(correlationID string) string {
+	if i := strings.LastIndex(correlationID, "#"); i >= 0 {
+		return correlationID[:i]
+	}
+	return correlationID
+}
+
+// groupReplyKey returns the route key for the branches of a parallel group or foreach command that was started
+// with correlationID. It's kept apart from the call's own route, which the group's merged result replies to.
+func groupReplyKey(correlationID string) string {
+	return correlationID + "#g"
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/broker"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/boltshared/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyKey(t *testing.T) {
+	assert.Equal(t, "abc", replyKey("abc"), "Call ids are their own key")
+	assert.Equal(t, "abc", replyKey("abc#r2"), "Retries share the call's key")
+	assert.Equal(t, "abc", replyKey("abc#c1"), "Compensations share the call's key")
+	key := groupReplyKey("abc#r2")
+	assert.Equal(t, key, replyKey(branchCorrelationID(key, 3)), "Branches use the group's key")
+	assert.NotEqual(t, "abc", replyKey(branchCorrelationID(groupReplyKey("abc"), 0)), "Branches don't go to the call's route")
+}
+
+// memoryEngine returns a bare engine on an in process broker, enough to publish and route replies
+func memoryEngine() *Engine {
+	return &Engine{
+		Config: &config.Config{},
+		Log:    logrus.StandardLogger(),
+		Stats:  stats.NewStatCollector("test"),
+		broker: broker.NewMemory(),
+	}
+}
+
+func TestReplyRouter(t *testing.T) {
+	engine := memoryEngine()
+	assert.Nil(t, engine.startReplyRouter(), "Router should start")
+
+	call, err := engine.createReplyQueue("abc")
+	assert.Nil(t, err, "Route should open")
+	group, _ := engine.createReplyQueue(groupReplyKey("abc"))
+	assert.Equal(t, call.Name(), group.Name(), "Routes share the reply queue")
+
+	engine.broker.Publish(call.Name(), broker.Message{CorrelationID: "xyz"})
+	engine.broker.Publish(call.Name(), broker.Message{CorrelationID: branchCorrelationID(groupReplyKey("abc"), 1)})
+	engine.broker.Publish(call.Name(), broker.Message{CorrelationID: "abc#r2"})
+
+	select {
+	case d := <-group.Deliveries():
+		assert.Equal(t, "abc#g#1", d.CorrelationID, "Branch reply should reach the group")
+	case <-time.After(time.Second):
+		t.Fatal("Group reply not routed")
+	}
+	select {
+	case d := <-call.Deliveries():
+		assert.Equal(t, "abc#r2", d.CorrelationID, "Unknown replies should be dropped, retries reach the call")
+	case <-time.After(time.Second):
+		t.Fatal("Call reply not routed")
+	}
+
+	assert.Nil(t, group.Close(), "Route should close")
+	_, ok := <-group.Deliveries()
+	assert.False(t, ok, "Closed route deliveries should be closed")
+
+	engine.broker.Close()
+	select {
+	case _, ok = <-call.Deliveries():
+		assert.False(t, ok, "Routes should close with the reply queue")
+	case <-time.After(time.Second):
+		t.Fatal("Route not closed with the broker")
+	}
+}
@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/bolterror"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+)
+
+// processSubCall runs the api call named by entry and publishes the merged result to replyTo with the given
+// correlation id, the same as a single worker would. See processParallel.
+func (engine *Engine) processSubCall(proc *commandprocess.CommandProcess, entry *CommandExt, correlationID, replyTo string) {
+	engine.replyAsWorker(proc, entry.Name, correlationID, replyTo, engine.runSubCall(proc, entry))
+}
+
+// runSubCall runs another api call's full pipeline with the parent's initial_input, the same as if a client had
+// requested it: cache, required params, timeouts and all. The sub-call's return_value, data and error sections
+// are then merged into a copy of the parent's payload.
+func (engine *Engine) runSubCall(proc *commandprocess.CommandProcess, entry *CommandExt) *gabs.Container {
+	proc.Mutex.RLock()
+	result, err := copyPayload(proc.Payload)
+	proc.Mutex.RUnlock()
+	if err != nil {
+		result = gabs.New()
+		bolterror.NewBoltError(err, entry.Name, "Sub-call couldn't copy payload", proc.InitialCommand, bolterror.Internal).AddToPayload(result)
+		return result
+	}
+	input := result.Path("initial_input")
+
+	//same cache check as HandleCall
+	cacheval, err := engine.GetCacheItem(entry.Call, input.String())
+	if err == nil {
+		returnvalue, err := gabs.ParseJSON([]byte(cacheval))
+		if err == nil {
+			engine.LogDebug("subcall_cached", logrus.Fields{"id": proc.ID, "command": entry.Name, "call": entry.Call}, "")
+			engine.Stats.Ch("general").Ch("cache_hits").Incr()
+			result.SetP(mergeJSONValue(result.Path("return_value").Data(), returnvalue.Data()), "return_value")
+			return result
+		}
+		engine.DelCacheItem(entry.Call, input.String())
+		engine.LogWarn("cache_error", logrus.Fields{"id": proc.ID, "command": entry.Call, "cached": true}, "Cached value couldn't be parsed to JSON")
+	}
+
+	apicall := engine.Config.APICalls[entry.Call]
+	payload, _ := gabs.ParseJSON([]byte(commandprocess.EmptyPayload))
+	child := commandprocess.NewCommandProcess(commandprocess.CallTypeTask, entry.Call, &apicall, payload, proc.HMACGroup, proc.HMACToken)
+	child.Payload.SetP(time.Now(), "call_in")
+	child.SetInitialInput(input)
+	child.Payload.SetP(child.ID, "id")
+
+	engine.LogInfo("subcall_in", logrus.Fields{"id": proc.ID, "subcallId": child.ID, "command": entry.Name, "call": entry.Call}, "")
+	engine.Stats.Ch("performance").Ch("calls").Ch(entry.Call).Ch("hits").Incr()
+
+	//cancelling the parent cancels the sub-call
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-proc.CancelChannel:
+			child.Cancel()
+		case <-finished:
+		}
+	}()
+
+	//processCall returns early if the sub-call times out or returns after a command, so wait on the rest
+	engine.processCall(child)
+	if !waitForComplete(child, proc.APICall.ResultZombie, nil) {
+		engine.LogWarn("subcall_zombie", logrus.Fields{"id": proc.ID, "subcallId": child.ID, "command": entry.Name, "call": entry.Call}, proc.InitialCommand)
+		bolterror.NewBoltError(errors.New("sub-call didn't complete"), entry.Name, "Sub-call "+entry.Call+" didn't complete before the zombie limit", proc.InitialCommand, bolterror.Zombie).AddToPayload(result)
+		return result
+	}
+
+	child.Mutex.RLock()
+	mergePayloadSections(result, child.Payload, "data", "return_value", "error")
+	child.Mutex.RUnlock()
+	engine.LogInfo("subcall_out", logrus.Fields{"id": proc.ID, "subcallId": child.ID, "command": entry.Name, "call": entry.Call}, "")
+	return result
+}
+
+// waitForComplete waits until proc is complete, limit has passed if it's more than 0, or stop is closed. Returns
+// false if proc didn't complete.
+func waitForComplete(proc *commandprocess.CommandProcess, limit time.Duration, stop <-chan struct{}) bool {
+	var expired <-chan time.Time
+	if limit > 0 {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-proc.CompleteChannel:
+		return true
+	case <-expired:
+	case <-stop:
+	}
+	return false
+}
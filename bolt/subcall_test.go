@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"testing"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubCall(t *testing.T) {
+	seen := make(chan string, 1)
+	engine := callEngine(t, `{"apiCalls": {
+		"v1/cart": {"resultZombieMs": 2000, "commands": [
+			{"name": "cart/load", "configParams": {"from": "cart"}},
+			{"name": "cart/price", "call": "v1/price"}]},
+		"v1/price": {"commands": [{"name": "price/get", "configParams": {"from": "price"}}]}}}`,
+		map[string]stubWorker{
+			"cart/load": func(payload *gabs.Container) bool {
+				payload.SetP("c1", "data.cart")
+				payload.SetP(2, "return_value.items")
+				return true
+			},
+			"price/get": func(payload *gabs.Container) bool {
+				seen <- payload.String()
+				payload.SetP("usd", "data.currency")
+				payload.SetP(20, "return_value.total")
+				return true
+			},
+		})
+
+	proc := runCall(t, engine, "v1/cart", `{"sku": "1"}`)
+	sub, _ := gabs.ParseJSON([]byte(<-seen))
+	assert.Equal(t, "1", sub.Path("initial_input.sku").Data(), "Sub-call should get the initial input")
+	assert.False(t, sub.ExistsP("data.cart"), "Sub-call shouldn't see the parent's data")
+	assert.False(t, sub.ExistsP("return_value.items"), "Sub-call shouldn't see the parent's return_value")
+	assert.Equal(t, "price", sub.Path("params.from").Data(), "Sub-call should get its own params")
+	assert.NotEqual(t, proc.ID, sub.Path("id").Data(), "Sub-call should run as its own call")
+
+	assert.False(t, hasErrors(proc.Payload), "Call should succeed")
+	assert.Equal(t, "c1", proc.Payload.Path("data.cart").Data(), "Parent data should be kept")
+	assert.Equal(t, "usd", proc.Payload.Path("data.currency").Data(), "Sub-call data should be merged")
+	assert.EqualValues(t, 2, proc.Payload.Path("return_value.items").Data(), "Parent return_value should be kept")
+	assert.EqualValues(t, 20, proc.Payload.Path("return_value.total").Data(), "Sub-call return_value should be merged")
+}
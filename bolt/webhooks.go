@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/security"
+)
+
+// Headers of a callback post. The signature is the hex HMAC-SHA256 of "<timestamp>.<body>" with the call's group key.
+const (
+	CallbackURLHeader       = "Bolt-Callback-Url" //Request header giving a call's callback URL
+	CallbackIDHeader        = "Bolt-Request-Id"
+	CallbackTimestampHeader = "Bolt-Timestamp"
+	CallbackSignatureHeader = "Bolt-Signature"
+)
+
+// Allowed returns an error if rawurl isn't an http(s) URL on one of the allowed hosts
+func (wh WebhooksExt) Allowed(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("callback must be an http or https URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range wh.AllowHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("callback host %s isn't allowed", host)
+}
+
+// webhooks returns the engine's webhook settings
+func (engine *Engine) webhooks() WebhooksExt {
+	if engine.ConfigExt == nil {
+		return WebhooksExt{}
+	}
+	return engine.ConfigExt.Engine.Webhooks
+}
+
+// callbackURL returns the URL a call's result should be posted to, from the request header or the api call's
+// callback setting. Returns an error if it isn't allowed.
+func (engine *Engine) callbackURL(r *http.Request, apicall string) (string, error) {
+	callback := r.Header.Get(CallbackURLHeader)
+	if callback == "" {
+		callback = engine.ConfigExt.Call(apicall).Callback
+	}
+	if callback == "" {
+		return "", nil
+	}
+	return callback, engine.webhooks().Allowed(callback)
+}
+
+// signCallback returns the signature of a callback post
+func signCallback(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback waits for proc to complete, then posts its filtered result to proc.CallbackURL. Failed
+// deliveries are retried with a doubling backoff, up to the webhooks' maxAttempts. Every attempt is logged on
+// proc, so /retr/status shows how delivery went. Nothing is posted if proc doesn't complete in time, see
+// callbackWait, or there's no key to sign the result with.
+func (engine *Engine) deliverCallback(proc *commandprocess.CommandProcess) {
+	if !waitForComplete(proc, engine.callbackWait(proc), nil) {
+		engine.skipCallback(proc, "call didn't complete in time")
+		return
+	}
+
+	wh := engine.webhooks()
+	key, err := security.GetKeyFromGroup(proc.HMACGroup, &engine.Config.Security.Groups)
+	if err != nil {
+		engine.skipCallback(proc, "no key to sign the callback with: "+err.Error())
+		return
+	}
+
+	proc.Mutex.Lock()
+	proc.Payload.SetP(proc.Complete, "complete")
+	filterKeys := []string(nil)
+	if proc.APICall != nil {
+		filterKeys = proc.APICall.FilterKeys
+	}
+	body := []byte(engine.FormatRequest(proc, filterKeys))
+	proc.Mutex.Unlock()
+
+	client := &http.Client{
+		Timeout: wh.Timeout(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse //redirects could leave the allowed hosts
+		},
+	}
+	backoff := wh.Backoff()
+	for attempt := 1; attempt <= wh.Attempts(); attempt++ {
+		status, err := postCallback(client, proc.CallbackURL, proc.ID, key, body)
+		delivered := err == nil
+		logged := commandprocess.CallbackAttempt{Time: time.Now(), Status: status}
+		if err != nil {
+			logged.Error = err.Error()
+		}
+		proc.AddCallbackAttempt(logged, delivered)
+
+		fields := logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "url": proc.CallbackURL, "attempt": attempt, "status": status}
+		if delivered {
+			engine.LogInfo("callback_delivered", fields, "")
+			engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("callbacks_delivered").Incr()
+			break
+		}
+		fields["err"] = err
+		engine.LogWarn("callback_failed", fields, "Callback delivery failed")
+		if attempt == wh.Attempts() {
+			engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("callbacks_failed").Incr()
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	engine.saveRequest(proc)
+}
+
+// callbackWait returns how long deliverCallback waits on proc to complete. That's the call's zombie limit, or its
+// result timeout without one, plus the time retries of its commands can add. Calls without either limit are waited
+// on until they'd expire from the request store.
+func (engine *Engine) callbackWait(proc *commandprocess.CommandProcess) time.Duration {
+	var limit time.Duration
+	if proc.APICall != nil {
+		limit = proc.APICall.ResultZombie
+		if limit == 0 {
+			limit = proc.APICall.ResultTimeout
+		}
+	}
+	if limit == 0 {
+		storeExt := RequestStoreExt{}
+		if engine.ConfigExt != nil {
+			storeExt = engine.ConfigExt.Engine.RequestStore
+		}
+		return storeExt.Expiration()
+	}
+	for i, cmd := range proc.APICall.Commands {
+		retry := engine.ConfigExt.Command(proc.InitialCommand, i).Retry
+		for attempt := 1; attempt < retry.MaxAttempts; attempt++ {
+			limit += retry.Backoff(attempt) + cmd.ResultTimeout
+		}
+	}
+	return limit
+}
+
+// skipCallback logs a callback that won't be delivered on proc, so /retr/status shows why
+func (engine *Engine) skipCallback(proc *commandprocess.CommandProcess, reason string) {
+	proc.AddCallbackAttempt(commandprocess.CallbackAttempt{Time: time.Now(), Error: reason}, false)
+	engine.LogWarn("callback_skipped", logrus.Fields{"id": proc.ID, "command": proc.InitialCommand, "url": proc.CallbackURL, "group": proc.HMACGroup}, reason)
+	engine.Stats.Ch("calls").Ch(proc.InitialCommand).Ch("callbacks_failed").Incr()
+	engine.saveRequest(proc)
+}
+
+// postCallback posts body to callback once. Returns the status the callback answered with, and an error unless
+// it was a 2xx.
+func postCallback(client *http.Client, callback, id, key string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackIDHeader, id)
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	req.Header.Set(CallbackSignatureHeader, signCallback(key, timestamp, body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("callback answered %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
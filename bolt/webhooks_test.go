@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/boltshared/config"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooksAllowed(t *testing.T) {
+	wh := WebhooksExt{AllowHosts: []string{"hooks.example.com", ".internal.net"}}
+	assert.Nil(t, wh.Allowed("https://hooks.example.com/done"), "Listed hosts should be allowed")
+	assert.Nil(t, wh.Allowed("http://HOOKS.example.com:8080/done"), "Ports and case shouldn't matter")
+	assert.Nil(t, wh.Allowed("https://a.b.internal.net/done"), "Subdomains of dotted hosts should be allowed")
+	assert.NotNil(t, wh.Allowed("https://evil.com/hooks.example.com"), "Other hosts shouldn't be allowed")
+	assert.NotNil(t, wh.Allowed("https://internal.net.evil.com/"), "Suffixes must match the end of the host")
+	assert.NotNil(t, wh.Allowed("ftp://hooks.example.com/done"), "Only http(s) should be allowed")
+	assert.NotNil(t, WebhooksExt{}.Allowed("https://hooks.example.com/done"), "An empty allowlist allows nothing")
+}
+
+func TestSignCallback(t *testing.T) {
+	sig := signCallback("key", "1500000000", []byte(`{"a":1}`))
+	assert.Equal(t, 64, len(sig), "Should be hex sha256")
+	assert.Equal(t, sig, signCallback("key", "1500000000", []byte(`{"a":1}`)), "Should be stable")
+	assert.NotEqual(t, sig, signCallback("other", "1500000000", []byte(`{"a":1}`)), "Should depend on the key")
+	assert.NotEqual(t, sig, signCallback("key", "1500000001", []byte(`{"a":1}`)), "Should depend on the timestamp")
+}
+
+func TestDeliverCallback(t *testing.T) {
+	calls := 0
+	var body string
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		header = r.Header
+	}))
+	defer server.Close()
+
+	engine := memoryEngine()
+	engine.Config.Security.Groups = []config.SecurityGroups{{Name: "group", Hmackey: "key"}}
+	engine.ConfigExt, _ = ParseConfigExt([]byte(`{"engine": {"webhooks": {"backoffMs": 1, "maxAttempts": 3}}}`))
+	payload, _ := gabs.ParseJSON([]byte(`{"return_value": {"a": 1}}`))
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, payload, "group", "")
+	proc.CallbackURL = server.URL
+	proc.SetComplete()
+
+	engine.deliverCallback(proc)
+	assert.Equal(t, 2, calls, "Should retry after a failure")
+	assert.Equal(t, 2, len(proc.CallbackAttempts), "Should log every attempt")
+	assert.Equal(t, http.StatusInternalServerError, proc.CallbackAttempts[0].Status, "Should log the failed status")
+	assert.NotEmpty(t, proc.CallbackAttempts[0].Error, "Should log the failure")
+	assert.True(t, proc.CallbackDelivered, "Should be delivered")
+	assert.Contains(t, body, `"complete":true`, "Should post the result")
+	assert.Equal(t, "abc", header.Get(CallbackIDHeader), "Should send the request id")
+	assert.Equal(t, signCallback("key", header.Get(CallbackTimestampHeader), []byte(body)), header.Get(CallbackSignatureHeader), "Should sign the body")
+
+	server.Close()
+	proc = commandprocess.NewCommandProcessWithID("def", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, payload, "group", "")
+	proc.CallbackURL = server.URL
+	proc.SetComplete()
+	engine.deliverCallback(proc)
+	assert.Equal(t, 3, len(proc.CallbackAttempts), "Should give up after maxAttempts")
+	assert.False(t, proc.CallbackDelivered, "Shouldn't be delivered")
+
+	//no key to sign with
+	calls = 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	defer server.Close()
+	proc = commandprocess.NewCommandProcessWithID("ghi", commandprocess.CallTypeTask, "v1/test", &config.APICall{}, payload, "other", "")
+	proc.CallbackURL = server.URL
+	proc.SetComplete()
+	engine.deliverCallback(proc)
+	assert.Equal(t, 0, calls, "Shouldn't post without a key")
+	assert.Equal(t, 1, len(proc.CallbackAttempts), "Should log the skipped delivery")
+	assert.Contains(t, proc.CallbackAttempts[0].Error, "no key", "Should log why")
+
+	//never completes
+	proc = commandprocess.NewCommandProcessWithID("jkl", commandprocess.CallTypeTask, "v1/test", &config.APICall{ResultZombie: 10 * time.Millisecond}, payload, "group", "")
+	proc.CallbackURL = server.URL
+	engine.deliverCallback(proc)
+	assert.Equal(t, 0, calls, "Shouldn't post an incomplete call")
+	assert.Equal(t, 1, len(proc.CallbackAttempts), "Should log the skipped delivery")
+	assert.Contains(t, proc.CallbackAttempts[0].Error, "didn't complete", "Should log why")
+}
+
+func TestCallbackWait(t *testing.T) {
+	engine := memoryEngine()
+	engine.ConfigExt, _ = ParseConfigExt([]byte(`{"apiCalls": {"v1/test": {"commands": [
+		{"name": "product/get", "retry": {"maxAttempts": 3, "backoffMs": 100, "backoffMultiplier": 2}}]}}}`))
+	apicall := &config.APICall{ResultTimeout: time.Second, ResultZombie: 5 * time.Second, Commands: []config.CommandInfo{{Name: "product/get", ResultTimeout: time.Second}}}
+	assert.Nil(t, engine.ConfigExt.Prepare(&config.Config{APICalls: map[string]config.APICall{"v1/test": *apicall}}), "Settings should be valid")
+
+	proc := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", apicall, gabs.New(), "group", "")
+	assert.Equal(t, 5*time.Second+300*time.Millisecond+2*time.Second, engine.callbackWait(proc), "Should be the zombie limit plus the retries")
+	proc = commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/other", &config.APICall{ResultTimeout: time.Second}, gabs.New(), "group", "")
+	assert.Equal(t, time.Second, engine.callbackWait(proc), "Should use the result timeout without a zombie limit")
+	proc = commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/other", &config.APICall{}, gabs.New(), "group", "")
+	assert.Equal(t, RequestStoreExt{}.Expiration(), engine.callbackWait(proc), "Should wait until the request expires without limits")
+}
@@ -10,7 +10,6 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/TeamFairmont/boltshared/config"
-	"github.com/TeamFairmont/boltshared/mqwrapper"
 	"github.com/TeamFairmont/boltshared/utils"
 	"github.com/TeamFairmont/gabs"
 )
@@ -20,28 +19,33 @@ var count = 0
 func (engine *Engine) workerStub() {
 	engine.LogWarn("worker_stub", nil, "stubMode true, running a worker stub for all config'ed commands!")
 
-	mq, err := mqwrapper.ConnectMQ(engine.Config.Engine.MQUrl)
-	if err != nil {
-		engine.LogWarn("worker_stub", logrus.Fields{"err": err}, "Worker stub failed to connect to the MQ")
-	}
-
-	err = mq.Channel.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
-	if err != nil {
-		engine.LogWarn("worker_stub", logrus.Fields{"err": err}, "Worker stub QoS couldn't be set")
-	}
-
 	//make an all commands map to de-dupe if same command in multiple calls
 	allcommands := make(map[string]*config.CommandInfo)
-	for _, call := range engine.Config.APICalls {
+	addcommand := func(cmd *config.CommandInfo) {
+		meta, ok := engine.Config.CommandMetas[cmd.Name]
+		if !ok || !meta.NoStub { //skip those with no-stub
+			allcommands[cmd.Name] = cmd
+		}
+	}
+	for callName, call := range engine.Config.APICalls {
 		for j := range call.Commands {
-			meta, ok := engine.Config.CommandMetas[call.Commands[j].Name]
-			if !ok || !meta.NoStub { //skip those with no-stub
-				allcommands[call.Commands[j].Name] = &call.Commands[j]
+			cmdExt := engine.ConfigExt.Command(callName, j)
+			if cmdExt.Fallback != nil && cmdExt.Fallback.Command != nil {
+				addcommand(cmdExt.Fallback.Command)
+			}
+			if cmdExt.Compensate != nil {
+				addcommand(cmdExt.Compensate)
+			}
+			if cmdExt.Call != "" { //sub-calls are run by the engine, their commands are stubbed with their own call
+				continue
+			}
+			if len(cmdExt.Parallel) > 0 { //parallel groups are run by the engine, stub the group's commands instead
+				for b := range cmdExt.Parallel {
+					addcommand(&cmdExt.Parallel[b])
+				}
+				continue
 			}
+			addcommand(&call.Commands[j])
 		}
 	}
 
@@ -49,7 +53,7 @@ func (engine *Engine) workerStub() {
 	//spin up queues and goroutines for each command
 	count = 0
 	for k, cmd := range allcommands {
-		q, res, err := mqwrapper.CreateConsumeNamedQueue(engine.Config.Engine.Advanced.QueuePrefix+k, mq.Channel)
+		q, err := engine.broker.Consume(engine.Config.Engine.Advanced.QueuePrefix + k)
 		if err != nil {
 			engine.LogWarn("worker_stub", logrus.Fields{"command": k, "err": err}, "Worker stub failed to register queue")
 		} else {
@@ -60,16 +64,16 @@ func (engine *Engine) workerStub() {
 			go func(k string) {
 				currentIteration := utils.GetBoltIteration()
 				//waits here untill a worker stub is queried, then infinite loop
-				for d := range res {
+				for d := range q.Deliveries() {
 					keepAlive, err := utils.CheckBoltIteration(currentIteration)
 					if err != nil {
 						engine.LogError("worker_stub", logrus.Fields{"Error": err}, "Error with CheckBoltIteration(), in workerStub()")
 					}
-					engine.LogDebug("worker_stub", logrus.Fields{"command": q.Name, "id": d.CorrelationId, "payload": string(d.Body)}, "Command received")
+					engine.LogDebug("worker_stub", logrus.Fields{"command": q.Name(), "id": d.CorrelationID, "payload": string(d.Body)}, "Command received")
 
 					payload, err := gabs.ParseJSON(d.Body)
 					if err != nil {
-						engine.LogError("worker_stub", logrus.Fields{"command": q.Name, "id": d.CorrelationId, "payload": string(d.Body)}, "Payload malformed, not valid JSON")
+						engine.LogError("worker_stub", logrus.Fields{"command": q.Name(), "id": d.CorrelationID, "payload": string(d.Body)}, "Payload malformed, not valid JSON")
 					}
 					// Get the requiredParams from the desired command name "k" from the config
 					reqParams := engine.Config.CommandMetas[k].RequiredParams
@@ -140,13 +144,13 @@ func (engine *Engine) workerStub() {
 					}
 
 					//send reply back
-					err = mqwrapper.PublishCommand(mq.Channel, d.CorrelationId, "", d.ReplyTo, payload, "")
+					err = engine.publishReply(d.ReplyTo, d.CorrelationID, payload)
 					if err != nil {
 						engine.LogError("worker_stub", logrus.Fields{"command": command, "err": err}, "Worker stub failed to publish command result")
 					}
 					//ack to queue that this message is done
-					d.Ack(false)
-					engine.LogInfo("worker_stub", logrus.Fields{"command": q.Name, "id": d.CorrelationId}, "Command completed")
+					d.Ack()
+					engine.LogInfo("worker_stub", logrus.Fields{"command": q.Name(), "id": d.CorrelationID}, "Command completed")
 
 					//happens after reboot but only after a api call
 					if !keepAlive {
@@ -15,6 +15,7 @@ const (
 	Request         //An error related to an incoming/in-process API call
 	Timeout         //Call or command wasnt completed before the allocated timeout period
 	Zombie          //Last command wasn't completed before allocated 'zombie' give-up time. In a healthy system these shouldn't happen
+	Cancelled       //The caller cancelled the call before it completed
 )
 
 // BoltError is the wrapper for an error that needs to be communicated back to the API caller.
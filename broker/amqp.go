@@ -0,0 +1,357 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TeamFairmont/amqp"
+	"github.com/TeamFairmont/boltshared/mqwrapper"
+)
+
+// confirmTimeout is how long Publish waits on the broker to confirm a message
+const confirmTimeout = 5 * time.Second
+
+// ErrConfirmTimeout is returned by AMQP.Publish when the broker doesn't confirm a message in time
+var ErrConfirmTimeout = errors.New("broker: publish wasn't confirmed in time")
+
+// AMQP is a Broker connected to RabbitMQ through mqwrapper. The general channel is in confirm mode and messages
+// are published as mandatory, so Publish can tell when a message wasn't routed to a queue or was nacked.
+type AMQP struct {
+	conn *mqwrapper.Connection
+
+	publish   sync.Mutex //held while publishing, so delivery tags follow the order messages reach the channel
+	confirms  *confirmTracker
+	declare   sync.Mutex
+	exchanges map[string]bool //broadcast exchanges declared so far, guarded by declare
+}
+
+// DialAMQP connects to the AMQP broker at url and puts the general channel in confirm mode
+func DialAMQP(url string) (*AMQP, error) {
+	conn, err := mqwrapper.ConnectMQ(url)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Channel.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b := &AMQP{
+		conn:      conn,
+		confirms:  newConfirmTracker(),
+		exchanges: make(map[string]bool),
+	}
+	//unbuffered, so a message's return is always read before its confirm
+	go b.confirms.run(conn.Channel.NotifyPublish(make(chan amqp.Confirmation)), conn.Channel.NotifyReturn(make(chan amqp.Return)))
+	return b, nil
+}
+
+// Publish sends msg to queue through the default exchange and waits for the broker to confirm it. Returns
+// ErrUnroutable if queue doesn't exist, ErrNacked if the broker refused the message.
+func (b *AMQP) Publish(queue string, msg Message) error {
+	return b.publishConfirmed("", queue, true, msg)
+}
+
+// Broadcast sends msg to the fanout exchange, declaring it if needed, and waits for the broker to confirm it
+func (b *AMQP) Broadcast(exchange string, msg Message) error {
+	b.declare.Lock()
+	if !b.exchanges[exchange] {
+		err := declareFanout(b.conn.Channel, exchange)
+		if err != nil {
+			b.declare.Unlock()
+			return err
+		}
+		b.exchanges[exchange] = true
+	}
+	b.declare.Unlock()
+	return b.publishConfirmed(exchange, "", false, msg)
+}
+
+// publishConfirmed publishes msg and waits on its confirm. Only the publish itself is done one at a time, the
+// confirms of several messages are waited on together.
+func (b *AMQP) publishConfirmed(exchange, key string, mandatory bool, msg Message) error {
+	b.publish.Lock()
+	tag, confirmed := b.confirms.next()
+	err := b.conn.Channel.Publish(exchange, key, mandatory, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: msg.CorrelationID,
+		MessageId:     strconv.FormatUint(tag, 10), //ties a return to its publish, see confirmTracker.run
+		ReplyTo:       msg.ReplyTo,
+		Type:          msg.Type,
+		Expiration:    expiration(msg.Expiration),
+		Headers:       amqp.Table(msg.Headers),
+		Body:          msg.Body,
+	})
+	if err != nil {
+		b.confirms.unpublish(tag)
+	}
+	b.publish.Unlock()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(confirmTimeout)
+	defer timeout.Stop()
+	select {
+	case err = <-confirmed:
+		return err
+	case <-timeout.C:
+		b.confirms.forget(tag)
+		return ErrConfirmTimeout
+	}
+}
+
+// confirmTracker hands the broker's confirms and returns to the publishes waiting on them, by delivery tag. The
+// channel numbers messages from 1 in the order they're published.
+type confirmTracker struct {
+	mutex   sync.Mutex
+	tag     uint64 //delivery tag of the last message published
+	pending map[uint64]*pendingConfirm
+	closed  bool
+}
+
+// pendingConfirm is a published message waiting on its confirm
+type pendingConfirm struct {
+	returned bool
+	done     chan error //gets the outcome once, buffered so the tracker never waits on a publish
+}
+
+func newConfirmTracker() *confirmTracker {
+	return &confirmTracker{pending: make(map[uint64]*pendingConfirm)}
+}
+
+// next registers the message about to be published and returns its delivery tag, and the channel its outcome is
+// sent to. The caller must keep other publishes out until the message is published or unpublish is called.
+func (t *confirmTracker) next() (uint64, <-chan error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	p := &pendingConfirm{done: make(chan error, 1)}
+	t.tag++
+	if t.closed {
+		p.done <- ErrClosed
+	} else {
+		t.pending[t.tag] = p
+	}
+	return t.tag, p.done
+}
+
+// unpublish drops the last tag from next, its message couldn't be published
+func (t *confirmTracker) unpublish(tag uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pending, tag)
+	if tag == t.tag {
+		t.tag--
+	}
+}
+
+// forget stops waiting on tag, its confirm is dropped if it still comes
+func (t *confirmTracker) forget(tag uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pending, tag)
+}
+
+// run reads confirms and returns until confirms is closed with the channel, then fails the publishes still
+// waiting. A mandatory message that can't be routed is returned before it's acked.
+func (t *confirmTracker) run(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			tag, err := strconv.ParseUint(r.MessageId, 10, 64)
+			if err != nil {
+				continue
+			}
+			t.mutex.Lock()
+			if p := t.pending[tag]; p != nil {
+				p.returned = true
+			}
+			t.mutex.Unlock()
+
+		case c, ok := <-confirms:
+			if !ok {
+				t.close()
+				return
+			}
+			t.mutex.Lock()
+			p := t.pending[c.DeliveryTag]
+			delete(t.pending, c.DeliveryTag)
+			t.mutex.Unlock()
+			if p == nil { //timed out
+				continue
+			}
+			switch {
+			case p.returned:
+				p.done <- ErrUnroutable
+			case !c.Ack:
+				p.done <- ErrNacked
+			default:
+				p.done <- nil
+			}
+		}
+	}
+}
+
+// close fails every waiting publish, and any made after, with ErrClosed
+func (t *confirmTracker) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	for tag, p := range t.pending {
+		p.done <- ErrClosed
+		delete(t.pending, tag)
+	}
+}
+
+// TempQueue creates an exclusive, auto-deleted queue. It tries to use a channel just for the queue, if that
+// fails it falls back to the general channel.
+func (b *AMQP) TempQueue() (Queue, error) {
+	ch, own := b.channel()
+	q, res, err := mqwrapper.CreateConsumeTempQueue(ch)
+	if err != nil {
+		if own {
+			ch.Close()
+		}
+		return nil, err
+	}
+	return newAMQPQueue(q.Name, ch, own, res), nil
+}
+
+// Consume consumes a named queue on a channel of its own, so its prefetch doesn't affect other queues
+func (b *AMQP) Consume(queue string) (Queue, error) {
+	ch, own := b.channel()
+	q, res, err := mqwrapper.CreateConsumeNamedQueue(queue, ch)
+	if err != nil {
+		if own {
+			ch.Close()
+		}
+		return nil, err
+	}
+	return newAMQPQueue(q.Name, ch, own, res), nil
+}
+
+// Subscribe binds a temp queue to the fanout exchange, declaring it if needed
+func (b *AMQP) Subscribe(exchange string) (Queue, error) {
+	ch, own := b.channel()
+	err := declareFanout(ch, exchange)
+	if err != nil {
+		if own {
+			ch.Close()
+		}
+		return nil, err
+	}
+	q, res, err := mqwrapper.CreateConsumeTempQueue(ch)
+	if err == nil {
+		err = ch.QueueBind(q.Name, "", exchange, false, nil)
+	}
+	if err != nil {
+		if own {
+			ch.Close()
+		}
+		return nil, err
+	}
+	return newAMQPQueue(q.Name, ch, own, res), nil
+}
+
+// declareFanout declares a durable fanout exchange, so workers can bind to it before the engine first broadcasts
+func declareFanout(ch *amqp.Channel, exchange string) error {
+	return ch.ExchangeDeclare(exchange, "fanout", true, false, false, false, nil)
+}
+
+// NotifyClose receives the error the connection was closed with
+func (b *AMQP) NotifyClose() <-chan error {
+	closed := b.conn.Connection.NotifyClose(make(chan *amqp.Error, 1))
+	notify := make(chan error, 1)
+	go func() {
+		for ev := range closed {
+			if ev != nil {
+				notify <- fmt.Errorf("broker: connection closed, %d %s", ev.Code, ev.Reason)
+				break
+			}
+		}
+		close(notify)
+	}()
+	return notify
+}
+
+// Close closes the connection
+func (b *AMQP) Close() error {
+	return b.conn.Close()
+}
+
+// channel opens a channel with a prefetch of 1, or returns the general channel if it can't. own is false
+// for the general channel, which must not be closed with the queue.
+func (b *AMQP) channel() (ch *amqp.Channel, own bool) {
+	ch, err := b.conn.Connection.Channel()
+	if err != nil || ch == nil {
+		return b.conn.Channel, false
+	}
+	ch.Qos(1, 0, false)
+	return ch, true
+}
+
+// expiration formats a message ttl the way AMQP expects it, whole milliseconds as a string
+func expiration(ttl time.Duration) string {
+	if ttl <= 0 {
+		return ""
+	}
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+type amqpQueue struct {
+	name       string
+	ch         *amqp.Channel
+	own        bool
+	deliveries chan Message
+}
+
+func newAMQPQueue(name string, ch *amqp.Channel, own bool, res <-chan amqp.Delivery) *amqpQueue {
+	q := &amqpQueue{name: name, ch: ch, own: own, deliveries: make(chan Message)}
+	go func() {
+		for d := range res {
+			d := d
+			q.deliveries <- Message{
+				CorrelationID: d.CorrelationId,
+				ReplyTo:       d.ReplyTo,
+				Type:          d.Type,
+				Headers:       map[string]interface{}(d.Headers),
+				Body:          d.Body,
+				ack:           func() error { return d.Ack(false) },
+			}
+		}
+		close(q.deliveries)
+	}()
+	return q
+}
+
+func (q *amqpQueue) Name() string {
+	return q.name
+}
+
+func (q *amqpQueue) Deliveries() <-chan Message {
+	return q.deliveries
+}
+
+// Close closes the queue's channel, which deletes a temp queue. A queue on the general channel stays until the
+// connection closes, closing the channel would break every other queue on it.
+func (q *amqpQueue) Close() error {
+	if !q.own {
+		return nil
+	}
+	return q.ch.Close()
+}
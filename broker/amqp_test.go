@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func outcome(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting on a confirm")
+	}
+	return nil
+}
+
+func TestConfirmTracker(t *testing.T) {
+	tracker := newConfirmTracker()
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return)
+	go tracker.run(confirms, returns)
+
+	tag1, done1 := tracker.next()
+	tag2, done2 := tracker.next()
+	tag3, _ := tracker.next()
+	assert.Equal(t, []uint64{1, 2, 3}, []uint64{tag1, tag2, tag3}, "Tags should count from 1")
+
+	returns <- amqp.Return{MessageId: "2"}
+	confirms <- amqp.Confirmation{DeliveryTag: tag2, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: tag1, Ack: true}
+	assert.Equal(t, ErrUnroutable, outcome(t, done2), "Returned messages should be unroutable")
+	assert.Nil(t, outcome(t, done1), "Confirms can arrive in any order")
+
+	tracker.forget(tag3)
+	confirms <- amqp.Confirmation{DeliveryTag: tag3, Ack: true}
+	returns <- amqp.Return{MessageId: "3"}
+	returns <- amqp.Return{MessageId: "3"}
+	confirms <- amqp.Confirmation{DeliveryTag: tag3, Ack: true} //late confirms and returns must never block the reader
+
+	tag4, done4 := tracker.next()
+	confirms <- amqp.Confirmation{DeliveryTag: tag4, Ack: false}
+	assert.Equal(t, ErrNacked, outcome(t, done4), "Nacked messages should be refused")
+
+	tag5, _ := tracker.next()
+	tracker.unpublish(tag5)
+	tag6, done6 := tracker.next()
+	assert.Equal(t, tag5, tag6, "Unpublished tags should be reused")
+
+	close(confirms)
+	assert.Equal(t, ErrClosed, outcome(t, done6), "Waiting publishes should fail on close")
+	_, done7 := tracker.next()
+	assert.Equal(t, ErrClosed, outcome(t, done7), "Publishes after close should fail")
+}
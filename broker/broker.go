@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package broker abstracts the message broker the engine publishes commands to and receives worker replies
+// from. AMQP talks to RabbitMQ through mqwrapper, Memory runs entirely in process so the engine, the worker
+// stub and tests don't need a live broker.
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Broker kinds accepted by New
+const (
+	KindAMQP   = "amqp"   //RabbitMQ or another AMQP 0.9.1 broker, the default
+	KindMemory = "memory" //In process, only reachable from the same engine
+)
+
+// Publish errors every broker can return
+var (
+	ErrUnroutable = errors.New("broker: no queue to route the message to")
+	ErrNacked     = errors.New("broker: message refused")
+)
+
+// Message is a message published to, or delivered from, a queue
+type Message struct {
+	CorrelationID string                 //Ties a reply to the command it's for
+	ReplyTo       string                 //Queue the reply should be published to
+	Type          string                 //Kind of message, empty for commands and replies
+	Expiration    time.Duration          //Time the message may wait in the queue before it's dropped, 0 for no limit
+	Headers       map[string]interface{} //Extra fields carried with the message
+	Body          []byte
+
+	ack func() error
+}
+
+// Ack tells the broker a delivered message has been handled. Does nothing for brokers that don't track acks.
+func (m Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack()
+}
+
+// Queue is a queue being consumed
+type Queue interface {
+	Name() string
+	Deliveries() <-chan Message //Closed once the queue is closed or the broker connection is lost
+	Close() error               //Stops consuming, temp queues are deleted
+}
+
+// Broker publishes messages to queues and consumes them
+type Broker interface {
+	Publish(queue string, msg Message) error //Returns ErrUnroutable if queue doesn't exist
+	TempQueue() (Queue, error)               //Creates and consumes a queue only this broker connection can use, ie: for replies
+	Consume(queue string) (Queue, error)     //Consumes a named queue, creating it if needed
+
+	Broadcast(exchange string, msg Message) error //Sends msg to every queue subscribed to exchange, if any
+	Subscribe(exchange string) (Queue, error)     //Creates and consumes a temp queue that receives the exchange's broadcasts
+
+	NotifyClose() <-chan error //Receives an error if the connection is lost, closed without one on Close
+	Close() error
+}
+
+// New connects to a broker of the given kind. url is only used by AMQP.
+func New(kind, url string) (Broker, error) {
+	switch kind {
+	case "", KindAMQP:
+		return DialAMQP(url)
+	case KindMemory:
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("broker: unknown kind %q", kind)
+}
+
+// IsKind returns true if kind can be passed to New
+func IsKind(kind string) bool {
+	return kind == "" || kind == KindAMQP || kind == KindMemory
+}
@@ -0,0 +1,261 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package broker
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when using a broker after Close, and by publishes still waiting when a connection closes
+var ErrClosed = errors.New("broker: closed")
+
+// Memory is a Broker that only exists in process. Like a mandatory AMQP publish, a message published to a
+// queue nobody has consumed yet is refused with ErrUnroutable. Named queues are shared by all their consumers and stay until the
+// broker is closed, temp queues are deleted when closed.
+type Memory struct {
+	mutex       sync.Mutex
+	queues      map[string]*memoryQueue
+	subscribers map[string][]*memoryQueue //temp queues subscribed to each broadcast exchange
+	notify      []chan error
+	temps       int
+	closed      bool
+}
+
+// NewMemory creates an empty in process broker
+func NewMemory() *Memory {
+	return &Memory{queues: make(map[string]*memoryQueue), subscribers: make(map[string][]*memoryQueue)}
+}
+
+// Publish adds msg to the end of queue. It never blocks, queues grow as needed.
+func (b *Memory) Publish(queue string, msg Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return ErrUnroutable
+	}
+	if msg.Expiration > 0 {
+		msg.Headers = withExpiry(msg.Headers, time.Now().Add(msg.Expiration))
+	}
+	q.push(msg)
+	return nil
+}
+
+// TempQueue creates a queue with a generated name
+func (b *Memory) TempQueue() (Queue, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	return b.tempQueue(), nil
+}
+
+// tempQueue creates a temp queue, the mutex must be held
+func (b *Memory) tempQueue() *memoryQueue {
+	b.temps++
+	q := newMemoryQueue(b, "memory.gen-"+strconv.Itoa(b.temps), true)
+	b.queues[q.name] = q
+	return q
+}
+
+// Broadcast adds msg to every queue subscribed to exchange. Subscriptions whose queues were closed are dropped.
+func (b *Memory) Broadcast(exchange string, msg Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	subscribed := b.subscribers[exchange][:0]
+	for _, q := range b.subscribers[exchange] {
+		if b.queues[q.name] == q {
+			q.push(msg)
+			subscribed = append(subscribed, q)
+		}
+	}
+	b.subscribers[exchange] = subscribed
+	return nil
+}
+
+// Subscribe creates a temp queue that receives the exchange's broadcasts
+func (b *Memory) Subscribe(exchange string) (Queue, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	q := b.tempQueue()
+	b.subscribers[exchange] = append(b.subscribers[exchange], q)
+	return q, nil
+}
+
+// Consume returns the named queue, creating it if needed
+func (b *Memory) Consume(queue string) (Queue, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		q = newMemoryQueue(b, queue, false)
+		b.queues[queue] = q
+	}
+	return q, nil
+}
+
+// NotifyClose is closed when the broker is, a Memory broker can't lose its connection
+func (b *Memory) NotifyClose() <-chan error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	notify := make(chan error, 1)
+	if b.closed {
+		close(notify)
+	} else {
+		b.notify = append(b.notify, notify)
+	}
+	return notify
+}
+
+// Close drops all queues and closes their delivery channels
+func (b *Memory) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for name, q := range b.queues {
+		q.stop()
+		delete(b.queues, name)
+	}
+	for _, notify := range b.notify {
+		close(notify)
+	}
+	b.notify = nil
+	return nil
+}
+
+// expiryHeader carries a message's expiry time through a Memory queue
+const expiryHeader = "x-memory-expires"
+
+func withExpiry(headers map[string]interface{}, at time.Time) map[string]interface{} {
+	copied := make(map[string]interface{}, len(headers)+1)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	copied[expiryHeader] = at
+	return copied
+}
+
+type memoryQueue struct {
+	broker     *Memory
+	name       string
+	temp       bool
+	cond       *sync.Cond
+	pending    []Message
+	stopped    bool
+	done       chan struct{}
+	deliveries chan Message
+}
+
+func newMemoryQueue(b *Memory, name string, temp bool) *memoryQueue {
+	q := &memoryQueue{
+		broker:     b,
+		name:       name,
+		temp:       temp,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		done:       make(chan struct{}),
+		deliveries: make(chan Message),
+	}
+	go q.deliver()
+	return q
+}
+
+func (q *memoryQueue) Name() string {
+	return q.name
+}
+
+func (q *memoryQueue) Deliveries() <-chan Message {
+	return q.deliveries
+}
+
+// Close deletes a temp queue. Named queues are shared, so they stay until the broker is closed.
+func (q *memoryQueue) Close() error {
+	if !q.temp {
+		return nil
+	}
+	q.broker.mutex.Lock()
+	defer q.broker.mutex.Unlock()
+	if q.broker.queues[q.name] == q {
+		delete(q.broker.queues, q.name)
+	}
+	q.stop()
+	return nil
+}
+
+func (q *memoryQueue) push(msg Message) {
+	q.cond.L.Lock()
+	q.pending = append(q.pending, msg)
+	q.cond.L.Unlock()
+	q.cond.Signal()
+}
+
+func (q *memoryQueue) stop() {
+	q.cond.L.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.done)
+	}
+	q.cond.L.Unlock()
+	q.cond.Signal()
+}
+
+// deliver hands pending messages to consumers in order, skipping expired ones, until the queue is stopped
+func (q *memoryQueue) deliver() {
+	for {
+		q.cond.L.Lock()
+		for len(q.pending) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.pending = nil
+			q.cond.L.Unlock()
+			close(q.deliveries)
+			return
+		}
+		msg := q.pending[0]
+		q.pending = q.pending[1:]
+		q.cond.L.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if at, ok := msg.Headers[expiryHeader].(time.Time); ok {
+			ttl := at.Sub(time.Now())
+			if ttl <= 0 {
+				continue
+			}
+			delete(msg.Headers, expiryHeader)
+			timer = time.NewTimer(ttl)
+			expired = timer.C
+		}
+		select {
+		case q.deliveries <- msg:
+		case <-expired:
+		case <-q.done:
+			close(q.deliveries)
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
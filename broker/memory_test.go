@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, q Queue) (Message, bool) {
+	select {
+	case msg, ok := <-q.Deliveries():
+		return msg, ok
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting on " + q.Name())
+	}
+	return Message{}, false
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+
+	worker, err := b.Consume("cmd/echo")
+	assert.Nil(t, err, "Consume should work")
+	replies, err := b.TempQueue()
+	assert.Nil(t, err, "TempQueue should work")
+
+	assert.Nil(t, b.Publish("cmd/echo", Message{CorrelationID: "1", ReplyTo: replies.Name(), Body: []byte(`{"a":1}`)}), "Publish should work")
+	assert.Nil(t, b.Publish("cmd/echo", Message{CorrelationID: "2", ReplyTo: replies.Name()}), "Publish should work")
+
+	first, _ := receive(t, worker)
+	second, _ := receive(t, worker)
+	assert.Equal(t, "1", first.CorrelationID, "Messages should arrive in order")
+	assert.Equal(t, `{"a":1}`, string(first.Body), "Body should be delivered")
+	assert.Equal(t, "2", second.CorrelationID, "Messages should arrive in order")
+	assert.Nil(t, first.Ack(), "Ack should be a no-op")
+
+	assert.Nil(t, b.Publish(first.ReplyTo, Message{CorrelationID: first.CorrelationID}), "Reply should publish")
+	reply, _ := receive(t, replies)
+	assert.Equal(t, "1", reply.CorrelationID, "Reply should reach the temp queue")
+}
+
+func TestMemoryUnconsumedQueue(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+
+	assert.Equal(t, ErrUnroutable, b.Publish("nobody", Message{CorrelationID: "lost"}), "Publishing to an unknown queue should be refused")
+	q, _ := b.Consume("nobody")
+	assert.Nil(t, b.Publish("nobody", Message{CorrelationID: "kept"}), "Publish should work")
+	msg, _ := receive(t, q)
+	assert.Equal(t, "kept", msg.CorrelationID, "Only messages published after the queue exists should arrive")
+}
+
+func TestMemoryExpiration(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+
+	q, _ := b.Consume("slow")
+	b.Publish("slow", Message{CorrelationID: "old", Expiration: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	b.Publish("slow", Message{CorrelationID: "new", Expiration: time.Minute})
+
+	msg, _ := receive(t, q)
+	assert.Equal(t, "new", msg.CorrelationID, "Expired messages should be dropped")
+	assert.Nil(t, msg.Headers[expiryHeader], "Expiry bookkeeping shouldn't leak into headers")
+}
+
+func TestMemoryClose(t *testing.T) {
+	b := NewMemory()
+	notify := b.NotifyClose()
+
+	temp, _ := b.TempQueue()
+	assert.Nil(t, temp.Close(), "Closing a temp queue should work")
+	_, ok := receive(t, temp)
+	assert.False(t, ok, "Closed temp queue deliveries should be closed")
+	assert.Equal(t, ErrUnroutable, b.Publish(temp.Name(), Message{}), "Closed temp queues should be deleted")
+
+	named, _ := b.Consume("named")
+	assert.Nil(t, b.Close(), "Close should work")
+	_, ok = receive(t, named)
+	assert.False(t, ok, "Named queues should close with the broker")
+
+	_, ok = <-notify
+	assert.False(t, ok, "NotifyClose should close without an error")
+	assert.Equal(t, ErrClosed, b.Publish("named", Message{}), "Publish after close should error")
+}
+
+func TestNew(t *testing.T) {
+	b, err := New(KindMemory, "")
+	assert.Nil(t, err, "Memory broker should be created")
+	assert.Nil(t, b.Close(), "Close should work")
+
+	_, err = New("kafka", "")
+	assert.NotNil(t, err, "Unknown kinds should error")
+	assert.True(t, IsKind(""), "Empty kind should default to amqp")
+	assert.False(t, IsKind("kafka"), "Unknown kinds should be rejected")
+}
+
+func TestMemoryBroadcast(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+
+	assert.Nil(t, b.Broadcast("cancel", Message{CorrelationID: "nobody"}), "Broadcasting without subscribers should work")
+	first, _ := b.Subscribe("cancel")
+	second, _ := b.Subscribe("cancel")
+	other, _ := b.Subscribe("other")
+
+	assert.Nil(t, b.Broadcast("cancel", Message{CorrelationID: "abc"}), "Broadcast should work")
+	msg, _ := receive(t, first)
+	assert.Equal(t, "abc", msg.CorrelationID, "Every subscriber should get the broadcast")
+	msg, _ = receive(t, second)
+	assert.Equal(t, "abc", msg.CorrelationID, "Every subscriber should get the broadcast")
+
+	second.Close()
+	assert.Nil(t, b.Broadcast("cancel", Message{CorrelationID: "def"}), "Broadcast should work")
+	msg, _ = receive(t, first)
+	assert.Equal(t, "def", msg.CorrelationID, "Closed subscribers shouldn't stop the broadcast")
+
+	select {
+	case <-other.Deliveries():
+		t.Fatal("Other exchanges shouldn't get the broadcast")
+	default:
+	}
+}
@@ -37,6 +37,22 @@ const EmptyPayload = `{
 	"params":{}
 }`
 
+// Progress is what a worker last reported about a command it's still working on
+type Progress struct {
+	Command string      `json:"command"`
+	Percent float64     `json:"percent"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"` //Partial results
+	Time    time.Time   `json:"time"`
+}
+
+// CallbackAttempt is one attempt at posting a call's result to its callback URL
+type CallbackAttempt struct {
+	Time   time.Time `json:"time"`
+	Status int       `json:"status"`          //HTTP status the callback answered with, 0 if there was no answer
+	Error  string    `json:"error,omitempty"` //Why the attempt failed
+}
+
 // CommandProcess stores in-process API call information
 type CommandProcess struct {
 	ID                 string          `json:"id"`      //UUID for this request
@@ -50,9 +66,15 @@ type CommandProcess struct {
 	ReqTime            time.Time       `json:"reqTime"`   //The timestamp this request was first created
 	PeekTime           time.Time       `json:"peekTime"`  //PeekTime is updated whenever a client requests a peek into this calls status. It is used in the algo to detect hung calls
 	PeekCount          int             `json:"peekCount"` //PeekCount is number of times the call has been Peek'ed
+	Responded          bool            `json:"responded"` //True once a request call answered its caller before completing, its result is left for /retr
+
+	Complete        bool      `json:"complete"`     //True if all commands have completed.
+	CompleteTime    time.Time `json:"completeTime"` //Timestamp of when 'completed' was set true
+	CompleteChannel chan bool `json:"-"`            //Closed by the first SetComplete
 
-	Complete     bool      `json:"complete"`     //True if all commands have completed.
-	CompleteTime time.Time `json:"completeTime"` //Timestamp of when 'completed' was set true
+	Cancelled     bool      `json:"cancelled"`  //True once Cancel is called, the call stops at its next step
+	CancelTime    time.Time `json:"cancelTime"` //Timestamp of when 'cancelled' was set true
+	CancelChannel chan bool `json:"-"`          //Closed by Cancel
 
 	CommandTime         time.Time           `json:"lastCommandTime"` //The timestamp of the last command entered into MQ
 	LastPrimaryCommand  string              `json:"lastCommand"`     //The config-based subcommand called (doesnt update for 'nextCommand' overrides)
@@ -60,10 +82,26 @@ type CommandProcess struct {
 	CurrentCommandIndex int                 `json:"-"`               //Array index of current command
 	NextCommand         string              `json:"nextCommand"`     //If this is set by a worker in the payload, this command will be executed before executing the next config-based command
 
+	PendingCommand string    `json:"pendingCommand"` //The command last entered into MQ, whose reply is being waited on
+	CommandAttempt int       `json:"commandAttempt"` //Attempt number of PendingCommand, more than 1 if it has been retried
+	CorrelationID  string    `json:"-"`              //Correlation id PendingCommand was published with. Replies with any other id are stale
+	Fallback       bool      `json:"fallback"`       //True while PendingCommand is the fallback of the current config-based command
+	RetryTime      time.Time `json:"-"`              //When the retry of PendingCommand is published, zero unless a retry is waiting out its backoff
+
+	CompletedCommands []int     `json:"completedCommands"`  //Indexes of config-based commands that replied without a new error, in order
+	Progress          *Progress `json:"progress,omitempty"` //Latest progress reported by a worker
+
+	CallbackURL       string            `json:"callbackUrl,omitempty"` //URL the result is posted to once the call completes
+	CallbackAttempts  []CallbackAttempt `json:"callbackAttempts"`      //Delivery log of the result to CallbackURL
+	CallbackDelivered bool              `json:"callbackDelivered"`     //True once CallbackURL accepted the result
+
 	TimeoutChannel chan bool `json:"-"` //When StartTimeout() is called, this is set to the timeout channel
 	TimeoutStarted bool      `json:"-"` //When StartTimeout() is called, this is set to true
 
 	Mutex sync.RWMutex `json:"-"`
+
+	eventMutex  sync.Mutex   //guards subscribers, separate from Mutex so events can be sent with it held
+	subscribers []chan Event //see Subscribe
 }
 
 // NewCommandProcessWithID creates a command process instance, sets defaults, etc, and allows the caller to specify the uuid
@@ -78,6 +116,8 @@ func NewCommandProcessWithID(id string, calltype int, cmd string, apicall *confi
 	cp.HMACGroup = hmacgroup
 	cp.HMACToken = hmactoken
 	cp.PeekTime = cp.ReqTime
+	cp.CancelChannel = make(chan bool)
+	cp.CompleteChannel = make(chan bool)
 
 	return &cp
 }
@@ -116,16 +156,75 @@ func (cp *CommandProcess) UpdatePeekTime() {
 	cp.PeekCount++
 }
 
-// SetComplete sets the Complete flag to true, CompleteTime
+// SetComplete sets the Complete flag to true, CompleteTime, and closes CompleteChannel the first time it's called.
+// The channel is closed last, so whoever it wakes sees both fields set.
 func (cp *CommandProcess) SetComplete() {
 	cp.Mutex.Lock()
 	defer cp.Mutex.Unlock()
+	first := !cp.Complete
 	cp.Complete = true
 	cp.CompleteTime = time.Now()
+	if first && cp.CompleteChannel != nil {
+		close(cp.CompleteChannel)
+	}
+}
+
+// Cancel sets the Cancelled flag and CancelTime, and closes CancelChannel so processing stops at its next step.
+// Returns false if the process was already complete or cancelled.
+func (cp *CommandProcess) Cancel() bool {
+	cp.Mutex.Lock()
+	defer cp.Mutex.Unlock()
+	if cp.Complete || cp.Cancelled {
+		return false
+	}
+	cp.Cancelled = true
+	cp.CancelTime = time.Now()
+	if cp.CancelChannel != nil {
+		close(cp.CancelChannel)
+	}
+	return true
+}
+
+// AddCallbackAttempt logs an attempt at delivering the result to CallbackURL, setting CallbackDelivered if it
+// succeeded
+func (cp *CommandProcess) AddCallbackAttempt(attempt CallbackAttempt, delivered bool) {
+	cp.Mutex.Lock()
+	defer cp.Mutex.Unlock()
+	cp.CallbackAttempts = append(cp.CallbackAttempts, attempt)
+	cp.CallbackDelivered = cp.CallbackDelivered || delivered
+}
+
+// SetProgress keeps progress as the latest reported by a worker and sends it to subscribers
+func (cp *CommandProcess) SetProgress(progress Progress) {
+	cp.Mutex.Lock()
+	defer cp.Mutex.Unlock()
+	cp.Progress = &progress
+	cp.Notify(EventProgress, progress.Command, progress)
+}
+
+// IsCancelled returns true once Cancel has been called
+func (cp *CommandProcess) IsCancelled() bool {
+	cp.Mutex.RLock()
+	defer cp.Mutex.RUnlock()
+	return cp.Cancelled
 }
 
 // AddTraceEntry copies a snapshot of relevant Payload fields into the Payload's trace array
 func (cp *CommandProcess) AddTraceEntry() {
+	name := ""
+	if cp.CurrentCommand != nil {
+		name = cp.CurrentCommand.Name
+	}
+	cp.AddCommandTraceEntry(name)
+}
+
+// AddCommandTraceEntry is AddTraceEntry for a command other than CurrentCommand, such as a branch of a parallel group
+func (cp *CommandProcess) AddCommandTraceEntry(command string) {
+	cp.AddTraceEntryWith(command, nil)
+}
+
+// AddTraceEntryWith is AddCommandTraceEntry with extra fields set on the entry, such as a compensation's outcome
+func (cp *CommandProcess) AddTraceEntryWith(command string, fields map[string]interface{}) {
 	cp.Mutex.Lock()
 	defer cp.Mutex.Unlock()
 
@@ -134,10 +233,22 @@ func (cp *CommandProcess) AddTraceEntry() {
 	trace.SetP(cp.Payload.Path("data").Data(), "data")
 	trace.SetP(cp.Payload.Path("config").Data(), "config")
 	trace.SetP(cp.Payload.Path("params").Data(), "params")
-	if cp.CurrentCommand != nil {
-		trace.SetP(cp.CurrentCommand.Name, "command")
+	if command != "" {
+		trace.SetP(command, "command")
 	}
 	trace.SetP(cp.CurrentCommandIndex, "commandIndex")
+	if cp.CommandAttempt > 1 {
+		trace.SetP(cp.CommandAttempt, "attempt")
+	}
 	trace.SetP(time.Now(), "timestamp")
+	for k, v := range fields {
+		trace.Set(v, k)
+	}
 	cp.Payload.ArrayAppendP(trace.Data(), "trace")
+
+	//the entry shares its sections with the live payload, subscribers get a copy they can read without the mutex
+	event, err := gabs.ParseJSON(trace.Bytes())
+	if err == nil {
+		cp.Notify(EventTrace, command, event.Data())
+	}
 }
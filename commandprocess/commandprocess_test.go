@@ -57,6 +57,62 @@ func TestSetComplete(t *testing.T) {
 	}, "Complete time should be greater than or equal to test start time")
 }
 
+func TestCancel(t *testing.T) {
+	cp := NewCommandProcess(CallTypeTask, "cmd", nil, nil, "group", "token")
+	assert.False(t, cp.IsCancelled(), "New process shouldn't be cancelled")
+	assert.True(t, cp.Cancel(), "Cancel should succeed")
+	assert.True(t, cp.IsCancelled(), "Cancelled should be true")
+	assert.False(t, cp.CancelTime.IsZero(), "Cancel time should be set")
+
+	_, open := <-cp.CancelChannel
+	assert.False(t, open, "Cancel channel should be closed")
+	assert.False(t, cp.Cancel(), "Cancelling twice should fail")
+
+	cp = NewCommandProcess(CallTypeTask, "cmd", nil, nil, "group", "token")
+	cp.SetComplete()
+	assert.False(t, cp.Cancel(), "Complete processes can't be cancelled")
+}
+
+func TestCompleteChannel(t *testing.T) {
+	cp := NewCommandProcess(CallTypeTask, "cmd", nil, nil, "group", "token")
+	select {
+	case <-cp.CompleteChannel:
+		t.Fatal("Complete channel shouldn't be closed yet")
+	default:
+	}
+	cp.SetComplete()
+	cp.SetComplete()
+	_, open := <-cp.CompleteChannel
+	assert.False(t, open, "Complete channel should be closed")
+	assert.True(t, cp.Complete, "Complete should be true")
+}
+
+func TestSubscribe(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(EmptyPayload))
+	cp := NewCommandProcess(CallTypeTask, "cmd", nil, payload, "group", "token")
+	cp.Notify(EventCommand, "nobody", nil) //no subscribers yet
+
+	events, unsubscribe := cp.Subscribe()
+	cp.Notify(EventCommand, "first", nil)
+	cp.AddCommandTraceEntry("first")
+	ev := <-events
+	assert.Equal(t, EventCommand, ev.Type, "Should get the command event")
+	assert.Equal(t, "first", ev.Command, "Should get the command")
+	ev = <-events
+	assert.Equal(t, EventTrace, ev.Type, "Trace entries should send an event")
+
+	for i := 0; i < eventBuffer*2; i++ {
+		cp.Notify(EventReply, "flood", nil) //full subscribers shouldn't block
+	}
+	unsubscribe()
+	cp.Notify(EventReply, "after", nil)
+	count := 0
+	for range events {
+		count++
+	}
+	assert.Equal(t, eventBuffer, count, "Extra events should be dropped and the channel closed")
+}
+
 func TestAddTraceEntry(t *testing.T) {
 	payload, _ := gabs.ParseJSON([]byte(EmptyPayload))
 	cp := NewCommandProcess(CallTypeTask, "cmd", nil, payload, "group", "token")
@@ -65,3 +121,39 @@ func TestAddTraceEntry(t *testing.T) {
 	count, _ := cp.Payload.ArrayCount("trace")
 	assert.Exactly(t, 2, count, "Should be two trace entries")
 }
+
+func TestAddTraceEntryAttempt(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(EmptyPayload))
+	cp := NewCommandProcess(CallTypeTask, "cmd", nil, payload, "group", "token")
+	cp.CommandAttempt = 1
+	cp.AddTraceEntry()
+	cp.CommandAttempt = 2
+	cp.AddTraceEntry()
+	trace, _ := cp.Payload.S("trace").Children()
+	assert.Nil(t, trace[0].Path("attempt").Data(), "First attempt shouldn't be marked")
+	assert.EqualValues(t, 2, trace[1].Path("attempt").Data(), "Retry should be marked with its attempt")
+}
+
+func TestAddTraceEntryWith(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(EmptyPayload))
+	cp := NewCommandProcess(CallTypeTask, "cmd", nil, payload, "group", "token")
+	cp.AddTraceEntryWith("undo", map[string]interface{}{"outcome": "ok"})
+	trace, _ := cp.Payload.S("trace").Children()
+	assert.Equal(t, "undo", trace[0].Path("command").Data(), "Should name the command")
+	assert.Equal(t, "ok", trace[0].Path("outcome").Data(), "Should include the extra fields")
+}
+
+func TestAddTraceEntryEvent(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(EmptyPayload))
+	cp := NewCommandProcess(CallTypeTask, "cmd", nil, payload, "group", "token")
+	events, unsubscribe := cp.Subscribe()
+	defer unsubscribe()
+	cp.Payload.SetP("before", "data.name")
+	cp.AddCommandTraceEntry("cmd")
+	cp.Payload.SetP("after", "data.name")
+
+	ev := <-events
+	entry, _ := ev.Data.(map[string]interface{})
+	data, _ := entry["data"].(map[string]interface{})
+	assert.Equal(t, "before", data["name"], "Event should hold a copy, not the live payload")
+}
@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commandprocess
+
+import "time"
+
+// Event types sent to a process's subscribers
+const (
+	EventCommand  = "command"  //A command was published, Data has the correlation id and attempt
+	EventReply    = "reply"    //The pending command replied
+	EventTrace    = "trace"    //A trace entry was added, Data is the entry
+	EventTimeout  = "timeout"  //The call or a command timed out, processing continues in the background
+	EventProgress = "progress" //A worker reported progress, Data is the Progress
+)
+
+// eventBuffer is how many events a subscriber holds before it reads them, extra events are dropped
+const eventBuffer = 32
+
+// Event is a step in processing a call, see Subscribe
+type Event struct {
+	Type    string      `json:"type"`
+	Command string      `json:"command,omitempty"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Subscribe returns a channel receiving the process's events as they happen, and a func that unsubscribes and
+// closes it. Events are dropped rather than holding up processing if the subscriber falls behind. Completion
+// isn't an event, wait on CompleteChannel for it.
+func (cp *CommandProcess) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	cp.eventMutex.Lock()
+	cp.subscribers = append(cp.subscribers, events)
+	cp.eventMutex.Unlock()
+
+	unsubscribe := func() {
+		cp.eventMutex.Lock()
+		defer cp.eventMutex.Unlock()
+		for i, sub := range cp.subscribers {
+			if sub == events {
+				cp.subscribers = append(cp.subscribers[:i], cp.subscribers[i+1:]...)
+				close(events)
+				return
+			}
+		}
+	}
+	return events, unsubscribe
+}
+
+// Notify sends an event to the process's subscribers. It doesn't use the process's Mutex, so it can be called
+// with it held.
+func (cp *CommandProcess) Notify(eventType, command string, data interface{}) {
+	cp.eventMutex.Lock()
+	defer cp.eventMutex.Unlock()
+	if len(cp.subscribers) == 0 {
+		return
+	}
+	ev := Event{Type: eventType, Command: command, Time: time.Now(), Data: data}
+	for _, sub := range cp.subscribers {
+		select {
+		case sub <- ev:
+		default:
+		}
+	}
+}
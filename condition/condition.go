@@ -0,0 +1,467 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package condition parses and evaluates the boolean expressions used to decide whether a command
+// runs, against the current payload of an API call.
+//
+// Expressions look like:
+//
+//	data.stock > 0 && initial_input.showReviews == true
+//	!exists(return_value.price) || return_value.price.currency != "usd"
+//
+// Paths must start with initial_input, data or return_value. Supported operators are
+// == != < <= > >= && || ! and parentheses. Literals can be numbers, "strings", true, false and null.
+package condition
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/TeamFairmont/gabs"
+)
+
+// Roots are the payload sections an expression path may start with
+var Roots = []string{"initial_input", "data", "return_value"}
+
+// Expr is a parsed condition expression, safe to evaluate from multiple goroutines
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses an expression, returning an error describing the first problem found
+func Parse(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("condition: unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression against payload. Missing paths evaluate to null, and comparisons
+// between mismatched types are false.
+func (e *Expr) Eval(payload *gabs.Container) bool {
+	return truthy(e.root.eval(payload))
+}
+
+//*************************
+// evaluation
+//*************************
+
+type node interface {
+	eval(payload *gabs.Container) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(payload *gabs.Container) interface{} {
+	return n.value
+}
+
+type pathNode struct {
+	path []string
+}
+
+func (n pathNode) eval(payload *gabs.Container) interface{} {
+	if payload == nil {
+		return nil
+	}
+	return Lookup(payload.Data(), n.path)
+}
+
+type existsNode struct {
+	path pathNode
+}
+
+func (n existsNode) eval(payload *gabs.Container) interface{} {
+	return n.path.eval(payload) != nil
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(payload *gabs.Container) interface{} {
+	return !truthy(n.operand.eval(payload))
+}
+
+type logicNode struct {
+	op          string
+	left, right node
+}
+
+func (n logicNode) eval(payload *gabs.Container) interface{} {
+	left := truthy(n.left.eval(payload))
+	if n.op == "&&" {
+		return left && truthy(n.right.eval(payload))
+	}
+	return left || truthy(n.right.eval(payload))
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n compareNode) eval(payload *gabs.Container) interface{} {
+	left := n.left.eval(payload)
+	right := n.right.eval(payload)
+
+	switch n.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	if lf, ok := left.(float64); ok {
+		if rf, ok := right.(float64); ok {
+			switch n.op {
+			case "<":
+				return lf < rf
+			case "<=":
+				return lf <= rf
+			case ">":
+				return lf > rf
+			case ">=":
+				return lf >= rf
+			}
+		}
+	}
+	if ls, ok := left.(string); ok {
+		if rs, ok := right.(string); ok {
+			switch n.op {
+			case "<":
+				return ls < rs
+			case "<=":
+				return ls <= rs
+			case ">":
+				return ls > rs
+			case ">=":
+				return ls >= rs
+			}
+		}
+	}
+	return false
+}
+
+// Lookup walks a decoded JSON value by object key or array index, returning nil if nothing is at path
+func Lookup(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// equal compares two decoded JSON values, treating all numbers as float64
+func equal(left, right interface{}) bool {
+	return reflect.DeepEqual(normalize(left), normalize(right))
+}
+
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+// truthy follows the usual scripting rules: null, false, 0, "" and empty arrays/objects are false
+func truthy(value interface{}) bool {
+	switch v := normalize(value).(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+//*************************
+// parsing
+//*************************
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{"||", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{"&&", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek().kind == tokOp && p.peek().text == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokOp {
+		switch t.text {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			return compareNode{t.text, left, right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseValue() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("condition: bad number %q at position %d", t.text, t.pos)
+		}
+		return literalNode{f}, nil
+
+	case tokString:
+		return literalNode{t.text}, nil
+
+	case tokLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, fmt.Errorf("condition: missing ) for ( at position %d", t.pos)
+		}
+		return inner, nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		case "exists":
+			if p.next().kind != tokLParen {
+				return nil, fmt.Errorf("condition: exists must be followed by ( at position %d", t.pos)
+			}
+			pt := p.next()
+			if pt.kind != tokIdent {
+				return nil, fmt.Errorf("condition: exists needs a payload path at position %d", pt.pos)
+			}
+			path, err := parsePath(pt)
+			if err != nil {
+				return nil, err
+			}
+			if p.next().kind != tokRParen {
+				return nil, fmt.Errorf("condition: missing ) for exists at position %d", t.pos)
+			}
+			return existsNode{path}, nil
+		}
+		return parsePath(t)
+
+	case tokEOF:
+		return nil, errors.New("condition: unexpected end of expression")
+	}
+	return nil, fmt.Errorf("condition: unexpected %q at position %d", t.text, t.pos)
+}
+
+// parsePath checks a dotted path token starts at one of the allowed Roots
+func parsePath(t token) (pathNode, error) {
+	path := strings.Split(t.text, ".")
+	for _, part := range path {
+		if part == "" {
+			return pathNode{}, fmt.Errorf("condition: bad path %q at position %d", t.text, t.pos)
+		}
+	}
+	for _, root := range Roots {
+		if path[0] == root {
+			return pathNode{path}, nil
+		}
+	}
+	return pathNode{}, fmt.Errorf("condition: path %q at position %d must start with one of %s", t.text, t.pos, strings.Join(Roots, ", "))
+}
+
+//*************************
+// lexing
+//*************************
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func lex(src string) ([]token, error) {
+	toks := []token{}
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("condition: unterminated string at position %d", start)
+			}
+			i++
+			toks = append(toks, token{tokString, sb.String(), start})
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E') {
+				i++
+			}
+			toks = append(toks, token{tokNumber, src[start:i], start})
+
+		case isIdentChar(c):
+			start := i
+			for i < len(src) && (isIdentChar(src[i]) || src[i] == '.' || src[i] == '-' || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i], start})
+
+		default:
+			start := i
+			for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!"} {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, token{tokOp, op, start})
+					i += len(op)
+					break
+				}
+			}
+			if i == start {
+				return nil, fmt.Errorf("condition: unexpected %q at position %d", string(c), i)
+			}
+		}
+	}
+	toks = append(toks, token{tokEOF, "", len(src)})
+	return toks, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package condition
+
+import (
+	"testing"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPayload, _ = gabs.ParseJSON([]byte(`{
+	"initial_input": {"sku": "ABC123", "qty": 2, "showReviews": true},
+	"data": {"stock": 5, "tags": ["sale", "new"], "price": {"currency": "usd"}},
+	"return_value": {},
+	"config": {"secret": 1}
+}`))
+
+func TestEval(t *testing.T) {
+	cases := map[string]bool{
+		`data.stock > 0`:                                   true,
+		`data.stock >= 5 && data.stock <= 5`:               true,
+		`data.stock < initial_input.qty`:                   false,
+		`initial_input.sku == "ABC123"`:                    true,
+		`initial_input.sku != 'ABC123'`:                    false,
+		`initial_input.showReviews`:                        true,
+		`!initial_input.showReviews || data.stock == 5`:    true,
+		`exists(return_value.price)`:                       false,
+		`!exists(return_value.price) && exists(data.tags)`: true,
+		`data.tags.1 == "new"`:                             true,
+		`data.price.currency == "usd" && (data.stock > 10 || initial_input.qty == 2)`: true,
+		`data.missing == null`: true,
+		`data.stock > "a"`:     false,
+		`return_value`:         false,
+	}
+	for src, expected := range cases {
+		expr, err := Parse(src)
+		if assert.Nil(t, err, "Should parse: "+src) {
+			assert.Equal(t, expected, expr.Eval(testPayload), "Should evaluate: "+src)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		``,
+		`data.stock >`,
+		`config.secret == 1`,
+		`(data.stock > 1`,
+		`data.stock = 1`,
+		`exists(1)`,
+		`"unterminated`,
+		`data..stock`,
+	}
+	for _, src := range bad {
+		_, err := Parse(src)
+		assert.NotNil(t, err, "Should not parse: "+src)
+	}
+}
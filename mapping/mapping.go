@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package mapping reshapes a payload between commands with a list of declarative rules, so workers that expect
+// different field names don't need glue workers in between. Rules look like:
+//
+//	{"op": "copy", "from": "initial_input.sku", "to": "data.productId"}
+//	{"op": "rename", "from": "data.qty", "to": "data.quantity"}
+//	{"op": "delete", "path": "data.internalNotes"}
+//	{"op": "default", "path": "params.currency", "value": "usd"}
+//
+// Paths are dotted, ie: data.price.amount, and are read from initial_input, data, return_value or params.
+// Only data, return_value and params can be written to. Array elements can be read by index, ie: data.tags.0,
+// but not written.
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/TeamFairmont/boltengine/condition"
+	"github.com/TeamFairmont/gabs"
+)
+
+// Rule operations
+const (
+	Copy    = "copy"    //Copies the value at From to To
+	Rename  = "rename"  //Moves the value at From to To
+	Delete  = "delete"  //Removes the value at Path
+	Default = "default" //Sets Path to Value if nothing is there yet
+)
+
+// ReadRoots are the payload sections a rule may read from
+var ReadRoots = []string{"initial_input", "data", "return_value", "params"}
+
+// WriteRoots are the payload sections a rule may write to
+var WriteRoots = []string{"data", "return_value", "params"}
+
+// Rule is a single mapping step
+type Rule struct {
+	Op    string      `json:"op"`
+	From  string      `json:"from"`  //Source path for copy and rename
+	To    string      `json:"to"`    //Target path for copy and rename
+	Path  string      `json:"path"`  //Target path for delete and default
+	Value interface{} `json:"value"` //Value set by default
+}
+
+// Rules is a list of mapping steps, applied in order
+type Rules []Rule
+
+// Validate checks every rule has a known op and usable paths
+func (rules Rules) Validate() error {
+	for i, rule := range rules {
+		var err error
+		switch rule.Op {
+		case Copy:
+			err = checkPath(rule.From, ReadRoots)
+			if err == nil {
+				err = checkWritePath(rule.To)
+			}
+		case Rename:
+			err = checkWritePath(rule.From)
+			if err == nil {
+				err = checkWritePath(rule.To)
+			}
+			if err == nil && strings.HasPrefix(rule.To+".", rule.From+".") {
+				err = fmt.Errorf("can't rename %s to %s, it would be deleted along with its source", rule.From, rule.To)
+			}
+		case Delete, Default:
+			err = checkWritePath(rule.Path)
+		default:
+			err = fmt.Errorf("unknown op %q", rule.Op)
+		}
+		if err != nil {
+			return fmt.Errorf("mapping rule %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Apply runs the rules against payload in order. It stops at the first rule that fails, such as a copy from
+// a path that doesn't exist, so payload may be partly mapped when an error is returned.
+func (rules Rules) Apply(payload *gabs.Container) error {
+	for i, rule := range rules {
+		var err error
+		switch rule.Op {
+		case Copy, Rename:
+			value := condition.Lookup(payload.Data(), strings.Split(rule.From, "."))
+			if value == nil {
+				err = fmt.Errorf("%s from %s: nothing at path", rule.Op, rule.From)
+				break
+			}
+			_, err = payload.SetP(deepCopy(value), rule.To)
+			if err == nil && rule.Op == Rename {
+				err = payload.DeleteP(rule.From)
+			}
+		case Delete:
+			if condition.Lookup(payload.Data(), strings.Split(rule.Path, ".")) != nil {
+				err = payload.DeleteP(rule.Path)
+			}
+		case Default:
+			if condition.Lookup(payload.Data(), strings.Split(rule.Path, ".")) == nil {
+				_, err = payload.SetP(deepCopy(rule.Value), rule.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", rule.Op)
+		}
+		if err != nil {
+			return fmt.Errorf("mapping rule %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// checkPath makes sure path is a dotted path below one of roots
+func checkPath(path string, roots []string) error {
+	if path == "" {
+		return errors.New("missing path")
+	}
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("bad path %q", path)
+		}
+	}
+	if len(parts) > 1 {
+		for _, root := range roots {
+			if parts[0] == root {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("path %q must be below one of %s", path, strings.Join(roots, ", "))
+}
+
+// checkWritePath is checkPath for a path that's written to. Array elements can't be written, so paths through an
+// index are refused.
+func checkWritePath(path string) error {
+	err := checkPath(path, WriteRoots)
+	if err != nil {
+		return err
+	}
+	for _, part := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			return fmt.Errorf("path %q can't write to an array element", path)
+		}
+	}
+	return nil
+}
+
+// deepCopy copies decoded JSON objects and arrays, so a mapped value doesn't share them with its source
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = deepCopy(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = deepCopy(item)
+		}
+		return a
+	}
+	return value
+}
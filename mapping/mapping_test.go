@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mapping
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseRules(t *testing.T, src string) Rules {
+	rules := Rules{}
+	assert.Nil(t, json.Unmarshal([]byte(src), &rules), "Rules should parse")
+	return rules
+}
+
+func TestApply(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(`{
+		"initial_input": {"sku": "ABC123", "tags": ["sale"]},
+		"data": {"qty": 2, "notes": "x", "price": {"amount": 5}},
+		"return_value": {},
+		"params": {}
+	}`))
+	rules := parseRules(t, `[
+		{"op": "copy", "from": "initial_input.sku", "to": "data.productId"},
+		{"op": "copy", "from": "initial_input.tags.0", "to": "data.tag"},
+		{"op": "rename", "from": "data.qty", "to": "data.quantity"},
+		{"op": "copy", "from": "data.price", "to": "return_value.price"},
+		{"op": "delete", "path": "data.notes"},
+		{"op": "delete", "path": "data.missing"},
+		{"op": "default", "path": "params.currency", "value": "usd"},
+		{"op": "default", "path": "data.productId", "value": "unused"}
+	]`)
+	assert.Nil(t, rules.Validate(), "Rules should validate")
+	assert.Nil(t, rules.Apply(payload), "Rules should apply")
+
+	assert.Equal(t, "ABC123", payload.Path("data.productId").Data(), "Copy should set the target")
+	assert.Equal(t, "ABC123", payload.Path("initial_input.sku").Data(), "Copy should keep the source")
+	assert.Equal(t, "sale", payload.Path("data.tag").Data(), "Copy should read array elements")
+	assert.Equal(t, float64(2), payload.Path("data.quantity").Data(), "Rename should set the target")
+	assert.Nil(t, payload.Path("data.qty").Data(), "Rename should remove the source")
+	assert.Nil(t, payload.Path("data.notes").Data(), "Delete should remove the path")
+	assert.Equal(t, "usd", payload.Path("params.currency").Data(), "Default should fill a missing path")
+
+	payload.SetP(10, "return_value.price.amount")
+	assert.Equal(t, float64(5), payload.Path("data.price.amount").Data(), "Copied objects shouldn't be shared")
+}
+
+func TestApplyMissingSource(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(`{"data": {}}`))
+	rules := parseRules(t, `[{"op": "copy", "from": "data.missing", "to": "data.x"}]`)
+	assert.NotNil(t, rules.Apply(payload), "Copy from a missing path should error")
+}
+
+func TestValidate(t *testing.T) {
+	bad := []string{
+		`[{"op": "move", "from": "data.a", "to": "data.b"}]`,
+		`[{"op": "copy", "from": "data.a"}]`,
+		`[{"op": "copy", "from": "data.a", "to": "initial_input.b"}]`,
+		`[{"op": "rename", "from": "initial_input.a", "to": "data.b"}]`,
+		`[{"op": "delete", "path": "data"}]`,
+		`[{"op": "default", "path": "data..a", "value": 1}]`,
+		`[{"op": "copy", "from": "config.secret", "to": "data.b"}]`,
+		`[{"op": "rename", "from": "data.a", "to": "data.a.b"}]`,
+		`[{"op": "rename", "from": "data.a", "to": "data.a"}]`,
+		`[{"op": "copy", "from": "data.a", "to": "data.tags.0"}]`,
+		`[{"op": "rename", "from": "data.tags.0", "to": "data.b"}]`,
+		`[{"op": "delete", "path": "data.tags.1.name"}]`,
+	}
+	for _, src := range bad {
+		assert.NotNil(t, parseRules(t, src).Validate(), "Should not validate: "+src)
+	}
+}
+
+func TestValidateGood(t *testing.T) {
+	good := []string{
+		`[{"op": "copy", "from": "initial_input.tags.0", "to": "data.tag"}]`,
+		`[{"op": "rename", "from": "data.a", "to": "data.ab"}]`,
+		`[{"op": "rename", "from": "data.a.b", "to": "data.a2"}]`,
+	}
+	for _, src := range good {
+		assert.Nil(t, parseRules(t, src).Validate(), "Should validate: "+src)
+	}
+}
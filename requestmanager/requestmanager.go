@@ -7,6 +7,7 @@ package requestmanager
 
 import (
 	"encoding/json"
+	"hash/fnv"
 	"sync"
 	"time"
 
@@ -20,19 +21,28 @@ var (
 	cou = 0
 )
 
+// saveLockCount is how many locks a RequestManager spreads its requests' saves over, see saveLock
+const saveLockCount = 64
+
 // RequestManager for use tracking CommandProcess
 type RequestManager struct {
 	requests       map[string]*commandprocess.CommandProcess
+	saved          map[string]bool //Requests saved to the store at least once, guarded by mutex
+	store          Store
+	node           string //Owner saved with each request, see NewSharedRequestManager
+	shared         bool
 	newRequestChan chan newRequest
 	getRequestChan chan getRequest
-	delRequestChan chan string
+	delRequestChan chan delRequest
 	mutex          sync.RWMutex
+
+	saveLocks [saveLockCount]sync.Mutex //keeps the store writes of one request in order, see saveLock
 }
 
 // newRequest is an internal type used to pass to the goroutine a new commandprocess
 type newRequest struct {
-	cp *commandprocess.CommandProcess
-	//returnChan chan int
+	cp         *commandprocess.CommandProcess
+	returnChan chan int
 }
 
 // getRequest is an internal type used to pass to the goroutine a request ID to return
@@ -41,13 +51,41 @@ type getRequest struct {
 	returnChan chan *commandprocess.CommandProcess
 }
 
-// NewRequestManager inits a manager for use tracking CommandProcess
+// delRequest is an internal type used to pass to the goroutine a request ID to remove
+type delRequest struct {
+	id         string
+	returnChan chan int
+}
+
+// NewRequestManager inits a manager for use tracking CommandProcess, that keeps its requests in memory only
 func NewRequestManager() *RequestManager {
+	return NewRequestManagerWithStore(NewMapStore())
+}
+
+// NewRequestManagerWithStore inits a manager for use tracking CommandProcess, that persists requests saved
+// with SaveRequest to store. Call Restore to load the requests already in the store.
+func NewRequestManagerWithStore(store Store) *RequestManager {
+	return newRequestManager(store, "", false)
+}
+
+// NewSharedRequestManager inits a manager whose store is shared by several engine nodes. Each node processes
+// the requests it creates and saves them as owned by node, which must be unique to the node. Requests saved by
+// other nodes can be read with GetSharedRequest, and aren't touched by Restore. A request another node removes
+// from the store, ie: by fetching it, is no longer tracked by its owner either.
+func NewSharedRequestManager(store Store, node string) *RequestManager {
+	return newRequestManager(store, node, true)
+}
+
+func newRequestManager(store Store, node string, shared bool) *RequestManager {
 	rm := RequestManager{}
 	rm.requests = make(map[string]*commandprocess.CommandProcess)
+	rm.saved = make(map[string]bool)
+	rm.store = store
+	rm.node = node
+	rm.shared = shared
 	rm.newRequestChan = make(chan newRequest)
 	rm.getRequestChan = make(chan getRequest)
-	rm.delRequestChan = make(chan string) //should this have a buffer & config var ?
+	rm.delRequestChan = make(chan delRequest) //should this have a buffer & config var ?
 
 	go func() { //uses done channel to exit on reboot
 		for {
@@ -56,15 +94,17 @@ func NewRequestManager() *RequestManager {
 				rm.mutex.Lock()
 				rm.requests[nr.cp.ID] = nr.cp
 				rm.mutex.Unlock()
-				//nr.returnChan <- 0
+				nr.returnChan <- 0
 			case gr := <-rm.getRequestChan:
 				rm.mutex.RLock()
 				gr.returnChan <- rm.requests[gr.id]
 				rm.mutex.RUnlock()
-			case id := <-rm.delRequestChan:
+			case dr := <-rm.delRequestChan:
 				rm.mutex.Lock()
-				delete(rm.requests, id)
+				delete(rm.requests, dr.id)
+				delete(rm.saved, dr.id)
 				rm.mutex.Unlock()
+				dr.returnChan <- 0
 			case <-utils.GetDoneChannel(): //if done channel is closed
 				return
 			}
@@ -83,13 +123,24 @@ func (rm *RequestManager) Count() int {
 // Returns the created CommandProcess instance
 func (rm *RequestManager) CreateRequest(reqtype int, cmd string, apicall *config.APICall, payload *gabs.Container, appID, requestKey string) *commandprocess.CommandProcess {
 	cp := commandprocess.NewCommandProcess(reqtype, cmd, apicall, payload, appID, requestKey)
-	req := newRequest{cp}
-	rm.newRequestChan <- req
-	//<-req.returnChan
-	//id := <-req.returnChan
+	rm.track(cp)
 	return cp
 }
 
+// track adds cp to the requests, it's tracked once track returns
+func (rm *RequestManager) track(cp *commandprocess.CommandProcess) {
+	req := newRequest{cp, make(chan int)}
+	rm.newRequestChan <- req
+	<-req.returnChan
+}
+
+// tracks returns true if cp is the request tracked for its id
+func (rm *RequestManager) tracks(cp *commandprocess.CommandProcess) bool {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	return rm.requests[cp.ID] == cp
+}
+
 // GetRequest Looks up a known request by UUID. Returns nil if not found
 func (rm *RequestManager) GetRequest(id string) *commandprocess.CommandProcess {
 	gr := getRequest{id, make(chan *commandprocess.CommandProcess)}
@@ -97,9 +148,114 @@ func (rm *RequestManager) GetRequest(id string) *commandprocess.CommandProcess {
 	return <-gr.returnChan
 }
 
-// RemoveRequest removes a known request by UUID
+// SaveRequest snapshots a request to the manager's store, if it's still tracked. It's saved by the calling
+// goroutine, so a slow store doesn't hold up other requests. cp's mutex must not be held.
+func (rm *RequestManager) SaveRequest(cp *commandprocess.CommandProcess) error {
+	lock := rm.saveLock(cp.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	//requests removed before they're saved stay removed, see RemoveRequest
+	if !rm.tracks(cp) {
+		return nil
+	}
+	data, err := encodeRequest(rm.node, cp)
+	if err != nil {
+		return err
+	}
+
+	//a shared request missing from the store was removed by another node, so it's removed here too
+	rm.mutex.RLock()
+	saved := rm.saved[cp.ID]
+	rm.mutex.RUnlock()
+	if rm.shared && saved {
+		updated, err := rm.store.Update(cp.ID, data)
+		if err == nil && !updated {
+			rm.untrack(cp.ID)
+		}
+		return err
+	}
+
+	err = rm.store.Save(cp.ID, data)
+	if err == nil {
+		rm.mutex.Lock()
+		rm.saved[cp.ID] = true
+		rm.mutex.Unlock()
+	}
+	return err
+}
+
+// saveLock returns the lock held while saving or deleting the request id. Snapshots are taken and written with
+// it held, so a later snapshot is never overwritten by an earlier one.
+func (rm *RequestManager) saveLock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &rm.saveLocks[h.Sum32()%saveLockCount]
+}
+
+// Restore loads the requests saved in the manager's store. restore is called for each one before it's tracked
+// again, it must set the request's APICall and returns false to drop the request instead. Requests that can't
+// be read or are dropped are deleted from the store, requests owned by other nodes are left alone. Returns the
+// number of requests restored.
+func (rm *RequestManager) Restore(restore func(cp *commandprocess.CommandProcess) bool) (int, error) {
+	saved, err := rm.store.Load()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for id, data := range saved {
+		cp, owner, err := decodeRequest(data)
+		if err == nil && owner != rm.node {
+			continue
+		}
+		if err != nil || cp.ID != id || !restore(cp) {
+			rm.store.Delete(id)
+			continue
+		}
+		rm.track(cp)
+		rm.SaveRequest(cp)
+		count++
+	}
+	return count, nil
+}
+
+// GetSharedRequest looks up a request saved to a shared store by another node. The request is a snapshot as of
+// its owner's last save, it isn't tracked by this manager. Returns nil if the request isn't saved or the manager
+// isn't shared. Removing the request with RemoveRequest deletes it from the store.
+func (rm *RequestManager) GetSharedRequest(id string) (*commandprocess.CommandProcess, error) {
+	if !rm.shared {
+		return nil, nil
+	}
+	data, err := rm.store.Get(id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	cp, _, err := decodeRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Close closes the manager's store
+func (rm *RequestManager) Close() error {
+	return rm.store.Close()
+}
+
+// RemoveRequest removes a known request by UUID, and deletes it from the store
 func (rm *RequestManager) RemoveRequest(id string) {
-	rm.delRequestChan <- id
+	rm.untrack(id)
+
+	lock := rm.saveLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	rm.store.Delete(id)
+}
+
+// untrack removes a request from the requests, it's no longer tracked once untrack returns
+func (rm *RequestManager) untrack(id string) {
+	dr := delRequest{id, make(chan int)}
+	rm.delRequestChan <- dr
+	<-dr.returnChan
 }
 
 // ExpireCompletedRequests loops through all requests that have completed and expires the request if the timeout is reached
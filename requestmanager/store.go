@@ -0,0 +1,308 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package requestmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+)
+
+// Store types for NewStore
+const (
+	StoreMap   = "map"   //In memory only, requests are lost when the engine stops. The default
+	StoreFile  = "file"  //One json file per request in a directory
+	StoreRedis = "redis" //A redis hash
+)
+
+// Store persists the requests a RequestManager tracks, so task results outlive the engine process. Requests are
+// saved as opaque json, keyed by request id. Implementations must be safe for concurrent use.
+type Store interface {
+	Save(id string, data []byte) error
+	Update(id string, data []byte) (bool, error) //Saves id only if it's already saved, returns false if it isn't
+	Get(id string) ([]byte, error)               //Returns nil data if id isn't saved
+	Delete(id string) error
+	Load() (map[string][]byte, error) //Every saved request, by id
+	Close() error
+}
+
+// NewStore creates a store of type storeType. path is the directory of a file store, the key prefix of a redis
+// store. host and pass are only used by a redis store. File and redis stores drop requests that haven't been
+// saved for expiration, so those of a node that stopped don't stay forever.
+func NewStore(storeType, path, host, pass string, expiration time.Duration) (Store, error) {
+	switch storeType {
+	case "", StoreMap:
+		return NewMapStore(), nil
+	case StoreFile:
+		return NewFileStore(path, expiration)
+	case StoreRedis:
+		return NewRedisStore(host, pass, path, expiration)
+	}
+	return nil, fmt.Errorf("requestmanager: unknown store type %s", storeType)
+}
+
+// IsStoreType returns true if storeType is a store NewStore can create
+func IsStoreType(storeType string) bool {
+	switch storeType {
+	case "", StoreMap, StoreFile, StoreRedis:
+		return true
+	}
+	return false
+}
+
+// record is what's saved for a request. CommandProcess only marshals its metadata, the payload and the fields
+// hidden from status output are saved next to it. Owner is the node processing the request, see
+// NewSharedRequestManager.
+type record struct {
+	Owner        string                         `json:"owner"`
+	Process      *commandprocess.CommandProcess `json:"process"`
+	Payload      json.RawMessage                `json:"payload"`
+	InitialInput string                         `json:"initialInput"`
+	HMACToken    string                         `json:"token"`
+}
+
+// encodeRequest snapshots cp, owned by node, for a Store. cp's mutex must not be held.
+func encodeRequest(node string, cp *commandprocess.CommandProcess) ([]byte, error) {
+	cp.Mutex.RLock()
+	defer cp.Mutex.RUnlock()
+	rec := record{Owner: node, Process: cp, InitialInput: cp.InitialInputString, HMACToken: cp.HMACToken}
+	if cp.Payload != nil {
+		rec.Payload = cp.Payload.Bytes()
+	}
+	return json.Marshal(rec)
+}
+
+// decodeRequest rebuilds a CommandProcess saved by encodeRequest and returns the node that owns it. Its APICall
+// isn't saved, it has to be looked up again from the config.
+func decodeRequest(data []byte) (cp *commandprocess.CommandProcess, owner string, err error) {
+	rec := record{}
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, "", err
+	}
+	if rec.Process == nil || rec.Process.ID == "" {
+		return nil, "", fmt.Errorf("requestmanager: saved request has no id")
+	}
+	cp = rec.Process
+	cp.InitialInputString = rec.InitialInput
+	cp.HMACToken = rec.HMACToken
+	cp.Payload, err = gabs.ParseJSON([]byte(commandprocess.EmptyPayload))
+	if len(rec.Payload) > 0 {
+		cp.Payload, err = gabs.ParseJSON(rec.Payload)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	cp.CancelChannel = make(chan bool)
+	if cp.Cancelled {
+		close(cp.CancelChannel)
+	}
+	cp.CompleteChannel = make(chan bool)
+	if cp.Complete {
+		close(cp.CompleteChannel)
+	}
+	return cp, rec.Owner, nil
+}
+
+// MapStore keeps requests in memory, the same as not having a store
+type MapStore struct {
+	mutex sync.RWMutex
+	data  map[string][]byte
+}
+
+// NewMapStore creates an empty MapStore
+func NewMapStore() *MapStore {
+	return &MapStore{data: make(map[string][]byte)}
+}
+
+func (s *MapStore) Save(id string, data []byte) error {
+	s.mutex.Lock()
+	s.data[id] = data
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MapStore) Update(id string, data []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.data[id]; !ok {
+		return false, nil
+	}
+	s.data[id] = data
+	return true, nil
+}
+
+func (s *MapStore) Get(id string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.data[id], nil
+}
+
+func (s *MapStore) Delete(id string) error {
+	s.mutex.Lock()
+	delete(s.data, id)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MapStore) Load() (map[string][]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loaded := make(map[string][]byte, len(s.data))
+	for id, data := range s.data {
+		loaded[id] = data
+	}
+	return loaded, nil
+}
+
+func (s *MapStore) Close() error {
+	return nil
+}
+
+// FileStore keeps each request in <dir>/<id>.json. Files are written to a temp file first and renamed, so a crash
+// mid-write doesn't leave a broken request behind. Files not written for the store's expiration are deleted when
+// they're next read.
+type FileStore struct {
+	mutex      sync.Mutex
+	dir        string
+	expiration time.Duration //0 to keep files until they're deleted
+}
+
+// fileExt is the extension of the files in a FileStore
+const fileExt = ".json"
+
+// NewFileStore creates dir if needed and returns a store using it, keeping requests for expiration after their
+// last save
+func NewFileStore(dir string, expiration time.Duration) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("requestmanager: file store needs a directory")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, expiration: expiration}, nil
+}
+
+// file returns the path for id, the id is cleaned so it can't point outside the directory
+func (s *FileStore) file(id string) string {
+	return filepath.Join(s.dir, filepath.Base(filepath.Clean("/"+id))+fileExt)
+}
+
+// expired returns true if a file last written at modified has expired
+func (s *FileStore) expired(modified time.Time) bool {
+	return s.expiration > 0 && time.Since(modified) > s.expiration
+}
+
+func (s *FileStore) Save(id string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(id, data)
+}
+
+func (s *FileStore) Update(id string, data []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info, err := os.Stat(s.file(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if s.expired(info.ModTime()) {
+		os.Remove(s.file(id))
+		return false, nil
+	}
+	return true, s.write(id, data)
+}
+
+// write saves data for id, the mutex must be held
+func (s *FileStore) write(id string, data []byte) error {
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file(id))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *FileStore) Get(id string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info, err := os.Stat(s.file(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(info.ModTime()) {
+		os.Remove(s.file(id))
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.file(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := os.Remove(s.file(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) Load() (map[string][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string][]byte)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, fileExt) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if s.expired(f.ModTime()) {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		loaded[strings.TrimSuffix(name, fileExt)] = data
+	}
+	return loaded, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package requestmanager
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// defaultRedisKey is the key prefix a RedisStore uses when none is configured
+const defaultRedisKey = "bolt:requests"
+
+// redisScanCount is how many keys Load asks redis for at a time
+const redisScanCount = 100
+
+// RedisStore keeps each request under its own redis key, <key>:<id>, so each one can expire on its own
+type RedisStore struct {
+	client     *redis.Client
+	key        string
+	expiration time.Duration //0 to keep requests until they're deleted
+}
+
+// NewRedisStore connects to the redis server at host and checks it answers. Requests expire from redis
+// expiration after their last save.
+func NewRedisStore(host, pass, key string, expiration time.Duration) (*RedisStore, error) {
+	if key == "" {
+		key = defaultRedisKey
+	}
+	client := redis.NewClient(&redis.Options{Addr: host, Password: pass})
+	err := client.Ping().Err()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStore{client: client, key: key, expiration: expiration}, nil
+}
+
+// field returns the redis key of request id
+func (s *RedisStore) field(id string) string {
+	return s.key + ":" + id
+}
+
+func (s *RedisStore) Save(id string, data []byte) error {
+	return s.client.Set(s.field(id), string(data), s.expiration).Err()
+}
+
+func (s *RedisStore) Update(id string, data []byte) (bool, error) {
+	return s.client.SetXX(s.field(id), string(data), s.expiration).Result()
+}
+
+func (s *RedisStore) Get(id string) ([]byte, error) {
+	data, err := s.client.Get(s.field(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (s *RedisStore) Delete(id string) error {
+	return s.client.Del(s.field(id)).Err()
+}
+
+// Load scans for the store's keys rather than using KEYS, so redis isn't blocked while a large store loads
+func (s *RedisStore) Load() (map[string][]byte, error) {
+	loaded := make(map[string][]byte)
+	prefix := s.key + ":"
+	var cursor int64
+	for {
+		next, keys, err := s.client.Scan(cursor, prefix+"*", redisScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			data, err := s.client.Get(key).Result()
+			if err == redis.Nil { //expired or deleted since the scan
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			loaded[strings.TrimPrefix(key, prefix)] = []byte(data)
+		}
+		if next == 0 {
+			return loaded, nil
+		}
+		cursor = next
+	}
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
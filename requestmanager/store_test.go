@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package requestmanager
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TeamFairmont/boltengine/commandprocess"
+	"github.com/TeamFairmont/gabs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "requests")
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err, "Should create the store")
+	assert.Nil(t, store.Save("abc", []byte(`{"a":1}`)), "Should save")
+	assert.Nil(t, store.Save("../def", []byte(`{"b":2}`)), "Ids shouldn't escape the directory")
+	assert.Nil(t, store.Save("abc", []byte(`{"a":2}`)), "Should overwrite")
+
+	data, _ := store.Get("abc")
+	assert.Equal(t, `{"a":2}`, string(data), "Should get the last save")
+	data, err = store.Get("xyz")
+	assert.Nil(t, data, "Unknown ids should be nil")
+	assert.Nil(t, err, "Unknown ids shouldn't error")
+
+	loaded, err := store.Load()
+	assert.Nil(t, err, "Should load")
+	assert.Equal(t, `{"a":2}`, string(loaded["abc"]), "Should load the last save")
+	assert.Equal(t, `{"b":2}`, string(loaded["def"]), "Should load the cleaned id")
+
+	assert.Nil(t, store.Delete("abc"), "Should delete")
+	assert.Nil(t, store.Delete("abc"), "Deleting twice shouldn't error")
+	loaded, _ = store.Load()
+	assert.Equal(t, 1, len(loaded), "Should have one request left")
+
+	_, err = NewStore("mongo", "", "", "", 0)
+	assert.NotNil(t, err, "Unknown stores should error")
+}
+
+func TestFileStoreExpiration(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "requests")
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFileStore(dir, time.Minute)
+	updated, err := store.Update("abc", []byte(`{"a":1}`))
+	assert.Nil(t, err, "Should update")
+	assert.False(t, updated, "Unsaved ids aren't updated")
+	store.Save("abc", []byte(`{"a":1}`))
+	store.Save("def", []byte(`{"b":1}`))
+	updated, _ = store.Update("abc", []byte(`{"a":2}`))
+	assert.True(t, updated, "Saved ids are updated")
+
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(store.file("def"), old, old)
+	data, _ := store.Get("def")
+	assert.Nil(t, data, "Expired requests should be gone")
+	loaded, _ := store.Load()
+	assert.Equal(t, 1, len(loaded), "Expired requests shouldn't load")
+	assert.Equal(t, `{"a":2}`, string(loaded["abc"]), "Should load the update")
+}
+
+func TestEncodeRequest(t *testing.T) {
+	payload, _ := gabs.ParseJSON([]byte(commandprocess.EmptyPayload))
+	cp := commandprocess.NewCommandProcessWithID("abc", commandprocess.CallTypeTask, "v1/test", nil, payload, "group", "token")
+	cp.SetInitialInput(gabs.New())
+	cp.Payload.SetP("done", "return_value.status")
+	cp.SetComplete()
+
+	data, err := encodeRequest("node1", cp)
+	assert.Nil(t, err, "Should encode")
+	restored, owner, err := decodeRequest(data)
+	assert.Nil(t, err, "Should decode")
+	assert.Equal(t, "node1", owner, "Should keep the owner")
+	assert.Equal(t, "abc", restored.ID, "Should keep the id")
+	assert.Equal(t, "token", restored.HMACToken, "Should keep the token")
+	assert.True(t, restored.Complete, "Should keep the complete state")
+	assert.Equal(t, cp.CompleteTime.Unix(), restored.CompleteTime.Unix(), "Should keep the complete time")
+	assert.Equal(t, "done", restored.Payload.Path("return_value.status").Data(), "Should keep the payload")
+	assert.NotNil(t, restored.CancelChannel, "Should make the cancel channel")
+
+	_, _, err = decodeRequest([]byte(`{"process": {}}`))
+	assert.NotNil(t, err, "Requests without an id should error")
+}
+
+// track adds a request with a known id to rm
+func track(rm *RequestManager, id, cmd string) *commandprocess.CommandProcess {
+	cp := commandprocess.NewCommandProcessWithID(id, commandprocess.CallTypeTask, cmd, nil, gabs.New(), "group", "")
+	rm.track(cp)
+	return cp
+}
+
+func TestRestore(t *testing.T) {
+	store := NewMapStore()
+	first := NewRequestManagerWithStore(store)
+	kept := track(first, "abc", "v1/keep")
+	dropped := track(first, "def", "v1/drop")
+	removed := track(first, "ghi", "v1/keep")
+	first.SaveRequest(kept)
+	first.SaveRequest(dropped)
+	first.RemoveRequest(removed.ID)
+	first.SaveRequest(removed)
+
+	second := NewRequestManagerWithStore(store)
+	count, err := second.Restore(func(cp *commandprocess.CommandProcess) bool {
+		return cp.InitialCommand == "v1/keep"
+	})
+	assert.Nil(t, err, "Should restore")
+	assert.Equal(t, 1, count, "Only the kept request should be restored")
+	assert.NotNil(t, second.GetRequest(kept.ID), "Kept request should be tracked")
+	assert.Nil(t, second.GetRequest(dropped.ID), "Dropped request shouldn't be tracked")
+
+	saved, _ := store.Load()
+	assert.Equal(t, 1, len(saved), "Dropped requests should be deleted from the store")
+	second.RemoveRequest(kept.ID)
+	second.GetRequest(kept.ID) //force channel sync
+	saved, _ = store.Load()
+	assert.Equal(t, 0, len(saved), "Removed requests should be deleted from the store")
+}
+
+// blockingStore is a MapStore whose saves wait on release, or fail once it's closed
+type blockingStore struct {
+	*MapStore
+	release chan error
+}
+
+func (s blockingStore) Save(id string, data []byte) error {
+	err := <-s.release
+	if err != nil {
+		return err
+	}
+	return s.MapStore.Save(id, data)
+}
+
+func TestSaveRequest(t *testing.T) {
+	store := blockingStore{NewMapStore(), make(chan error)}
+	rm := NewRequestManagerWithStore(store)
+	cp := track(rm, "abc", "v1/test")
+
+	saved := make(chan error)
+	go func() { saved <- rm.SaveRequest(cp) }()
+	done := make(chan bool)
+	go func() {
+		rm.GetRequest(cp.ID)
+		rm.CreateRequest(commandprocess.CallTypeTask, "v1/test", nil, gabs.New(), "group", "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("A slow save shouldn't hold up other requests")
+	}
+
+	store.release <- errors.New("store down")
+	assert.NotNil(t, <-saved, "Store errors should be returned")
+	go func() { store.release <- nil }()
+	assert.Nil(t, rm.SaveRequest(cp), "Should save")
+	data, _ := store.Get(cp.ID)
+	assert.NotNil(t, data, "Should be in the store")
+}
+
+func TestSharedRequestManager(t *testing.T) {
+	store := NewMapStore()
+	node1 := NewSharedRequestManager(store, "node1")
+	node2 := NewSharedRequestManager(store, "node2")
+	cp := track(node1, "abc", "v1/test")
+	node1.SaveRequest(cp)
+	node1.GetRequest(cp.ID) //force channel sync
+
+	assert.Nil(t, node2.GetRequest(cp.ID), "Other nodes don't track the request")
+	shared, err := node2.GetSharedRequest(cp.ID)
+	assert.Nil(t, err, "Should read the shared request")
+	assert.Equal(t, "v1/test", shared.InitialCommand, "Should read the owner's snapshot")
+	shared, _ = node2.GetSharedRequest("xyz")
+	assert.Nil(t, shared, "Unknown ids should be nil")
+
+	count, _ := node2.Restore(func(cp *commandprocess.CommandProcess) bool { return true })
+	assert.Equal(t, 0, count, "Other nodes' requests shouldn't be restored")
+
+	node2.RemoveRequest(cp.ID)
+	shared, _ = node1.GetSharedRequest(cp.ID)
+	assert.Nil(t, shared, "Removing from any node should delete from the store")
+	assert.Nil(t, node1.SaveRequest(cp), "Saving a removed request shouldn't error")
+	shared, _ = node2.GetSharedRequest(cp.ID)
+	assert.Nil(t, shared, "The owner shouldn't save a request removed by another node")
+	assert.Nil(t, node1.GetRequest(cp.ID), "The owner should stop tracking a request removed by another node")
+
+	shared, _ = NewRequestManagerWithStore(store).GetSharedRequest(cp.ID)
+	assert.Nil(t, shared, "Unshared managers only see their own requests")
+}